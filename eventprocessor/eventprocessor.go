@@ -3,10 +3,16 @@ package eventprocessor
 import (
 	"context"
 	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/honeycombio/honeycomb-lambda-extension/eventpublisher"
 	"github.com/honeycombio/honeycomb-lambda-extension/extension"
-	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
+	"github.com/honeycombio/honeycomb-lambda-extension/telemetryapi"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,43 +20,170 @@ var (
 	log = logrus.WithFields(logrus.Fields{
 		"source": "hny-lambda-ext-eventprocessor",
 	})
+	// ExtensionTypeField is the field name for the kind of event the extension
+	// sends of its own, such as a shutdown reason or self-telemetry
+	ExtensionTypeField = "lambda_extension.type"
 	// ShutdownReasonFieldExtensionType is the field name for shutdown reason in shutdown reason event
-	ShutdownReasonFieldExtensionType = "lambda_extension.type"
+	ShutdownReasonFieldExtensionType = ExtensionTypeField
 	// ShutdownReasonFieldRequestID is the field name used for request ID in shutdown reason event
 	ShutdownReasonFieldRequestID = "requestId"
 	// ShutdownReasonFieldInvokedFunctionARN is the field name used for function arn in shutdown reason event
 	ShutdownReasonFieldInvokedFunctionARN = "invokedFunctionArn"
+	// ShutdownReasonFieldInFlightRequestIDs is the field name used on Lambda Managed Instances for the
+	// request IDs of all invocations still running at the time of the shutdown
+	ShutdownReasonFieldInFlightRequestIDs = "inFlightRequestIds"
+)
+
+const (
+	// Backoff bounds applied between failed calls to NextEvent, so that an
+	// unreachable Runtime API doesn't turn into a busy loop stealing CPU from
+	// the function.
+	nextEventInitialBackoff = 100 * time.Millisecond
+	nextEventMaxBackoff     = 5 * time.Second
+	// After this many consecutive failures the extension gives up and exits.
+	nextEventMaxAttempts = 10
+	// nextEventErrorType is reported to the Extensions API when giving up
+	nextEventErrorType = "Extension.NextEventFailed"
+	// apiKeyRejectedErrorType is reported to the Extensions API when exiting
+	// because Honeycomb keeps rejecting the API key
+	apiKeyRejectedErrorType = "Extension.APIKeyRejected"
+	// exitErrorTimeout bounds how long reporting an exit error may take
+	exitErrorTimeout = time.Second
+	// shutdownDeadlineMargin is kept in hand before the SHUTDOWN deadline, so
+	// the extension exits before Lambda kills it
+	shutdownDeadlineMargin = 100 * time.Millisecond
+	// shutdownQuietPeriod is how long the receiver must go without a telemetry
+	// batch after SHUTDOWN before the final batch is considered delivered
+	shutdownQuietPeriod = 200 * time.Millisecond
+	// receiverDrainTimeout bounds draining the receiver when SHUTDOWN has no
+	// deadline to go by
+	receiverDrainTimeout = 500 * time.Millisecond
 )
 
 // eventPoller is the interface that provides a next event for the event processor
+// and a way to report that the extension is giving up
 type eventPoller interface {
 	NextEvent(ctx context.Context) (*extension.NextEventResponse, error)
+	ExitError(ctx context.Context, errorType string, err error) error
 }
 
-// eventFlusher is the interface that provides a way to create new libhoney events and flush them
+// eventFlusher is the interface that provides a way to create and publish new
+// events and flush them
 type eventFlusher interface {
-	NewEvent() *libhoney.Event
+	NewEvent() *publisher.Event
+	Publish(ev *publisher.Event) error
 	Flush()
 }
 
+// forwardSender is implemented by flushers that also forward events to
+// destinations of their own, such as syslog, whose background senders are
+// woken at the end of every invocation when flushing in the background
+type forwardSender interface {
+	SendForwardersSoon()
+}
+
+// spoolReplayer is implemented by flushers that spool events that failed to
+// send, so they can have another go at sending them at shutdown
+type spoolReplayer interface {
+	ReplaySpool()
+	SpooledEvents() int
+}
+
+// deadlineSetter is implemented by flushers that retry failed sends, so that
+// retries don't run past the deadline of the event being processed
+type deadlineSetter interface {
+	SetDeadline(deadline time.Time)
+}
+
+// degradedReporter is implemented by flushers that can tell when sends are
+// persistently failing in a way that won't fix itself
+type degradedReporter interface {
+	Degraded() error
+}
+
+// telemetryReceiver is the interface to the Telemetry API receiver, which is
+// shut down and drained before the final flush so that no telemetry already
+// delivered by Lambda is left behind
+type telemetryReceiver interface {
+	Shutdown(ctx context.Context) error
+}
+
 // Server represents a server that polls and processes Lambda extension events
 type Server struct {
 	extensionClient    eventPoller
-	libhoneyClient     eventFlusher
+	publisher          eventFlusher
+	tracker            *InvocationTracker
+	receiver           telemetryReceiver
 	invokedFunctionARN string
 	lastRequestId      string
+	nextEventFailures  int
+	postInvokeTimeout  time.Duration
+	selfTelemetry      *selfTelemetry
+	exitOnAuthFailure  bool
+	exitOnce           sync.Once
+
+	// On Lambda Managed Instances only SHUTDOWN is delivered by NextEvent, so
+	// flushes are driven by time and received volume instead of by INVOKE. The
+	// async flush strategy uses the same background flushing, plus a flush
+	// every flushEveryInvocations invocations.
+	managedInstances      bool
+	flushStrategy         extension.FlushStrategy
+	flushInterval         time.Duration
+	flushMaxBytes         int
+	flushEveryInvocations int
+	flushMinRemaining     time.Duration
+	flushMu               sync.Mutex
+	flushRequests         chan struct{}
+	invokesSinceFlush     atomic.Int64
 }
 
-// New takes an eventPoller and eventFlusher and returns a Server
-func New(extensionClient eventPoller, libhoneyClient eventFlusher) *Server {
+// New takes the extension config, an eventPoller, an eventFlusher, the
+// InvocationTracker fed by the Telemetry API receiver and the receiver itself,
+// and returns a Server. receiver may be nil if there is nothing to drain.
+func New(config extension.Config, extensionClient eventPoller, eventPublisher eventFlusher, tracker *InvocationTracker, receiver telemetryReceiver) *Server {
+	postInvokeTimeout := config.PostInvokeTimeout
+	if config.LogsAPIDisablePlatformMessages {
+		// without platform events there's no platform.runtimeDone to wait for
+		postInvokeTimeout = 0
+	}
 	return &Server{
-		extensionClient: extensionClient,
-		libhoneyClient:  libhoneyClient,
+		extensionClient:   extensionClient,
+		publisher:         eventPublisher,
+		tracker:           tracker,
+		receiver:          receiver,
+		managedInstances:  config.IsManagedInstances,
+		flushInterval:     config.FlushInterval,
+		flushMaxBytes:     config.FlushMaxBytes,
+		postInvokeTimeout: postInvokeTimeout,
+		selfTelemetry:     newSelfTelemetry(config),
+		exitOnAuthFailure: config.ExitOnAuthFailure,
+
+		flushStrategy:         config.FlushStrategy,
+		flushEveryInvocations: config.FlushEveryInvocations,
+		flushMinRemaining:     config.FlushMinRemaining,
+		flushRequests:         make(chan struct{}, 1),
 	}
 }
 
+// flushesInBackground reports whether events are flushed by a background
+// goroutine rather than at the end of every invocation
+func (s *Server) flushesInBackground() bool {
+	return s.managedInstances || s.flushStrategy == extension.FlushStrategyAsync
+}
+
 // Run executes an event loop to poll and process events from the Lambda extension API
 func (s *Server) Run(ctx context.Context, cancel context.CancelFunc) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	if s.flushesInBackground() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.flushPeriodically(ctx, cancel)
+		}()
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -61,56 +194,368 @@ func (s *Server) Run(ctx context.Context, cancel context.CancelFunc) {
 	}
 }
 
+// flushPeriodically flushes events every flushInterval, or sooner once
+// flushMaxBytes of telemetry have been received or a flush is requested, until
+// ctx is cancelled.
+func (s *Server) flushPeriodically(ctx context.Context, cancel context.CancelFunc) {
+	interval := s.flushInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.flush()
+		case <-s.flushRequests:
+			s.flush()
+		case <-s.tracker.enqueued:
+			if s.flushMaxBytes > 0 && s.tracker.PendingBytes() >= s.flushMaxBytes {
+				log.Debug("Flushing early, pending bytes exceeded threshold")
+				s.flush()
+			}
+		}
+		s.exitIfDegraded(ctx, cancel)
+	}
+}
+
+// flush sends all pending events, along with a self-telemetry event if one is
+// due. Flushes are serialized so that the periodic flusher and the event loop
+// don't interleave.
+func (s *Server) flush() {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.tracker.resetPendingBytes()
+	s.invokesSinceFlush.Store(0)
+	if s.selfTelemetry != nil {
+		s.selfTelemetry.send(s.publisher)
+	}
+	start := time.Now()
+	s.publisher.Flush()
+	metrics.Increment(MetricFlushes)
+	metrics.Gauge(MetricFlushDurationMS, time.Since(start).Milliseconds())
+}
+
+// flushAfter flushes events once an INVOKE or unknown event from NextEvent has
+// been processed. Every event flushes synchronously with the sync strategy.
+// With the async strategy, INVOKE only flushes synchronously when its deadline
+// is close; otherwise a background flush is requested every
+// flushEveryInvocations invocations, and the forwarders' background senders
+// are woken on every INVOKE so that they never hold up NextEvent.
+func (s *Server) flushAfter(res *extension.NextEventResponse) {
+	if !s.flushesInBackground() {
+		s.flush()
+		return
+	}
+	if res.EventType != extension.Invoke {
+		return
+	}
+	if res.DeadlineMS > 0 && time.Until(time.UnixMilli(res.DeadlineMS)) < s.flushMinRemaining {
+		log.Debug("Flushing synchronously, invocation deadline is close")
+		s.flush()
+		return
+	}
+	if forwarder, ok := s.publisher.(forwardSender); ok {
+		forwarder.SendForwardersSoon()
+	}
+	if s.flushEveryInvocations > 0 && s.invokesSinceFlush.Add(1) >= int64(s.flushEveryInvocations) {
+		select {
+		case s.flushRequests <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // pollEventAndProcess polls the Lambda extension next event API and processes a single event
 func (s *Server) pollEventAndProcess(ctx context.Context, cancel context.CancelFunc) {
 	// Poll for event
 	res, err := s.extensionClient.NextEvent(ctx)
 	if err != nil {
-		log.WithError(err).Warn("Error from NextEvent")
+		if ctx.Err() != nil {
+			return
+		}
+		s.handleNextEventError(ctx, cancel, err)
 		return
 	}
+	s.nextEventFailures = 0
+	s.setDeadline(res)
 
-	// Ensure a flush happens and cancel is called if its a shutdown event
+	// Ensure a flush happens or is scheduled before polling again, and cancel is called if its a shutdown event
 	defer func() {
-		s.libhoneyClient.Flush()
 		if res.EventType == extension.Shutdown {
 			log.Warn("Received Lambda " + extension.Shutdown + ", events flushed and extension is shutting down.")
 			cancel()
+			return
 		}
+		s.flushAfter(res)
+		s.exitIfDegraded(ctx, cancel)
 	}()
 
 	// Handles event types
 	switch eventType := res.EventType; eventType {
 	case extension.Invoke:
 		log.Debug("Received INVOKE event.")
+		metrics.Increment(MetricInvocations)
 		s.lastRequestId = res.RequestID
 		s.invokedFunctionARN = res.InvokedFunctionARN
+		if !s.flushesInBackground() {
+			s.waitForRuntimeDone(ctx, res)
+		}
 	case extension.Shutdown:
 		log.Debug("Received SHUTDOWN event.")
-		if res.ShutdownReason != extension.ShutdownReasonSpindown && s.lastRequestId != "" {
-			log.WithField("res.ShutdownReason", res.ShutdownReason).Debug("Sending shutdown reason")
-			s.sendShutdownReason(res.ShutdownReason)
-		}
-		// wait for either result's deadline - 100 ms or 500ms, whichever is shorter
-		select {
-		case <-time.After(time.Duration(res.DeadlineMS-100) * time.Millisecond):
-			return
-		case <-time.After(500 * time.Millisecond):
-			return
-		}
+		s.shutdown(ctx, res)
 	default:
 		log.WithField("res", res).Debug("Received unknown event")
 	}
 }
 
-// sendShutdownReason sends and flushes an event with the shutdown reason. The last
-// request ID and function ARN will also be include in the generated event.
+// setDeadline bounds retries of failed sends by the deadline of the event from
+// NextEvent, less the margin kept in hand at shutdown.
+func (s *Server) setDeadline(res *extension.NextEventResponse) {
+	setter, ok := s.publisher.(deadlineSetter)
+	if !ok {
+		return
+	}
+	if res.DeadlineMS <= 0 {
+		setter.SetDeadline(time.Time{})
+		return
+	}
+	deadline := time.UnixMilli(res.DeadlineMS)
+	if res.EventType == extension.Shutdown {
+		deadline = deadline.Add(-shutdownDeadlineMargin)
+	}
+	setter.SetDeadline(deadline)
+}
+
+// shutdown sends the shutdown reason, gives the Telemetry API a chance to
+// deliver its final batch, drains the receiver, and flushes everything within
+// the time Lambda allows for shutdown. DeadlineMS is an absolute time in epoch
+// milliseconds; when it is missing there is nothing to bound the flush by.
+func (s *Server) shutdown(ctx context.Context, res *extension.NextEventResponse) {
+	received := time.Now()
+	defer s.logShutdownSummary()
+	if res.ShutdownReason != extension.ShutdownReasonSpindown {
+		s.sendShutdownReason(res.ShutdownReason)
+	}
+
+	if res.DeadlineMS <= 0 {
+		drainCtx, drainCancel := context.WithTimeout(ctx, receiverDrainTimeout)
+		s.drainReceiver(drainCtx)
+		drainCancel()
+		s.flush()
+		return
+	}
+
+	deadline := time.UnixMilli(res.DeadlineMS).Add(-shutdownDeadlineMargin)
+	flushCtx, flushCancel := context.WithDeadline(ctx, deadline)
+	defer flushCancel()
+
+	// spend no more than half of the remaining time waiting for the final batch
+	// and draining the receiver, leaving the rest for the flush
+	drainCtx, drainCancel := context.WithTimeout(flushCtx, time.Until(deadline)/2)
+	if !s.tracker.WaitQuiet(drainCtx, received, shutdownQuietPeriod) {
+		log.Debug("Telemetry still arriving at shutdown, flushing anyway")
+	}
+	s.drainReceiver(drainCtx)
+	drainCancel()
+
+	s.flushWithContext(flushCtx)
+	s.replaySpool(flushCtx)
+}
+
+// replaySpool sends spooled events in the time left before ctx is done, as
+// the spool won't outlive the execution environment.
+func (s *Server) replaySpool(ctx context.Context) {
+	replayer, ok := s.publisher.(spoolReplayer)
+	if !ok || ctx.Err() != nil || replayer.SpooledEvents() == 0 {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		replayer.ReplaySpool()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// logShutdownSummary logs how many events were received over the life of the
+// extension, how many were dropped because the ingestion queue was full, and
+// how many are left in the spool, to be lost with the execution environment.
+func (s *Server) logShutdownSummary() {
+	dropped := metrics.Default.Counter(eventpublisher.MetricQueueEventsDropped)
+	spooled := 0
+	if replayer, ok := s.publisher.(spoolReplayer); ok {
+		spooled = replayer.SpooledEvents()
+	}
+	summary := log.WithFields(logrus.Fields{
+		"events_received": metrics.Default.Counter(telemetryapi.MetricEventsReceived),
+		"events_dropped":  dropped,
+		"bytes_dropped":   metrics.Default.Counter(eventpublisher.MetricQueueBytesDropped),
+		"events_spooled":  spooled,
+	})
+	if dropped > 0 || spooled > 0 {
+		summary.Warn("Shutdown summary: some events were not sent")
+		return
+	}
+	summary.Info("Shutdown summary")
+}
+
+// drainReceiver shuts down the Telemetry API receiver, waiting for batches it
+// is still handling to be enqueued.
+func (s *Server) drainReceiver(ctx context.Context) {
+	if s.receiver == nil {
+		return
+	}
+	if err := s.receiver.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("Telemetry receiver did not drain before the final flush")
+	}
+}
+
+// flushWithContext flushes events, giving up when ctx is done. Anything still
+// pending when it gives up is reported in a log line, as there's no time left
+// to send it anywhere else.
+func (s *Server) flushWithContext(ctx context.Context) {
+	pendingBytes := s.tracker.PendingBytes()
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		s.flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithFields(logrus.Fields{
+			"pending_bytes": pendingBytes,
+			"flush_ms":      time.Since(start).Milliseconds(),
+			"in_flight":     s.tracker.InFlight(),
+		}).Warn("Shutdown deadline reached before events were flushed, unsent events will be lost")
+	}
+}
+
+// exitIfDegraded reports an exit error to the Extensions API and shuts the
+// extension down if it is configured to exit on auth failures and Honeycomb is
+// persistently rejecting the API key.
+func (s *Server) exitIfDegraded(ctx context.Context, cancel context.CancelFunc) {
+	if !s.exitOnAuthFailure {
+		return
+	}
+	reporter, ok := s.publisher.(degradedReporter)
+	if !ok {
+		return
+	}
+	err := reporter.Degraded()
+	if err == nil {
+		return
+	}
+	s.exitOnce.Do(func() {
+		log.WithError(err).Error("Sends are persistently failing, extension is exiting")
+		exitCtx, exitCancel := context.WithTimeout(ctx, exitErrorTimeout)
+		defer exitCancel()
+		if exitErr := s.extensionClient.ExitError(exitCtx, apiKeyRejectedErrorType, err); exitErr != nil {
+			log.WithError(exitErr).Warn("Unable to report exit error")
+		}
+		cancel()
+	})
+}
+
+// waitForRuntimeDone waits until the Telemetry API has delivered the invoke's
+// platform.runtimeDone, meaning the function's telemetry for it has been
+// enqueued, so that the flush that follows sends it before the sandbox may be
+// frozen. The wait is bounded by postInvokeTimeout and the invoke's deadline.
+func (s *Server) waitForRuntimeDone(ctx context.Context, res *extension.NextEventResponse) {
+	timeout := s.postInvokeTimeout
+	if timeout <= 0 || res.RequestID == "" {
+		return
+	}
+	if res.DeadlineMS > 0 {
+		timeout = min(timeout, time.Until(time.UnixMilli(res.DeadlineMS)))
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, timeout)
+	defer waitCancel()
+	start := time.Now()
+	if s.tracker.WaitDone(waitCtx, res.RequestID) {
+		log.WithField("wait", time.Since(start)).Debug("Invocation done, flushing")
+	} else {
+		log.WithField("timeout", timeout).Debug("Invocation not reported done within post-invoke timeout, flushing anyway")
+	}
+}
+
+// handleNextEventError waits out a jittered exponential backoff after a failed
+// call to NextEvent. If the error can't be retried, or it keeps happening, the
+// failure is reported to the Extensions API and the extension shuts down.
+func (s *Server) handleNextEventError(ctx context.Context, cancel context.CancelFunc, err error) {
+	s.nextEventFailures++
+	if !extension.IsRetryable(err) || s.nextEventFailures >= nextEventMaxAttempts {
+		log.WithError(err).WithField("attempts", s.nextEventFailures).Error("Giving up on NextEvent, extension is exiting")
+		exitCtx, exitCancel := context.WithTimeout(ctx, exitErrorTimeout)
+		defer exitCancel()
+		if exitErr := s.extensionClient.ExitError(exitCtx, nextEventErrorType, err); exitErr != nil {
+			log.WithError(exitErr).Warn("Unable to report exit error")
+		}
+		cancel()
+		return
+	}
+
+	backoff := nextEventBackoff(s.nextEventFailures)
+	log.WithError(err).WithField("attempts", s.nextEventFailures).Warnf("Error from NextEvent, retrying in %s", backoff)
+	select {
+	case <-ctx.Done():
+	case <-time.After(backoff):
+	}
+}
+
+// nextEventBackoff returns how long to wait after the given number of
+// consecutive failures: exponential growth capped at nextEventMaxBackoff, with
+// jitter across the upper half of the interval.
+func nextEventBackoff(failures int) time.Duration {
+	backoff := nextEventMaxBackoff
+	if failures < 16 {
+		backoff = min(nextEventInitialBackoff<<(failures-1), nextEventMaxBackoff)
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// sendShutdownReason sends an event with the shutdown reason. The last request ID
+// and function ARN will also be include in the generated event. On Lambda Managed
+// Instances, where there is no single last request, the request IDs of every
+// invocation still in flight are included instead.
+//
+// Nothing is sent if there is no invocation to attribute the shutdown to.
 func (s *Server) sendShutdownReason(shutdownReason extension.ShutdownReason) {
-	ev := s.libhoneyClient.NewEvent()
-	ev.AddField(ShutdownReasonFieldExtensionType, fmt.Sprintf("platform.%s", shutdownReason))
-	ev.AddField(ShutdownReasonFieldRequestID, s.lastRequestId)
-	ev.AddField(ShutdownReasonFieldInvokedFunctionARN, s.invokedFunctionARN)
-	if err := ev.Send(); err != nil {
+	fields := map[string]interface{}{
+		ExtensionTypeField: fmt.Sprintf("platform.%s", shutdownReason),
+	}
+	if s.managedInstances {
+		inFlight := s.tracker.InFlight()
+		if len(inFlight) == 0 {
+			return
+		}
+		fields[ShutdownReasonFieldInFlightRequestIDs] = inFlight
+	} else {
+		if s.lastRequestId == "" {
+			return
+		}
+		fields[ShutdownReasonFieldRequestID] = s.lastRequestId
+		fields[ShutdownReasonFieldInvokedFunctionARN] = s.invokedFunctionARN
+	}
+
+	log.WithField("res.ShutdownReason", shutdownReason).Debug("Sending shutdown reason")
+	ev := s.publisher.NewEvent()
+	ev.AddFields(fields)
+	if err := s.publisher.Publish(ev); err != nil {
 		log.WithError(err).Error("Unable to send event with shutdown reason")
 	}
 }
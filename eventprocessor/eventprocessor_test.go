@@ -3,12 +3,14 @@ package eventprocessor_test
 import (
 	"context"
 	"errors"
+	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/honeycombio/honeycomb-lambda-extension/eventprocessor"
 	"github.com/honeycombio/honeycomb-lambda-extension/extension"
-	"github.com/honeycombio/libhoney-go"
-	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,7 +20,8 @@ func TestRun(t *testing.T) {
 		eventFlusher           *fakeEventFlusher
 		expectedNextEventCount int
 		expectedFlushCount     int
-		expectedShutdownEvent  *transmission.Event
+		expectedExitErrorCount int
+		expectedShutdownEvent  map[string]interface{}
 	}{
 		"a single invoke event type and normal shutdown": {
 			eventPoller: &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
@@ -52,12 +55,10 @@ func TestRun(t *testing.T) {
 			eventFlusher:           newFakeEventFlusher(),
 			expectedNextEventCount: 2,
 			expectedFlushCount:     2,
-			expectedShutdownEvent: &transmission.Event{
-				Data: map[string]interface{}{
-					eventprocessor.ShutdownReasonFieldExtensionType:      "platform.failure",
-					eventprocessor.ShutdownReasonFieldRequestID:          "1",
-					eventprocessor.ShutdownReasonFieldInvokedFunctionARN: "arn1",
-				},
+			expectedShutdownEvent: map[string]interface{}{
+				eventprocessor.ShutdownReasonFieldExtensionType:      "platform.failure",
+				eventprocessor.ShutdownReasonFieldRequestID:          "1",
+				eventprocessor.ShutdownReasonFieldInvokedFunctionARN: "arn1",
 			},
 		},
 		"a single invoke event type and timeout shutdown": {
@@ -75,12 +76,10 @@ func TestRun(t *testing.T) {
 			eventFlusher:           newFakeEventFlusher(),
 			expectedNextEventCount: 2,
 			expectedFlushCount:     2,
-			expectedShutdownEvent: &transmission.Event{
-				Data: map[string]interface{}{
-					eventprocessor.ShutdownReasonFieldExtensionType:      "platform.timeout",
-					eventprocessor.ShutdownReasonFieldRequestID:          "1",
-					eventprocessor.ShutdownReasonFieldInvokedFunctionARN: "arn1",
-				},
+			expectedShutdownEvent: map[string]interface{}{
+				eventprocessor.ShutdownReasonFieldExtensionType:      "platform.timeout",
+				eventprocessor.ShutdownReasonFieldRequestID:          "1",
+				eventprocessor.ShutdownReasonFieldInvokedFunctionARN: "arn1",
 			},
 		},
 		"a timeout shutdown (no last requestId)": {
@@ -115,6 +114,23 @@ func TestRun(t *testing.T) {
 			expectedFlushCount:     2,
 			expectedShutdownEvent:  nil,
 		},
+		"a fatal next event error reports an exit error and stops": {
+			eventPoller: &fakeEventPoller{
+				oneTimeError: &extension.APIError{Kind: extension.ErrorKindClient, StatusCode: 403, Err: errors.New("forbidden")},
+				nextEventResponses: []*extension.NextEventResponse{
+					{
+						EventType:          extension.Invoke,
+						RequestID:          "1",
+						InvokedFunctionARN: "arn1",
+					},
+				},
+			},
+			eventFlusher:           newFakeEventFlusher(),
+			expectedNextEventCount: 0,
+			expectedFlushCount:     0,
+			expectedExitErrorCount: 1,
+			expectedShutdownEvent:  nil,
+		},
 		"an unknown event type and normal shutdown": {
 			eventPoller: &fakeEventPoller{
 				nextEventResponses: []*extension.NextEventResponse{
@@ -136,27 +152,535 @@ func TestRun(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			processor := eventprocessor.New(tc.eventPoller, tc.eventFlusher)
+			processor := eventprocessor.New(extension.Config{}, tc.eventPoller, tc.eventFlusher, eventprocessor.NewInvocationTracker(), nil)
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
 
 			processor.Run(ctx, cancel)
 
 			assert.Equal(t, tc.expectedNextEventCount, tc.eventPoller.nextEventCounter, "next event calls do not match")
-			assert.Equal(t, tc.expectedFlushCount, tc.eventFlusher.mockSender.Flushed, "flush calls do not match")
+			assert.Equal(t, tc.expectedFlushCount, tc.eventFlusher.Flushes(), "flush calls do not match")
+			assert.Equal(t, tc.expectedExitErrorCount, tc.eventPoller.exitErrorCounter, "exit error calls do not match")
+			if tc.expectedShutdownEvent != nil {
+				assert.Equal(t, tc.expectedShutdownEvent, tc.eventFlusher.Events()[0].Fields(), "shutdown event does not match")
+			}
+		})
+	}
+}
+
+func TestRunWaitsForRuntimeDone(t *testing.T) {
+	tests := map[string]struct {
+		config      extension.Config
+		runtimeDone bool
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		"flushes as soon as the invocation is done": {
+			config:      extension.Config{PostInvokeTimeout: 100 * time.Millisecond},
+			runtimeDone: true,
+			minDuration: 0,
+			maxDuration: 500 * time.Millisecond,
+		},
+		"flushes after the post-invoke timeout when never done": {
+			config:      extension.Config{PostInvokeTimeout: 100 * time.Millisecond},
+			runtimeDone: false,
+			minDuration: 100 * time.Millisecond,
+			maxDuration: 500 * time.Millisecond,
+		},
+		"doesn't wait with a post-invoke timeout of 0": {
+			config:      extension.Config{},
+			runtimeDone: false,
+			minDuration: 0,
+			maxDuration: 100 * time.Millisecond,
+		},
+		"doesn't wait when platform events aren't subscribed to": {
+			config:      extension.Config{PostInvokeTimeout: time.Second, LogsAPIDisablePlatformMessages: true},
+			runtimeDone: false,
+			minDuration: 0,
+			maxDuration: 500 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := eventprocessor.NewInvocationTracker()
+			eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+				{
+					EventType:          extension.Invoke,
+					RequestID:          "1",
+					InvokedFunctionARN: "arn1",
+					DeadlineMS:         time.Now().Add(time.Minute).UnixMilli(),
+				},
+				{
+					EventType:      extension.Shutdown,
+					ShutdownReason: extension.ShutdownReasonSpindown,
+				},
+			}}
+			eventFlusher := newFakeEventFlusher()
+			processor := eventprocessor.New(tc.config, eventPoller, eventFlusher, tracker, nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if tc.runtimeDone {
+				tracker.InvocationDone("1")
+			}
+			start := time.Now()
+			processor.Run(ctx, cancel)
+			elapsed := time.Since(start)
+
+			assert.Equal(t, 2, eventFlusher.Flushes(), "flush calls do not match")
+			assert.GreaterOrEqual(t, elapsed, tc.minDuration)
+			assert.Less(t, elapsed, tc.maxDuration)
+		})
+	}
+}
+
+func TestRunShutdownDeadline(t *testing.T) {
+	tests := map[string]struct {
+		flushDelay         time.Duration
+		remaining          time.Duration
+		expectedFlushCount int64
+		maxDuration        time.Duration
+	}{
+		"flushes within the shutdown deadline": {
+			flushDelay:         0,
+			remaining:          2 * time.Second,
+			expectedFlushCount: 1,
+			maxDuration:        time.Second,
+		},
+		"gives up on a flush that outlasts the shutdown deadline": {
+			flushDelay:         5 * time.Second,
+			remaining:          500 * time.Millisecond,
+			expectedFlushCount: 0,
+			maxDuration:        time.Second,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+				{
+					EventType:      extension.Shutdown,
+					ShutdownReason: extension.ShutdownReasonSpindown,
+					DeadlineMS:     time.Now().Add(tc.remaining).UnixMilli(),
+				},
+			}}
+			eventFlusher := newFakeEventFlusher()
+			eventFlusher.flushDelay = tc.flushDelay
+			processor := eventprocessor.New(extension.Config{}, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			start := time.Now()
+			processor.Run(ctx, cancel)
+
+			assert.Less(t, time.Since(start), tc.maxDuration)
+			assert.Equal(t, tc.expectedFlushCount, atomic.LoadInt64(&eventFlusher.flushCount), "flush calls do not match")
+		})
+	}
+}
+
+func TestRunShutdownDrainsReceiverBeforeFlush(t *testing.T) {
+	eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+		{
+			EventType:      extension.Shutdown,
+			ShutdownReason: extension.ShutdownReasonSpindown,
+			DeadlineMS:     time.Now().Add(time.Second).UnixMilli(),
+		},
+	}}
+	eventFlusher := newFakeEventFlusher()
+	receiver := &fakeReceiver{eventFlusher: eventFlusher}
+	processor := eventprocessor.New(extension.Config{}, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), receiver)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processor.Run(ctx, cancel)
+
+	assert.Equal(t, 1, receiver.shutdownCount, "expected receiver to be shut down")
+	assert.Equal(t, int64(0), receiver.flushCountAtShutdown, "expected receiver to be drained before flushing")
+	assert.Equal(t, int64(1), atomic.LoadInt64(&eventFlusher.flushCount), "expected a final flush")
+}
+
+func TestRunShutdownReplaysSpool(t *testing.T) {
+	eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+		{
+			EventType:      extension.Shutdown,
+			ShutdownReason: extension.ShutdownReasonSpindown,
+			DeadlineMS:     time.Now().Add(time.Second).UnixMilli(),
+		},
+	}}
+	eventFlusher := &fakeSpoolingEventFlusher{fakeEventFlusher: newFakeEventFlusher(), spooled: 3}
+	processor := eventprocessor.New(extension.Config{}, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processor.Run(ctx, cancel)
+
+	assert.Equal(t, 1, eventFlusher.replayCount, "expected the spool to be replayed after the final flush")
+	assert.Equal(t, int64(1), eventFlusher.flushCountAtReplay)
+}
+
+func TestRunAsyncFlushStrategy(t *testing.T) {
+	farDeadline := time.Now().Add(time.Minute).UnixMilli()
+	tests := map[string]struct {
+		invokes            []*extension.NextEventResponse
+		expectedFlushCount int
+	}{
+		"does not flush on invoke before enough invocations": {
+			invokes: []*extension.NextEventResponse{
+				{EventType: extension.Invoke, RequestID: "1", DeadlineMS: farDeadline},
+				{EventType: extension.Invoke, RequestID: "2", DeadlineMS: farDeadline},
+			},
+			expectedFlushCount: 1,
+		},
+		"flushes synchronously when the deadline is close": {
+			invokes: []*extension.NextEventResponse{
+				{EventType: extension.Invoke, RequestID: "1", DeadlineMS: time.Now().Add(100 * time.Millisecond).UnixMilli()},
+			},
+			expectedFlushCount: 2,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			eventPoller := &fakeEventPoller{nextEventResponses: append(tc.invokes, &extension.NextEventResponse{
+				EventType:      extension.Shutdown,
+				ShutdownReason: extension.ShutdownReasonSpindown,
+			})}
+			eventFlusher := newFakeEventFlusher()
+			config := extension.Config{
+				FlushStrategy:         extension.FlushStrategyAsync,
+				FlushInterval:         time.Hour,
+				FlushEveryInvocations: 10,
+				FlushMinRemaining:     500 * time.Millisecond,
+			}
+			processor := eventprocessor.New(config, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processor.Run(ctx, cancel)
+
+			assert.Equal(t, len(tc.invokes)+1, eventPoller.nextEventCounter, "next event calls do not match")
+			assert.Equal(t, tc.expectedFlushCount, eventFlusher.Flushes(), "flush calls do not match")
+		})
+	}
+
+	t.Run("flushes in the background after enough invocations", func(t *testing.T) {
+		release := make(chan struct{})
+		eventPoller := &fakeEventPoller{
+			block:      release,
+			blockAfter: 2,
+			nextEventResponses: []*extension.NextEventResponse{
+				{EventType: extension.Invoke, RequestID: "1", DeadlineMS: farDeadline},
+				{EventType: extension.Invoke, RequestID: "2", DeadlineMS: farDeadline},
+				{EventType: extension.Shutdown, ShutdownReason: extension.ShutdownReasonSpindown},
+			},
+		}
+		eventFlusher := newFakeEventFlusher()
+		config := extension.Config{
+			FlushStrategy:         extension.FlushStrategyAsync,
+			FlushInterval:         time.Hour,
+			FlushEveryInvocations: 2,
+		}
+		processor := eventprocessor.New(config, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan struct{})
+		go func() {
+			processor.Run(ctx, cancel)
+			close(done)
+		}()
+
+		assert.Eventually(t, func() bool {
+			return atomic.LoadInt64(&eventFlusher.flushCount) == 1
+		}, time.Second, 5*time.Millisecond, "expected a background flush while polling for the next event")
+
+		close(release)
+		<-done
+		assert.Equal(t, int64(2), atomic.LoadInt64(&eventFlusher.flushCount), "expected a final flush on shutdown")
+	})
+}
+
+func TestRunAsyncFlushStrategyWakesForwardersOnInvoke(t *testing.T) {
+	farDeadline := time.Now().Add(time.Minute).UnixMilli()
+	eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+		{EventType: extension.Invoke, RequestID: "1", DeadlineMS: farDeadline},
+		{EventType: extension.Invoke, RequestID: "2", DeadlineMS: farDeadline},
+		{EventType: extension.Shutdown, ShutdownReason: extension.ShutdownReasonSpindown},
+	}}
+	eventFlusher := &fakeForwardingEventFlusher{fakeEventFlusher: newFakeEventFlusher()}
+	config := extension.Config{
+		FlushStrategy:         extension.FlushStrategyAsync,
+		FlushInterval:         time.Hour,
+		FlushEveryInvocations: 10,
+	}
+	processor := eventprocessor.New(config, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processor.Run(ctx, cancel)
+
+	assert.Equal(t, 2, eventFlusher.forwarderWakes, "expected forwarders to be woken on every invoke")
+	assert.Equal(t, 1, eventFlusher.Flushes(), "expected only the shutdown flush")
+}
+
+func TestRunAsyncFlushStrategyDoesNotWaitOnSyslog(t *testing.T) {
+	tests := map[string]struct {
+		listen bool
+	}{
+		"nothing listening":                  {listen: false},
+		"listener never finishing handshake": {listen: true},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// a listener that is never accepted from completes TCP connects,
+			// leaving the TLS handshake to hang until the dial timeout
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := ln.Addr().String()
+			if !tc.listen {
+				ln.Close()
+			}
+			defer ln.Close()
+
+			syslog, err := publisher.NewSyslog(extension.Config{
+				SyslogAddress:          address,
+				SyslogTLS:              true,
+				SyslogBatchSize:        100,
+				SyslogStructuredDataID: "lambda@32473",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tee := publisher.NewTee(publisher.NewMemory(), syslog)
+			assert.NoError(t, tee.Publish(publisher.NewEvent(map[string]interface{}{"record": "one"})))
+
+			eventPoller := &signallingEventPoller{
+				fakeEventPoller: &fakeEventPoller{
+					block:      make(chan struct{}),
+					blockAfter: 1,
+					nextEventResponses: []*extension.NextEventResponse{
+						{EventType: extension.Invoke, RequestID: "1", DeadlineMS: time.Now().Add(time.Minute).UnixMilli()},
+						{EventType: extension.Shutdown, ShutdownReason: extension.ShutdownReasonSpindown},
+					},
+				},
+				polled: make(chan struct{}, 2),
+			}
+			config := extension.Config{
+				FlushStrategy: extension.FlushStrategyAsync,
+				FlushInterval: time.Hour,
+			}
+			processor := eventprocessor.New(config, eventPoller, tee, eventprocessor.NewInvocationTracker(), nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				processor.Run(ctx, cancel)
+				close(done)
+			}()
+
+			<-eventPoller.polled
+			select {
+			case <-eventPoller.polled:
+			case <-time.After(500 * time.Millisecond):
+				t.Error("expected the next event to be polled without waiting on the syslog receiver")
+			}
+
+			ln.Close()
+			close(eventPoller.block)
+			<-done
+		})
+	}
+}
+
+func TestRunManagedInstances(t *testing.T) {
+	tests := map[string]struct {
+		shutdownReason        extension.ShutdownReason
+		inFlight              []string
+		expectedShutdownEvent map[string]interface{}
+	}{
+		"normal shutdown with invocations in flight": {
+			shutdownReason:        extension.ShutdownReasonSpindown,
+			inFlight:              []string{"1", "2"},
+			expectedShutdownEvent: nil,
+		},
+		"timeout shutdown with invocations in flight": {
+			shutdownReason: extension.ShutdownReasonTimeout,
+			inFlight:       []string{"1", "2"},
+			expectedShutdownEvent: map[string]interface{}{
+				eventprocessor.ShutdownReasonFieldExtensionType:      "platform.timeout",
+				eventprocessor.ShutdownReasonFieldInFlightRequestIDs: []string{"1", "2"},
+			},
+		},
+		"failure shutdown with nothing in flight": {
+			shutdownReason:        extension.ShutdownReasonFailure,
+			inFlight:              nil,
+			expectedShutdownEvent: nil,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := eventprocessor.NewInvocationTracker()
+			for _, requestID := range tc.inFlight {
+				tracker.InvocationStarted(requestID)
+				time.Sleep(time.Millisecond)
+			}
+			tracker.InvocationStarted("finished")
+			tracker.InvocationDone("finished")
+
+			eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+				{
+					EventType:      extension.Shutdown,
+					ShutdownReason: tc.shutdownReason,
+				},
+			}}
+			eventFlusher := newFakeEventFlusher()
+			config := extension.Config{IsManagedInstances: true, FlushInterval: time.Hour}
+			processor := eventprocessor.New(config, eventPoller, eventFlusher, tracker, nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processor.Run(ctx, cancel)
+
+			assert.Equal(t, 1, eventPoller.nextEventCounter, "next event calls do not match")
+			events := eventFlusher.Events()
 			if tc.expectedShutdownEvent != nil {
-				assert.Equal(t, tc.expectedShutdownEvent.Data, tc.eventFlusher.mockSender.Events()[0].Data, "shutdown event does not match")
+				assert.Equal(t, tc.expectedShutdownEvent, events[0].Fields(), "shutdown event does not match")
+			} else {
+				assert.Empty(t, events, "expected no shutdown event")
 			}
 		})
 	}
 }
 
+func TestRunManagedInstancesFlushesInBackground(t *testing.T) {
+	tests := map[string]struct {
+		config       extension.Config
+		enqueueBytes int
+	}{
+		"flushes on interval": {
+			config: extension.Config{
+				IsManagedInstances: true,
+				FlushInterval:      10 * time.Millisecond,
+				FlushMaxBytes:      1000,
+			},
+			enqueueBytes: 0,
+		},
+		"flushes when pending bytes exceed threshold": {
+			config: extension.Config{
+				IsManagedInstances: true,
+				FlushInterval:      time.Hour,
+				FlushMaxBytes:      1000,
+			},
+			enqueueBytes: 1024,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			tracker := eventprocessor.NewInvocationTracker()
+			release := make(chan struct{})
+			eventPoller := &fakeEventPoller{
+				block: release,
+				nextEventResponses: []*extension.NextEventResponse{
+					{
+						EventType:      extension.Shutdown,
+						ShutdownReason: extension.ShutdownReasonSpindown,
+					},
+				},
+			}
+			eventFlusher := newFakeEventFlusher()
+			processor := eventprocessor.New(tc.config, eventPoller, eventFlusher, tracker, nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan struct{})
+			go func() {
+				processor.Run(ctx, cancel)
+				close(done)
+			}()
+
+			if tc.enqueueBytes > 0 {
+				tracker.EventsEnqueued(tc.enqueueBytes)
+			}
+			assert.Eventually(t, func() bool {
+				return atomic.LoadInt64(&eventFlusher.flushCount) > 0
+			}, time.Second, 5*time.Millisecond, "expected a flush before any event from NextEvent")
+			assert.Equal(t, 0, tracker.PendingBytes(), "pending bytes should reset on flush")
+
+			close(release)
+			<-done
+		})
+	}
+}
+
 // ###########################################
+func TestRunSetsRetryDeadline(t *testing.T) {
+	invokeDeadline := time.Now().Add(time.Minute).UnixMilli()
+	shutdownDeadline := time.Now().Add(time.Second).UnixMilli()
+	eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+		{EventType: extension.Invoke, DeadlineMS: invokeDeadline},
+		{EventType: extension.Shutdown, ShutdownReason: extension.ShutdownReasonSpindown, DeadlineMS: shutdownDeadline},
+	}}
+	eventFlusher := &fakeDeadlineEventFlusher{fakeEventFlusher: newFakeEventFlusher()}
+	processor := eventprocessor.New(extension.Config{}, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	processor.Run(ctx, cancel)
+
+	if assert.Len(t, eventFlusher.deadlines, 2) {
+		assert.Equal(t, time.UnixMilli(invokeDeadline), eventFlusher.deadlines[0])
+		assert.True(t, eventFlusher.deadlines[1].Before(time.UnixMilli(shutdownDeadline)), "expected a margin before the shutdown deadline")
+	}
+}
+
+func TestRunExitsWhenDegraded(t *testing.T) {
+	tests := map[string]struct {
+		exitOnAuthFailure bool
+		expectedExitError int
+		expectedNextEvent int
+	}{
+		"exits when configured to": {
+			exitOnAuthFailure: true,
+			expectedExitError: 1,
+			expectedNextEvent: 1,
+		},
+		"carries on otherwise": {
+			expectedNextEvent: 2,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			eventPoller := &fakeEventPoller{nextEventResponses: []*extension.NextEventResponse{
+				{EventType: extension.Invoke},
+				{EventType: extension.Shutdown, ShutdownReason: extension.ShutdownReasonSpindown},
+			}}
+			eventFlusher := &fakeDegradedEventFlusher{fakeEventFlusher: newFakeEventFlusher()}
+			processor := eventprocessor.New(extension.Config{ExitOnAuthFailure: tc.exitOnAuthFailure}, eventPoller, eventFlusher, eventprocessor.NewInvocationTracker(), nil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			processor.Run(ctx, cancel)
+
+			assert.Equal(t, tc.expectedExitError, eventPoller.exitErrorCounter)
+			assert.Equal(t, tc.expectedNextEvent, eventPoller.nextEventCounter)
+		})
+	}
+}
+
 // Test implementations
 // ###########################################
 
 type fakeEventPoller struct {
+	block              chan struct{}
+	blockAfter         int
 	oneTimeError       error
+	exitErrorCounter   int
 	nextEventCounter   int
 	nextEventResponses []*extension.NextEventResponse
 }
@@ -165,6 +689,9 @@ func (f *fakeEventPoller) NextEvent(ctx context.Context) (*extension.NextEventRe
 	if ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
+	if f.block != nil && f.nextEventCounter >= f.blockAfter {
+		<-f.block
+	}
 	if f.oneTimeError != nil {
 		err := f.oneTimeError
 		f.oneTimeError = nil
@@ -175,28 +702,89 @@ func (f *fakeEventPoller) NextEvent(ctx context.Context) (*extension.NextEventRe
 	return resp, nil
 }
 
+// signallingEventPoller is a fakeEventPoller that signals every poll
+type signallingEventPoller struct {
+	*fakeEventPoller
+	polled chan struct{}
+}
+
+func (f *signallingEventPoller) NextEvent(ctx context.Context) (*extension.NextEventResponse, error) {
+	f.polled <- struct{}{}
+	return f.fakeEventPoller.NextEvent(ctx)
+}
+
+func (f *fakeEventPoller) ExitError(ctx context.Context, errorType string, err error) error {
+	f.exitErrorCounter++
+	return nil
+}
+
 func newFakeEventFlusher() *fakeEventFlusher {
-	mockSender := &transmission.MockSender{}
-	libhoneyClient, _ := libhoney.NewClient(libhoney.ClientConfig{
-		APIKey:       "unit-test-api-key",
-		Dataset:      "unit-test-dataset",
-		Transmission: mockSender,
-	})
-	return &fakeEventFlusher{
-		mockSender:     mockSender,
-		libhoneyClient: libhoneyClient,
-	}
+	return &fakeEventFlusher{Memory: publisher.NewMemory()}
 }
 
 type fakeEventFlusher struct {
-	libhoneyClient *libhoney.Client
-	mockSender     *transmission.MockSender
+	*publisher.Memory
+	flushDelay time.Duration
+	flushCount int64
 }
 
-func (f *fakeEventFlusher) NewEvent() *libhoney.Event {
-	return f.libhoneyClient.NewEvent()
+func (f *fakeEventFlusher) Flush() {
+	time.Sleep(f.flushDelay)
+	atomic.AddInt64(&f.flushCount, 1)
+	f.Memory.Flush()
 }
 
-func (f *fakeEventFlusher) Flush() {
-	f.mockSender.Flush()
+type fakeReceiver struct {
+	eventFlusher         *fakeEventFlusher
+	shutdownCount        int
+	flushCountAtShutdown int64
+}
+
+func (f *fakeReceiver) Shutdown(ctx context.Context) error {
+	f.shutdownCount++
+	f.flushCountAtShutdown = atomic.LoadInt64(&f.eventFlusher.flushCount)
+	return nil
+}
+
+type fakeSpoolingEventFlusher struct {
+	*fakeEventFlusher
+	spooled            int
+	replayCount        int
+	flushCountAtReplay int64
+}
+
+func (f *fakeSpoolingEventFlusher) ReplaySpool() {
+	f.replayCount++
+	f.flushCountAtReplay = atomic.LoadInt64(&f.flushCount)
+	f.spooled = 0
+}
+
+func (f *fakeSpoolingEventFlusher) SpooledEvents() int {
+	return f.spooled
+}
+
+type fakeDeadlineEventFlusher struct {
+	*fakeEventFlusher
+	deadlines []time.Time
+}
+
+func (f *fakeDeadlineEventFlusher) SetDeadline(deadline time.Time) {
+	f.deadlines = append(f.deadlines, deadline)
+}
+
+type fakeForwardingEventFlusher struct {
+	*fakeEventFlusher
+	forwarderWakes int
+}
+
+func (f *fakeForwardingEventFlusher) SendForwardersSoon() {
+	f.forwarderWakes++
+}
+
+type fakeDegradedEventFlusher struct {
+	*fakeEventFlusher
+}
+
+func (f *fakeDegradedEventFlusher) Degraded() error {
+	return errors.New("API key rejected")
 }
@@ -0,0 +1,190 @@
+package eventprocessor
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// doneRetention is how long a finished invocation is remembered so that a late
+// call to WaitDone still sees it. Entries older than this are pruned.
+const doneRetention = time.Minute
+
+// maxInvocationAge bounds how long an invocation that never finished is
+// remembered, such as one whose platform.runtimeDone was lost. No invocation
+// runs for longer than Lambda's maximum function timeout of 15 minutes.
+const maxInvocationAge = 15*time.Minute + doneRetention
+
+// InvocationTracker follows the lifecycle of invocations by request ID as the
+// Telemetry API reports them. On Lambda Managed Instances the extension never
+// receives INVOKE events, and several invocations may be running at once, so
+// platform events are the only way to know what is in flight. Elsewhere it
+// tells the extension when the runtime has finished an invocation, so events
+// can be flushed before asking for the next one.
+//
+// It also keeps a running total of telemetry bytes received since the last
+// flush, which is used to decide when to flush early.
+type InvocationTracker struct {
+	mu           sync.Mutex
+	invocations  map[string]*invocation
+	pendingBytes int
+	lastEnqueued time.Time
+	enqueued     chan struct{}
+}
+
+type invocation struct {
+	started time.Time
+	doneAt  time.Time
+	done    chan struct{}
+}
+
+// NewInvocationTracker returns an empty InvocationTracker
+func NewInvocationTracker() *InvocationTracker {
+	return &InvocationTracker{
+		invocations: make(map[string]*invocation),
+		enqueued:    make(chan struct{}, 1),
+	}
+}
+
+// get returns the invocation for requestID, creating it if needed. The caller
+// must hold t.mu.
+func (t *InvocationTracker) get(requestID string) *invocation {
+	inv, ok := t.invocations[requestID]
+	if !ok {
+		inv = &invocation{done: make(chan struct{})}
+		t.invocations[requestID] = inv
+	}
+	return inv
+}
+
+// InvocationStarted records that the invocation with the given request ID has
+// started, as reported by a platform.start event.
+func (t *InvocationTracker) InvocationStarted(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune()
+	inv := t.get(requestID)
+	if inv.started.IsZero() {
+		inv.started = time.Now()
+	}
+}
+
+// InvocationDone records that the runtime has finished the invocation with the
+// given request ID, as reported by a platform.runtimeDone event. The receiver
+// calls this only once the batch carrying the event has been enqueued, so all
+// telemetry for the invocation that preceded it is ready to be flushed.
+func (t *InvocationTracker) InvocationDone(requestID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inv := t.get(requestID)
+	if inv.doneAt.IsZero() {
+		inv.doneAt = time.Now()
+		close(inv.done)
+	}
+}
+
+// WaitDone blocks until the invocation with the given request ID is done or ctx
+// is cancelled, and reports whether it finished. The invocation is forgotten
+// afterwards.
+func (t *InvocationTracker) WaitDone(ctx context.Context, requestID string) bool {
+	t.mu.Lock()
+	inv := t.get(requestID)
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.invocations, requestID)
+		t.mu.Unlock()
+	}()
+
+	select {
+	case <-inv.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// prune forgets invocations that finished more than doneRetention ago, and
+// those that started more than maxInvocationAge ago whether or not they
+// finished. The caller must hold t.mu.
+func (t *InvocationTracker) prune() {
+	for requestID, inv := range t.invocations {
+		finished := !inv.doneAt.IsZero() && time.Since(inv.doneAt) > doneRetention
+		abandoned := !inv.started.IsZero() && time.Since(inv.started) > maxInvocationAge
+		if finished || abandoned {
+			delete(t.invocations, requestID)
+		}
+	}
+}
+
+// EventsEnqueued records that a batch of telemetry of the given size has been
+// received and enqueued for sending.
+func (t *InvocationTracker) EventsEnqueued(bytes int) {
+	t.mu.Lock()
+	t.pendingBytes += bytes
+	t.lastEnqueued = time.Now()
+	t.mu.Unlock()
+
+	select {
+	case t.enqueued <- struct{}{}:
+	default:
+	}
+}
+
+// WaitQuiet blocks until no telemetry has been enqueued for the quiet period,
+// counting from since at the earliest, or until ctx is cancelled. It reports
+// whether the quiet period was reached.
+func (t *InvocationTracker) WaitQuiet(ctx context.Context, since time.Time, quiet time.Duration) bool {
+	for {
+		t.mu.Lock()
+		last := t.lastEnqueued
+		t.mu.Unlock()
+		if last.Before(since) {
+			last = since
+		}
+
+		wait := quiet - time.Since(last)
+		if wait <= 0 {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
+		}
+	}
+}
+
+// InFlight returns the request IDs of invocations that have started but not yet
+// finished, oldest first.
+func (t *InvocationTracker) InFlight() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	requestIDs := make([]string, 0, len(t.invocations))
+	for requestID, inv := range t.invocations {
+		if !inv.started.IsZero() && inv.doneAt.IsZero() {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+	sort.Slice(requestIDs, func(i, j int) bool {
+		return t.invocations[requestIDs[i]].started.Before(t.invocations[requestIDs[j]].started)
+	})
+	return requestIDs
+}
+
+// PendingBytes returns the number of telemetry bytes received since the last
+// call to resetPendingBytes.
+func (t *InvocationTracker) PendingBytes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pendingBytes
+}
+
+// resetPendingBytes is called when a flush begins.
+func (t *InvocationTracker) resetPendingBytes() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pendingBytes = 0
+}
@@ -0,0 +1,114 @@
+package eventprocessor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvocationTrackerInFlight(t *testing.T) {
+	tracker := NewInvocationTracker()
+	assert.Empty(t, tracker.InFlight())
+
+	tracker.InvocationStarted("1")
+	time.Sleep(time.Millisecond)
+	tracker.InvocationStarted("2")
+	time.Sleep(time.Millisecond)
+	tracker.InvocationStarted("3")
+	tracker.InvocationDone("2")
+	// a runtimeDone for an invocation we never saw start is ignored
+	tracker.InvocationDone("unknown")
+
+	assert.Equal(t, []string{"1", "3"}, tracker.InFlight())
+}
+
+func TestInvocationTrackerPrunesOldInvocations(t *testing.T) {
+	tracker := NewInvocationTracker()
+	tracker.InvocationStarted("finished")
+	tracker.InvocationDone("finished")
+	tracker.InvocationStarted("never finished")
+	tracker.InvocationStarted("running")
+
+	tracker.mu.Lock()
+	tracker.invocations["finished"].doneAt = time.Now().Add(-doneRetention - time.Second)
+	tracker.invocations["never finished"].started = time.Now().Add(-maxInvocationAge - time.Second)
+	tracker.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+	tracker.InvocationStarted("new")
+	assert.Equal(t, []string{"running", "new"}, tracker.InFlight())
+	tracker.mu.Lock()
+	assert.Len(t, tracker.invocations, 2, "expected old invocations to be forgotten")
+	tracker.mu.Unlock()
+}
+
+func TestInvocationTrackerPendingBytes(t *testing.T) {
+	tracker := NewInvocationTracker()
+	tracker.EventsEnqueued(100)
+	tracker.EventsEnqueued(50)
+	assert.Equal(t, 150, tracker.PendingBytes())
+
+	select {
+	case <-tracker.enqueued:
+	default:
+		t.Error("expected enqueued to be signalled")
+	}
+
+	tracker.resetPendingBytes()
+	assert.Equal(t, 0, tracker.PendingBytes())
+}
+
+func TestInvocationTrackerWaitDone(t *testing.T) {
+	t.Run("done before waiting", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		tracker.InvocationDone("1")
+		assert.True(t, tracker.WaitDone(context.Background(), "1"))
+		assert.Empty(t, tracker.invocations, "invocation should be forgotten after waiting")
+	})
+
+	t.Run("done while waiting", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		tracker.InvocationStarted("1")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			tracker.InvocationDone("1")
+		}()
+		assert.True(t, tracker.WaitDone(context.Background(), "1"))
+	})
+
+	t.Run("never done", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.False(t, tracker.WaitDone(ctx, "1"))
+	})
+}
+
+func TestInvocationTrackerWaitQuiet(t *testing.T) {
+	t.Run("quiet since the given time", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		start := time.Now()
+		assert.True(t, tracker.WaitQuiet(context.Background(), start, 20*time.Millisecond))
+		assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	})
+
+	t.Run("telemetry arriving extends the wait", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		start := time.Now()
+		go func() {
+			time.Sleep(15 * time.Millisecond)
+			tracker.EventsEnqueued(10)
+		}()
+		assert.True(t, tracker.WaitQuiet(context.Background(), start, 30*time.Millisecond))
+		assert.GreaterOrEqual(t, time.Since(start), 45*time.Millisecond)
+	})
+
+	t.Run("gives up when the context is done", func(t *testing.T) {
+		tracker := NewInvocationTracker()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.False(t, tracker.WaitQuiet(ctx, time.Now(), time.Second))
+	})
+}
@@ -0,0 +1,80 @@
+package eventprocessor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// Self-metrics describing the event processor
+const (
+	MetricFlushes         = "processor.flushes"
+	MetricFlushDurationMS = "processor.flush_duration_ms"
+	MetricInvocations     = "processor.invocations"
+)
+
+const (
+	// selfTelemetryType is the lambda_extension.type of self-telemetry events
+	selfTelemetryType = "extension.self_telemetry"
+
+	// selfTelemetryFieldPrefix namespaces self-metrics among the fields of a
+	// self-telemetry event
+	selfTelemetryFieldPrefix = "lambda_extension.self."
+)
+
+// selfTelemetry sends events describing the extension itself, built from the
+// self-metrics recorded by its packages. Counters are sent as the change since
+// the last self-telemetry event, and gauges as their current value.
+type selfTelemetry struct {
+	dataset  string
+	interval time.Duration
+
+	mu           sync.Mutex
+	lastSent     time.Time
+	lastCounters map[string]int64
+}
+
+// newSelfTelemetry returns a selfTelemetry if it is enabled by config, or nil
+func newSelfTelemetry(config extension.Config) *selfTelemetry {
+	if !config.SelfTelemetryEnabled {
+		return nil
+	}
+	return &selfTelemetry{
+		dataset:      config.SelfTelemetryDataset,
+		interval:     config.SelfTelemetryInterval,
+		lastCounters: make(map[string]int64),
+	}
+}
+
+// send sends a self-telemetry event through client, unless one was sent
+// within the interval.
+func (t *selfTelemetry) send(client eventFlusher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.lastSent.IsZero() && time.Since(t.lastSent) < t.interval {
+		return
+	}
+	t.lastSent = time.Now()
+
+	fields := map[string]interface{}{
+		ExtensionTypeField: selfTelemetryType,
+	}
+	for name, value := range metrics.Default.Counters() {
+		fields[selfTelemetryFieldPrefix+name] = value - t.lastCounters[name]
+		t.lastCounters[name] = value
+	}
+	for name, value := range metrics.Default.Gauges() {
+		fields[selfTelemetryFieldPrefix+name] = value
+	}
+
+	ev := client.NewEvent()
+	if t.dataset != "" {
+		ev.Dataset = t.dataset
+	}
+	ev.AddFields(fields)
+	if err := client.Publish(ev); err != nil {
+		log.WithError(err).Warn("Unable to send self-telemetry event")
+	}
+}
@@ -0,0 +1,57 @@
+package eventprocessor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSelfTelemetry(t *testing.T) {
+	assert.Nil(t, newSelfTelemetry(extension.Config{}))
+	assert.NotNil(t, newSelfTelemetry(extension.Config{SelfTelemetryEnabled: true}))
+}
+
+func TestSelfTelemetrySendsCounterDeltas(t *testing.T) {
+	flusher := publisher.NewMemory()
+	selfTelemetry := newSelfTelemetry(extension.Config{
+		SelfTelemetryEnabled: true,
+		SelfTelemetryDataset: "extension-dataset",
+	})
+	field := selfTelemetryFieldPrefix + "test.things"
+	gaugeField := selfTelemetryFieldPrefix + "test.depth"
+
+	metrics.Add("test.things", 3)
+	metrics.Gauge("test.depth", 7)
+	selfTelemetry.send(flusher)
+	metrics.Add("test.things", 2)
+	selfTelemetry.send(flusher)
+
+	events := flusher.Events()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "extension-dataset", events[0].Dataset)
+		assert.Equal(t, selfTelemetryType, events[0].Fields()[ExtensionTypeField])
+		assert.Equal(t, int64(2), events[1].Fields()[field], "expected the change since the last event")
+		assert.Equal(t, int64(7), events[1].Fields()[gaugeField], "expected the gauge's current value")
+	}
+}
+
+func TestSelfTelemetryInterval(t *testing.T) {
+	flusher := publisher.NewMemory()
+	selfTelemetry := newSelfTelemetry(extension.Config{
+		SelfTelemetryEnabled:  true,
+		SelfTelemetryInterval: 50 * time.Millisecond,
+	})
+
+	selfTelemetry.send(flusher)
+	selfTelemetry.send(flusher)
+	assert.Len(t, flusher.Events(), 1, "expected no event within the interval")
+
+	time.Sleep(50 * time.Millisecond)
+	selfTelemetry.send(flusher)
+	assert.Len(t, flusher.Events(), 2)
+	assert.Empty(t, flusher.Events()[0].Dataset, "expected the publisher's own dataset")
+}
@@ -0,0 +1,307 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// Self-metrics describing the API key being fetched again
+const (
+	MetricAPIKeyRefreshes    = "api_key.refreshes"
+	MetricAPIKeyEventsResent = "api_key.events_resent"
+)
+
+const (
+	// apiKeyRefreshThreshold is the number of send responses in a row
+	// rejecting the API key after which it's fetched again from its source
+	apiKeyRefreshThreshold = 3
+
+	// apiKeyRefreshInterval is the least time between fetching the API key
+	apiKeyRefreshInterval = time.Minute
+
+	// apiKeyMaxHeld bounds the rejected events held while the API key is
+	// being fetched. Responses to any more are passed on as they are.
+	apiKeyMaxHeld = 10000
+)
+
+// errRefresherStopped is the error in the response to an event added once the
+// refresher has been stopped
+var errRefresherStopped = errors.New("API key refresher stopped, event not sent")
+
+// resolveAPIKey fetches the primary destination's API key again from its
+// source. It can be mocked in tests to avoid making actual calls to AWS.
+var resolveAPIKey = extension.Config.RefreshAPIKey
+
+// apiKeyTag stands in for an event's metadata while the refresher waits for
+// the event's response, so the response can be matched back to the event.
+type apiKeyTag struct {
+	id       uint64
+	metadata interface{}
+}
+
+// rejectedEvent is an event Honeycomb rejected the API key for, and the
+// response saying so
+type rejectedEvent struct {
+	ev       *transmission.Event
+	response transmission.Response
+}
+
+// apiKeyRefresher is a transmission.Sender that sends every event with the
+// destination's current API key, and fetches the key again from its source
+// once Honeycomb keeps rejecting it, such as after the key is rotated.
+// libhoney's transmission sends each event with its own key, so it carries on
+// with the new key without being restarted.
+//
+// Events rejected while the key is being fetched, or rejected with a key that
+// has since been replaced, are sent again with the new key. Their responses
+// are only passed on if the key hasn't changed, so the spooler resolves them
+// once they have been sent again.
+type apiKeyRefresher struct {
+	transmission.Sender
+
+	resolve   func() (string, error)
+	interval  time.Duration
+	responses chan transmission.Response
+
+	mu          sync.Mutex
+	apiKey      string
+	nextID      uint64
+	pending     map[uint64]*transmission.Event
+	rejections  int
+	refreshing  bool
+	lastRefresh time.Time
+	held        []rejectedEvent
+	// stale are events rejected with a key that has since been replaced,
+	// waiting to be sent again together by one goroutine
+	stale     []rejectedEvent
+	resending bool
+	closed    bool
+
+	// addMu is held while events are handed on, and exclusively to stop
+	addMu   sync.RWMutex
+	stopped bool
+}
+
+// newAPIKeyRefresher wraps sender, sending events with apiKey until resolve
+// returns a different one.
+func newAPIKeyRefresher(sender transmission.Sender, apiKey string, resolve func() (string, error)) *apiKeyRefresher {
+	return &apiKeyRefresher{
+		Sender:   sender,
+		resolve:  resolve,
+		interval: apiKeyRefreshInterval,
+		apiKey:   apiKey,
+		pending:  make(map[uint64]*transmission.Event),
+	}
+}
+
+func (r *apiKeyRefresher) Start() error {
+	if err := r.Sender.Start(); err != nil {
+		return err
+	}
+	r.responses = make(chan transmission.Response, libhoney.DefaultPendingWorkCapacity*2)
+	go r.readResponses()
+	return nil
+}
+
+func (r *apiKeyRefresher) Stop() error {
+	r.addMu.Lock()
+	r.stopped = true
+	r.addMu.Unlock()
+	return r.Sender.Stop()
+}
+
+// Add hands ev to the wrapped Sender with the current API key. Once the
+// refresher has been stopped, ev is answered with an error instead.
+func (r *apiKeyRefresher) Add(ev *transmission.Event) {
+	r.addMu.RLock()
+	defer r.addMu.RUnlock()
+	if r.stopped {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.closed {
+			r.SendResponse(transmission.Response{Err: errRefresherStopped, Metadata: ev.Metadata})
+		}
+		return
+	}
+	r.add(ev)
+}
+
+// add hands ev on with the current API key. The caller must hold addMu.
+func (r *apiKeyRefresher) add(ev *transmission.Event) {
+	r.mu.Lock()
+	ev.APIKey = r.apiKey
+	id := r.nextID
+	r.nextID++
+	r.pending[id] = ev
+	r.mu.Unlock()
+
+	ev.Metadata = apiKeyTag{id: id, metadata: ev.Metadata}
+	r.Sender.Add(ev)
+}
+
+func (r *apiKeyRefresher) TxResponses() chan transmission.Response {
+	return r.responses
+}
+
+// SendResponse passes resp on, waiting for room if need be, the way libhoney
+// does with BlockOnResponse, since the spooler relies on seeing every
+// response. It must not be called once the responses channel is closed.
+func (r *apiKeyRefresher) SendResponse(resp transmission.Response) bool {
+	r.responses <- resp
+	return false
+}
+
+// readResponses passes responses on with their original metadata, unless the
+// events they are for are to be sent again. Once the wrapped Sender is done,
+// the responses of any events still held are passed on.
+func (r *apiKeyRefresher) readResponses() {
+	for resp := range r.Sender.TxResponses() {
+		if tag, ok := resp.Metadata.(apiKeyTag); ok {
+			resp.Metadata = tag.metadata
+			if r.resolveEvent(tag, resp) {
+				continue
+			}
+		}
+		r.SendResponse(resp)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rejected := range append(r.held, r.stale...) {
+		r.SendResponse(rejected.response)
+	}
+	r.held, r.stale = nil, nil
+	r.closed = true
+	close(r.responses)
+}
+
+// resolveEvent takes note of the response to the event tag stands for, and
+// reports whether the event is being held or sent again, in which case the
+// response isn't passed on.
+func (r *apiKeyRefresher) resolveEvent(tag apiKeyTag, resp transmission.Response) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ev, ok := r.pending[tag.id]
+	if !ok {
+		return false
+	}
+	delete(r.pending, tag.id)
+	ev.Metadata = tag.metadata
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		if resp.Err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			r.rejections = 0
+		}
+		return false
+	}
+	if ev.APIKey != r.apiKey {
+		// sent before the key was replaced
+		r.stale = append(r.stale, rejectedEvent{ev: ev, response: resp})
+		if !r.resending {
+			r.resending = true
+			go r.resendStale()
+		}
+		return true
+	}
+
+	r.rejections++
+	if !r.refreshing && r.rejections >= apiKeyRefreshThreshold && time.Since(r.lastRefresh) >= r.interval {
+		r.refreshing = true
+		go r.refresh()
+	}
+	if !r.refreshing || len(r.held) >= apiKeyMaxHeld {
+		return false
+	}
+	r.held = append(r.held, rejectedEvent{ev: ev, response: resp})
+	return true
+}
+
+// refresh fetches the API key from its source, and sends the events held
+// meanwhile again if it has changed. Otherwise, their responses are passed on.
+func (r *apiKeyRefresher) refresh() {
+	apiKey, err := r.resolve()
+	metrics.Increment(MetricAPIKeyRefreshes)
+
+	r.mu.Lock()
+	held := r.held
+	r.held = nil
+	r.refreshing = false
+	r.lastRefresh = time.Now()
+	changed := err == nil && apiKey != r.apiKey
+	if changed {
+		r.apiKey = apiKey
+		r.rejections = 0
+	} else if !r.closed {
+		for _, rejected := range held {
+			r.SendResponse(rejected.response)
+		}
+	}
+	r.mu.Unlock()
+
+	switch {
+	case err != nil:
+		log.WithError(err).Warn("Honeycomb is rejecting the API key, and fetching it again failed")
+	case !changed:
+		log.Warn("Honeycomb is rejecting the API key, and fetching it again returned the same key")
+	default:
+		log.WithField("events", len(held)).Info("Honeycomb rejected the API key, sending events with the key fetched again from its source")
+		r.resend(held)
+	}
+}
+
+// resendStale sends the events rejected with a replaced key again, in the
+// order they were rejected, until there are none left
+func (r *apiKeyRefresher) resendStale() {
+	for {
+		r.mu.Lock()
+		stale := r.stale
+		r.stale = nil
+		if len(stale) == 0 {
+			r.resending = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+		r.resend(stale)
+	}
+}
+
+// resend hands rejected events on again with the current API key, unless the
+// refresher has been stopped, in which case their responses are passed on.
+func (r *apiKeyRefresher) resend(rejected []rejectedEvent) {
+	r.addMu.RLock()
+	defer r.addMu.RUnlock()
+	if r.stopped {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.closed {
+			for _, rej := range rejected {
+				r.SendResponse(rej.response)
+			}
+		}
+		return
+	}
+	for _, rej := range rejected {
+		r.add(rej.ev)
+	}
+	metrics.Add(MetricAPIKeyEventsResent, int64(len(rejected)))
+}
+
+// apiKeyRefreshable reports whether an API key from source can change without
+// the function being redeployed. Decrypting the same ciphertext with KMS
+// again can only give the same key.
+func apiKeyRefreshable(source extension.APIKeySource) bool {
+	switch source {
+	case extension.APIKeySourceSecretsManager, extension.APIKeySourceSSM:
+		return true
+	default:
+		return false
+	}
+}
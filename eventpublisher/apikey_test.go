@@ -0,0 +1,217 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+// keyHandler accepts batches of a single event sent with its API key, and
+// rejects any other key
+type keyHandler struct {
+	mu     sync.Mutex
+	apiKey string
+	keys   []string
+}
+
+func (h *keyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := r.Header.Get("X-Honeycomb-Team")
+	h.keys = append(h.keys, key)
+	if key != h.apiKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unknown API key - check your credentials"}`))
+		return
+	}
+	w.Write([]byte(`[{"status":202}]`))
+}
+
+func (h *keyHandler) sentKeys() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.keys...)
+}
+
+// awaitResponses reads n responses from client, or fewer if they don't arrive
+// in time
+func awaitResponses(client *Client, n int) []transmission.Response {
+	var responses []transmission.Response
+	for range n {
+		select {
+		case r := <-client.TxResponses():
+			responses = append(responses, r)
+		case <-time.After(5 * time.Second):
+			return responses
+		}
+	}
+	return responses
+}
+
+func TestClientRefreshesRejectedAPIKey(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		spool            bool
+		resolved         string
+		resolveErr       error
+		expectedStatuses []int
+		expectedKeys     []string
+		expectedResent   int64
+	}{
+		{
+			desc:             "rotated key",
+			resolved:         "new-api-key",
+			expectedStatuses: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusAccepted, http.StatusAccepted},
+			expectedKeys:     []string{"old-api-key", "old-api-key", "old-api-key", "new-api-key", "new-api-key"},
+			expectedResent:   1,
+		},
+		{
+			desc:             "rotated key with spooling",
+			spool:            true,
+			resolved:         "new-api-key",
+			expectedStatuses: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusAccepted, http.StatusAccepted},
+			expectedKeys:     []string{"old-api-key", "old-api-key", "old-api-key", "new-api-key", "new-api-key"},
+			expectedResent:   1,
+		},
+		{
+			desc:             "unchanged key",
+			resolved:         "old-api-key",
+			expectedStatuses: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized},
+			expectedKeys:     []string{"old-api-key", "old-api-key", "old-api-key", "old-api-key"},
+		},
+		{
+			desc:             "fetching the key fails",
+			resolveErr:       errors.New("AccessDeniedException"),
+			expectedStatuses: []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized},
+			expectedKeys:     []string{"old-api-key", "old-api-key", "old-api-key", "old-api-key"},
+		},
+	}
+	originalResolveAPIKey := resolveAPIKey
+	defer func() {
+		resolveAPIKey = originalResolveAPIKey
+	}()
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			handler := &keyHandler{apiKey: "new-api-key"}
+			testServer := httptest.NewServer(handler)
+			defer testServer.Close()
+			resolveAPIKey = func(extension.Config) (string, error) {
+				return tC.resolved, tC.resolveErr
+			}
+			refreshesBefore := metrics.Default.Counter(MetricAPIKeyRefreshes)
+			resentBefore := metrics.Default.Counter(MetricAPIKeyEventsResent)
+
+			client, err := New(extension.Config{
+				APIKey:       "old-api-key",
+				APIKeySource: extension.APIKeySourceSecretsManager,
+				Dataset:      "test-dataset",
+				APIHost:      testServer.URL,
+				SpoolEnabled: tC.spool,
+				SpoolDir:     t.TempDir(),
+			}, "test-version")
+			assert.NoError(t, err)
+
+			// one event per batch, so each is answered on its own
+			var statuses []int
+			for range apiKeyRefreshThreshold + 1 {
+				assert.NoError(t, sendTestEvent(client))
+				for _, r := range awaitResponses(client, 1) {
+					statuses = append(statuses, r.StatusCode)
+				}
+			}
+
+			assert.Equal(t, tC.expectedStatuses, statuses)
+			assert.Equal(t, tC.expectedKeys, handler.sentKeys())
+			assert.Equal(t, refreshesBefore+1, metrics.Default.Counter(MetricAPIKeyRefreshes))
+			assert.Equal(t, resentBefore+tC.expectedResent, metrics.Default.Counter(MetricAPIKeyEventsResent))
+		})
+	}
+}
+
+func TestClientOnlyRefreshesAPIKeyFromASource(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		source   extension.APIKeySource
+		expected bool
+	}{
+		{desc: "unknown", source: "", expected: false},
+		{desc: "plaintext", source: extension.APIKeySourceEnvironment, expected: false},
+		{desc: "kms", source: extension.APIKeySourceKMS, expected: false},
+		{desc: "secrets manager", source: extension.APIKeySourceSecretsManager, expected: true},
+		{desc: "ssm", source: extension.APIKeySourceSSM, expected: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			client, err := New(extension.Config{
+				APIKey:       "test-api-key",
+				APIKeySource: tC.source,
+				Dataset:      "test-dataset",
+				Destinations: []extension.Destination{{Name: "other", APIKey: "other-api-key", Dataset: "other-dataset"}},
+			}, "test-version")
+			assert.NoError(t, err)
+			_, refreshes := client.destinations[0].queue.Sender.(*apiKeyRefresher)
+			assert.Equal(t, tC.expected, refreshes)
+			_, refreshes = client.destinations[1].queue.Sender.(*apiKeyRefresher)
+			assert.False(t, refreshes, "expected further destinations' keys never to be fetched again")
+		})
+	}
+}
+
+func TestAPIKeyRefresherResendsEventsForAReplacedKeyTogether(t *testing.T) {
+	sender := &respondingSender{status: http.StatusUnauthorized}
+	r := newAPIKeyRefresher(sender, "old-api-key", nil)
+	assert.NoError(t, r.Start())
+
+	for n := range 100 {
+		r.Add(testEvent(n))
+	}
+	r.mu.Lock()
+	r.apiKey = "new-api-key"
+	r.mu.Unlock()
+	assert.NoError(t, sender.Flush())
+
+	assert.Eventually(t, func() bool {
+		unflushed, _ := sender.counts()
+		return unflushed == 100
+	}, time.Second, 10*time.Millisecond)
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	for n, ev := range sender.unflushed {
+		assert.Equal(t, "new-api-key", ev.APIKey)
+		assert.Equal(t, n, ev.Data["n"], "expected events to be sent again in the order they were rejected")
+	}
+}
+
+// openSender is a respondingSender that keeps its responses channel open once
+// stopped, as libhoney does until its in-flight batches are answered
+type openSender struct {
+	respondingSender
+}
+
+func (s *openSender) Stop() error {
+	return nil
+}
+
+func TestAPIKeyRefresherAnswersEventsAddedOnceStopped(t *testing.T) {
+	r := newAPIKeyRefresher(&openSender{}, "test-api-key", nil)
+	assert.NoError(t, r.Start())
+	assert.NoError(t, r.Stop())
+
+	r.Add(testEvent(7))
+
+	select {
+	case resp := <-r.TxResponses():
+		assert.ErrorIs(t, resp.Err, errRefresherStopped)
+		assert.Equal(t, 7, resp.Metadata)
+	case <-time.After(time.Second):
+		t.Fatal("expected a response to the event")
+	}
+}
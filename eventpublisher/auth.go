@@ -0,0 +1,225 @@
+package eventpublisher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/libhoney-go"
+)
+
+const (
+	// authPath is Honeycomb's endpoint describing the API key it's called with
+	authPath = "/1/auth"
+
+	// authCheckTimeout bounds checking the API key at init
+	authCheckTimeout = 3 * time.Second
+
+	// authMaxResponseBytes bounds how much of an auth response is read
+	authMaxResponseBytes = 64 << 10
+
+	// authFieldPrefix namespaces the result of checking the API key among the
+	// fields of the event it's recorded on
+	authFieldPrefix = "lambda_extension.api_key."
+)
+
+// Outcomes of checking the API key with Honeycomb
+const (
+	// AuthStatusValid means the key can send events
+	AuthStatusValid = "valid"
+	// AuthStatusRejected means Honeycomb rejected the key, or the key isn't
+	// allowed to send events
+	AuthStatusRejected = "rejected"
+	// AuthStatusUnchecked means Honeycomb couldn't be asked about the key
+	AuthStatusUnchecked = "unchecked"
+)
+
+// Types of API key
+const (
+	// KeyTypeIngest is an ingest key, which can only send events and create
+	// datasets
+	KeyTypeIngest = "ingest"
+	// KeyTypeConfiguration is a configuration key, whose permissions are
+	// chosen when it's created
+	KeyTypeConfiguration = "configuration"
+)
+
+// AuthResult describes the API key as Honeycomb sees it
+type AuthResult struct {
+	Status string
+	// KeyType is KeyTypeIngest or KeyTypeConfiguration
+	KeyType string
+	// Classic is true for a key to a Honeycomb Classic team, which has
+	// datasets but no environments
+	Classic     bool
+	Team        string
+	Environment string
+	// Warnings are problems that won't stop events being sent, but may send
+	// them somewhere unexpected
+	Warnings []string
+	// Err is why the key was rejected, or couldn't be checked
+	Err error
+}
+
+// authResponse is the response from Honeycomb's /1/auth endpoint
+type authResponse struct {
+	Type         string          `json:"type"`
+	APIKeyAccess map[string]bool `json:"api_key_access"`
+	Environment  struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"environment"`
+	Team struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	} `json:"team"`
+}
+
+// CheckAuth asks Honeycomb about the API key in config, and checks that it can
+// send events to the configured dataset.
+func CheckAuth(ctx context.Context, config extension.Config, version string) AuthResult {
+	result := AuthResult{
+		Status:  AuthStatusUnchecked,
+		KeyType: keyTypeFromKey(config.APIKey),
+		Classic: libhoney.IsClassicKey(config.APIKey),
+	}
+	ctx, cancel := context.WithTimeout(ctx, authCheckTimeout)
+	defer cancel()
+
+	apiHost := config.APIHost
+	if apiHost == "" {
+		apiHost = defaultAPIHost
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(apiHost, "/")+authPath, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("X-Honeycomb-Team", config.APIKey)
+	req.Header.Set("User-Agent", fmt.Sprintf("honeycomb-lambda-extension/%s", version))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, authMaxResponseBytes))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		result.Status = AuthStatusRejected
+		result.Err = ErrAPIKeyRejected
+		return result
+	case resp.StatusCode != http.StatusOK:
+		result.Err = fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		return result
+	case err != nil:
+		result.Err = err
+		return result
+	}
+	var auth authResponse
+	if err := json.Unmarshal(body, &auth); err != nil {
+		result.Err = fmt.Errorf("unable to decode response: %w", err)
+		return result
+	}
+
+	result.Status = AuthStatusValid
+	if auth.Type != "" {
+		result.KeyType = auth.Type
+	}
+	result.Classic = auth.Environment.Slug == ""
+	result.Team = auth.Team.Slug
+	result.Environment = auth.Environment.Slug
+	if result.KeyType == KeyTypeConfiguration {
+		if !auth.APIKeyAccess["events"] {
+			result.Status = AuthStatusRejected
+			result.Err = errors.New("the API key is a configuration key without permission to send events")
+			return result
+		}
+		if !auth.APIKeyAccess["createDatasets"] {
+			result.Warnings = append(result.Warnings, "the API key can't create datasets, so events are only accepted if the dataset already exists")
+		}
+	}
+	if libhoney.IsClassicKey(config.APIKey) != result.Classic {
+		result.Warnings = append(result.Warnings, "the API key's format doesn't match its team, so libhoney handles LIBHONEY_DATASET as it would for the other kind of team")
+	}
+	result.Warnings = append(result.Warnings, datasetWarnings(config.Dataset, result.Classic)...)
+	return result
+}
+
+// datasetWarnings returns the ways in which events would end up somewhere
+// other than the dataset as written, given whether the key is to a Classic
+// team. Environments trim whitespace from dataset names, but Classic doesn't.
+func datasetWarnings(dataset string, classic bool) []string {
+	trimmed := strings.TrimSpace(dataset)
+	switch {
+	case dataset == "":
+		return []string{"LIBHONEY_DATASET is not set, so no events are sent with this API key"}
+	case !classic && trimmed == "":
+		return []string{"LIBHONEY_DATASET is only whitespace, which environments trim, so events are sent to unknown_dataset"}
+	case !classic && trimmed != dataset:
+		return []string{fmt.Sprintf("LIBHONEY_DATASET has surrounding whitespace, which environments trim, so events are sent to %q", trimmed)}
+	case classic && trimmed != dataset:
+		return []string{"LIBHONEY_DATASET has surrounding whitespace, which Honeycomb Classic keeps in the dataset's name"}
+	default:
+		return nil
+	}
+}
+
+// keyTypeFromKey guesses the type of key from its format, for when Honeycomb
+// can't be asked. Ingest keys are prefixed hcXik_ or hcXic_, depending on
+// whether they're for an environment or a Classic team.
+func keyTypeFromKey(key string) string {
+	if len(key) > 6 && strings.HasPrefix(key, "hc") && key[3] == 'i' && (key[4] == 'k' || key[4] == 'c') && key[5] == '_' {
+		return KeyTypeIngest
+	}
+	return KeyTypeConfiguration
+}
+
+// Fields returns the result as fields to record on an event
+func (r AuthResult) Fields() map[string]interface{} {
+	fields := map[string]interface{}{
+		authFieldPrefix + "status":   r.Status,
+		authFieldPrefix + "type":     r.KeyType,
+		authFieldPrefix + "classic":  r.Classic,
+		authFieldPrefix + "warnings": len(r.Warnings),
+	}
+	if r.Team != "" {
+		fields[authFieldPrefix+"team"] = r.Team
+	}
+	if r.Environment != "" {
+		fields[authFieldPrefix+"environment"] = r.Environment
+	}
+	if r.Err != nil {
+		fields[authFieldPrefix+"error"] = r.Err.Error()
+	}
+	return fields
+}
+
+// Log logs the result: an error if the key was rejected, and a warning for
+// each of its warnings
+func (r AuthResult) Log() {
+	logger := log.WithFields(map[string]interface{}{
+		"key_type": r.KeyType,
+		"classic":  r.Classic,
+	})
+	switch r.Status {
+	case AuthStatusValid:
+		logger.WithFields(map[string]interface{}{
+			"team":        r.Team,
+			"environment": r.Environment,
+		}).Debug("Honeycomb accepted the API key")
+	case AuthStatusRejected:
+		logger.WithError(r.Err).Error("Honeycomb API key can't send events, please verify the API key")
+	default:
+		logger.WithError(r.Err).Warn("Unable to check the Honeycomb API key")
+	}
+	for _, warning := range r.Warnings {
+		logger.Warn(warning)
+	}
+}
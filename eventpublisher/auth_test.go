@@ -0,0 +1,166 @@
+package eventpublisher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	// classicConfigurationKey is in the format of a Honeycomb Classic
+	// configuration key
+	classicConfigurationKey = "0123456789abcdef0123456789abcdef"
+	// environmentIngestKey is in the format of an environment's ingest key
+	environmentIngestKey = "hcaik_01hqk4k20zjk4y5k0gfvgnnp7mbcanmjdrc3wqr0jswds2y0aftxtjxdah"
+)
+
+func TestCheckAuth(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		apiKey           string
+		dataset          string
+		status           int
+		body             string
+		expectedStatus   string
+		expectedType     string
+		expectedClassic  bool
+		expectedEnv      string
+		expectedWarnings int
+		expectError      bool
+	}{
+		{
+			desc:            "classic configuration key",
+			apiKey:          classicConfigurationKey,
+			dataset:         "lambda-logs",
+			status:          http.StatusOK,
+			body:            `{"type": "configuration", "api_key_access": {"events": true, "createDatasets": true}, "environment": {"name": "", "slug": ""}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus:  AuthStatusValid,
+			expectedType:    KeyTypeConfiguration,
+			expectedClassic: true,
+		},
+		{
+			desc:           "environment ingest key",
+			apiKey:         environmentIngestKey,
+			dataset:        "lambda-logs",
+			status:         http.StatusOK,
+			body:           `{"type": "ingest", "api_key_access": {"events": true, "createDatasets": true}, "environment": {"name": "Production", "slug": "production"}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus: AuthStatusValid,
+			expectedType:   KeyTypeIngest,
+			expectedEnv:    "production",
+		},
+		{
+			desc:             "dataset with whitespace in an environment",
+			apiKey:           environmentIngestKey,
+			dataset:          " lambda-logs ",
+			status:           http.StatusOK,
+			body:             `{"type": "ingest", "api_key_access": {"events": true, "createDatasets": true}, "environment": {"name": "Production", "slug": "production"}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus:   AuthStatusValid,
+			expectedType:     KeyTypeIngest,
+			expectedEnv:      "production",
+			expectedWarnings: 1,
+		},
+		{
+			desc:             "configuration key that can't create datasets, without a dataset",
+			apiKey:           "abcdefghijklmnopqrstuv",
+			status:           http.StatusOK,
+			body:             `{"type": "configuration", "api_key_access": {"events": true}, "environment": {"name": "Production", "slug": "production"}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus:   AuthStatusValid,
+			expectedType:     KeyTypeConfiguration,
+			expectedEnv:      "production",
+			expectedWarnings: 2,
+		},
+		{
+			desc:             "key format doesn't match the team",
+			apiKey:           classicConfigurationKey,
+			dataset:          "lambda-logs",
+			status:           http.StatusOK,
+			body:             `{"type": "configuration", "api_key_access": {"events": true, "createDatasets": true}, "environment": {"name": "Production", "slug": "production"}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus:   AuthStatusValid,
+			expectedType:     KeyTypeConfiguration,
+			expectedEnv:      "production",
+			expectedWarnings: 1,
+		},
+		{
+			desc:            "configuration key that can't send events",
+			apiKey:          classicConfigurationKey,
+			dataset:         "lambda-logs",
+			status:          http.StatusOK,
+			body:            `{"type": "configuration", "api_key_access": {"events": false, "markers": true}, "environment": {"name": "", "slug": ""}, "team": {"name": "Test", "slug": "test"}}`,
+			expectedStatus:  AuthStatusRejected,
+			expectedType:    KeyTypeConfiguration,
+			expectedClassic: true,
+			expectError:     true,
+		},
+		{
+			desc:           "rejected key",
+			apiKey:         environmentIngestKey,
+			dataset:        "lambda-logs",
+			status:         http.StatusUnauthorized,
+			body:           `{"error": "unknown API key - check your credentials"}`,
+			expectedStatus: AuthStatusRejected,
+			expectedType:   KeyTypeIngest,
+			expectError:    true,
+		},
+		{
+			desc:            "Honeycomb unavailable",
+			apiKey:          classicConfigurationKey,
+			dataset:         "lambda-logs",
+			status:          http.StatusServiceUnavailable,
+			expectedStatus:  AuthStatusUnchecked,
+			expectedType:    KeyTypeConfiguration,
+			expectedClassic: true,
+			expectError:     true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, authPath, r.URL.Path)
+				assert.Equal(t, tC.apiKey, r.Header.Get("X-Honeycomb-Team"))
+				assert.Contains(t, r.Header.Get("User-Agent"), "honeycomb-lambda-extension/test-version")
+				w.WriteHeader(tC.status)
+				w.Write([]byte(tC.body))
+			}))
+			defer testServer.Close()
+
+			result := CheckAuth(context.Background(), extension.Config{
+				APIKey:  tC.apiKey,
+				Dataset: tC.dataset,
+				APIHost: testServer.URL + "/",
+			}, "test-version")
+
+			assert.Equal(t, tC.expectedStatus, result.Status)
+			assert.Equal(t, tC.expectedType, result.KeyType)
+			assert.Equal(t, tC.expectedClassic, result.Classic)
+			assert.Equal(t, tC.expectedEnv, result.Environment)
+			assert.Len(t, result.Warnings, tC.expectedWarnings, "warnings: %v", result.Warnings)
+			if tC.expectError {
+				assert.Error(t, result.Err)
+				assert.Contains(t, result.Fields(), authFieldPrefix+"error")
+			} else {
+				assert.NoError(t, result.Err)
+				assert.Equal(t, AuthStatusValid, result.Fields()[authFieldPrefix+"status"])
+			}
+		})
+	}
+}
+
+func TestKeyTypeFromKey(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected string
+	}{
+		{key: classicConfigurationKey, expected: KeyTypeConfiguration},
+		{key: "abcdefghijklmnopqrstuv", expected: KeyTypeConfiguration},
+		{key: environmentIngestKey, expected: KeyTypeIngest},
+		{key: "hcaic_0123456789abcdef", expected: KeyTypeIngest},
+		{key: "", expected: KeyTypeConfiguration},
+	}
+	for _, tC := range testCases {
+		assert.Equal(t, tC.expected, keyTypeFromKey(tC.key), tC.key)
+	}
+}
@@ -0,0 +1,161 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// Self-metrics describing the circuit breaker
+const (
+	MetricBreakerOpened   = "breaker.opened"
+	MetricBreakerRejected = "breaker.rejected"
+	MetricBreakerState    = "breaker.state"
+)
+
+// BreakerStateField is added to every event with the circuit breaker's state
+// at the time the event was created
+const BreakerStateField = "lambda_extension.circuit_breaker"
+
+// errCircuitOpen is the error a batch send fails with while the circuit
+// breaker is open
+var errCircuitOpen = errors.New("circuit breaker open, not sending to Honeycomb")
+
+// breakerState is the state of a circuitBreaker. Its value is recorded in the
+// breaker.state gauge.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker is an http.RoundTripper that stops making requests once
+// threshold sends in a row have failed with a 5xx or a network error, so that
+// flushes don't wait on timeouts while Honeycomb is unreachable. Sends made
+// while it is open fail at once with errCircuitOpen. After cooldown it is
+// half-open, and lets a single send through as a probe: if that succeeds the
+// breaker closes, otherwise it opens for another cooldown.
+type circuitBreaker struct {
+	next      http.RoundTripper
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(next http.RoundTripper, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{next: next, threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	allowed, probe := b.allow()
+	if !allowed {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		metrics.Increment(MetricBreakerRejected)
+		return nil, errCircuitOpen
+	}
+	res, err := b.next.RoundTrip(req)
+	b.record(probe, err == nil && res.StatusCode < 500)
+	return res, err
+}
+
+// State returns the breaker's state, reporting an open breaker whose cooldown
+// has passed as half-open.
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// allow reports whether a send may be made, and whether it is the probe of a
+// half-open breaker. An open breaker becomes half-open once its cooldown has
+// passed.
+func (b *circuitBreaker) allow() (allowed, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false, false
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false
+		}
+		b.probing = true
+		log.Debug("Circuit breaker half-open, probing Honeycomb")
+		return true, true
+	}
+	return true, false
+}
+
+// record updates the breaker with the outcome of a send. Outcomes of sends
+// made before the breaker opened don't change the state of an open or
+// half-open breaker.
+func (b *circuitBreaker) record(probe, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+		if ok {
+			b.failures = 0
+			b.setState(breakerClosed)
+			log.Info("Circuit breaker closed, Honeycomb is reachable again")
+		} else {
+			b.open()
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		return
+	}
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.open()
+		log.Warnf("Circuit breaker open after %d failed sends, events will be spooled or dropped for %s", b.failures, b.cooldown)
+	}
+}
+
+// open opens the breaker for a cooldown. The caller must hold b.mu.
+func (b *circuitBreaker) open() {
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+	metrics.Increment(MetricBreakerOpened)
+}
+
+// setState changes the breaker's state. The caller must hold b.mu.
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state = state
+	metrics.Gauge(MetricBreakerState, int64(state))
+}
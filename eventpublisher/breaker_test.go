@@ -0,0 +1,110 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	server, calls := statusServer(t, nil, http.StatusInternalServerError)
+	breaker := newCircuitBreaker(http.DefaultTransport, 3, time.Minute)
+	client := &http.Client{Transport: breaker}
+
+	for range 3 {
+		sendBatch(client, server.URL)
+	}
+	assert.Equal(t, breakerOpen, breaker.State())
+
+	_, err := sendBatch(client, server.URL)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Equal(t, int64(3), calls.Load(), "expected no request while the breaker is open")
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	server, _ := statusServer(t, nil, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusOK, http.StatusInternalServerError)
+	breaker := newCircuitBreaker(http.DefaultTransport, 3, time.Minute)
+	client := &http.Client{Transport: breaker}
+
+	for range 4 {
+		sendBatch(client, server.URL)
+	}
+	assert.Equal(t, breakerClosed, breaker.State())
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	server, _ := statusServer(t, nil, http.StatusUnauthorized)
+	breaker := newCircuitBreaker(http.DefaultTransport, 1, time.Minute)
+	client := &http.Client{Transport: breaker}
+
+	sendBatch(client, server.URL)
+	assert.Equal(t, breakerClosed, breaker.State())
+}
+
+func TestCircuitBreakerProbesWhenHalfOpen(t *testing.T) {
+	tests := map[string]struct {
+		probeStatus   int
+		expectedState breakerState
+	}{
+		"closes when the probe succeeds": {
+			probeStatus:   http.StatusOK,
+			expectedState: breakerClosed,
+		},
+		"opens again when the probe fails": {
+			probeStatus:   http.StatusBadGateway,
+			expectedState: breakerOpen,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, calls := statusServer(t, nil, http.StatusInternalServerError, tc.probeStatus)
+			breaker := newCircuitBreaker(http.DefaultTransport, 1, 50*time.Millisecond)
+			client := &http.Client{Transport: breaker}
+
+			sendBatch(client, server.URL)
+			assert.Equal(t, breakerOpen, breaker.State())
+
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, breakerHalfOpen, breaker.State())
+			sendBatch(client, server.URL)
+
+			assert.Equal(t, int64(2), calls.Load())
+			assert.Equal(t, tc.expectedState, breaker.State())
+		})
+	}
+}
+
+func TestCircuitBreakerSendsOneProbeAtATime(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int64
+	breaker := newCircuitBreaker(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		<-release
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}), 1, 0)
+	breaker.open()
+	client := &http.Client{Transport: breaker}
+
+	done := make(chan struct{})
+	go func() {
+		sendBatch(client, "http://honeycomb.invalid")
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, time.Millisecond)
+
+	_, err := sendBatch(client, "http://honeycomb.invalid")
+	assert.ErrorIs(t, err, errCircuitOpen)
+
+	close(release)
+	<-done
+	assert.Equal(t, breakerClosed, breaker.State())
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
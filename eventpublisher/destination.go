@@ -0,0 +1,170 @@
+package eventpublisher
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// destination is the pipeline events take to one Honeycomb team and dataset:
+// an ingestion queue, a spooler if spooling is enabled, and libhoney's
+// transmission, sending over a transport that retries failed sends behind a
+// circuit breaker. Each destination batches, flushes and tracks errors on its
+// own.
+type destination struct {
+	name    string
+	apiKey  string
+	apiHost string
+	dataset string
+	filter  map[string][]string
+
+	sender  transmission.Sender
+	metrics *libhoneyMetrics
+	queue   *queue
+	spooler *spooler
+	retries *retryTransport
+	breaker *circuitBreaker
+	health  *sendHealth
+}
+
+// newSpoolerFromConfig returns a spooler keeping events in dir and wrapping
+// sender, which sends with tx, if spooling is enabled and dir is usable, or nil
+// otherwise. Replayed events are sent with apiKey.
+func newSpoolerFromConfig(config extension.Config, tx *transmission.Honeycomb, sender transmission.Sender, dir, apiKey string) *spooler {
+	if !config.SpoolEnabled {
+		return nil
+	}
+	sp, err := newSpool(dir, int64(config.SpoolMaxBytes), config.SpoolMaxAge, config.SpoolCompress)
+	if err != nil {
+		log.Warnf("Unable to use %s as a spool, events that fail to send will be lost: %v", dir, err)
+		return nil
+	}
+	// the spooler relies on seeing a response for every event it sends, and
+	// a batch that times out is retried once before its response is sent
+	tx.BlockOnResponse = true
+	responseTimeout := 2*max(tx.BatchSendTimeout, time.Second) + time.Second
+	return newSpooler(sender, sp, apiKey, responseTimeout, config.FlushMinRemaining)
+}
+
+// sendTransport is the transport batches are sent to Honeycomb over, which
+// retries failed sends behind a circuit breaker when they are enabled
+type sendTransport struct {
+	http.RoundTripper
+	retries *retryTransport
+	breaker *circuitBreaker
+	// timeout bounds sending a batch, retries included
+	timeout time.Duration
+}
+
+func newSendTransport(config extension.Config) sendTransport {
+	// httpTransport uses settings from http.DefaultTransport as starting point, but
+	// overrides the dialer connect timeout
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	httpTransport.DialContext = (&net.Dialer{
+		Timeout: config.ConnectTimeout,
+	}).DialContext
+
+	// failed batch sends are retried by the transport, each attempt with its
+	// own timeout, so the timeout for the whole send allows for retries
+	t := sendTransport{
+		RoundTripper: countingTransport{next: httpTransport},
+		timeout:      config.BatchSendTimeout,
+	}
+	if config.RetryMaxAttempts > 1 {
+		t.retries = newRetryTransport(t.RoundTripper, retryPolicyFromConfig(config))
+		t.RoundTripper = t.retries
+		t.timeout += config.RetryBudget
+	}
+	// the circuit breaker sits in front of retries, so that no request at all
+	// is made while it is open
+	if config.CircuitBreakerThreshold > 0 {
+		t.breaker = newCircuitBreaker(t.RoundTripper, config.CircuitBreakerThreshold, config.CircuitBreakerCooldown)
+		t.RoundTripper = t.breaker
+	}
+	return t
+}
+
+// newDestination builds the pipeline to dest, using the sending, queueing and
+// spooling settings in config. Its spool is kept in spoolDir, and its queue
+// holds up to queueMaxBytes of events. If resolve is not nil, the API key is
+// fetched again with it when Honeycomb keeps rejecting the key.
+func newDestination(config extension.Config, dest extension.Destination, spoolDir string, policy extension.QueuePolicy, queueMaxBytes int, version string, resolve func() (string, error)) *destination {
+	transport := newSendTransport(config)
+
+	// events wait in the extension's own bounded queue, so libhoney blocks
+	// rather than silently dropping when its pending work is full
+	txMetrics := &libhoneyMetrics{}
+	honeycombTx := &transmission.Honeycomb{
+		MaxBatchSize:          libhoney.DefaultMaxBatchSize,
+		BatchTimeout:          libhoney.DefaultBatchTimeout,
+		MaxConcurrentBatches:  libhoney.DefaultMaxConcurrentBatches,
+		PendingWorkCapacity:   libhoney.DefaultPendingWorkCapacity,
+		BlockOnSend:           true,
+		UserAgentAddition:     fmt.Sprintf("honeycomb-lambda-extension/%s", version),
+		EnableMsgpackEncoding: true,
+		BatchSendTimeout:      transport.timeout,
+		Transport:             transport,
+		Metrics:               txMetrics,
+	}
+	var sender transmission.Sender = honeycombTx
+	if resolve != nil {
+		sender = newAPIKeyRefresher(sender, dest.APIKey, resolve)
+	}
+	txSpooler := newSpoolerFromConfig(config, honeycombTx, sender, spoolDir, dest.APIKey)
+	if txSpooler != nil {
+		sender = txSpooler
+	}
+	txQueue := newQueue(sender, policy, queueMaxBytes)
+
+	apiHost := dest.APIHost
+	if apiHost == "" {
+		apiHost = defaultAPIHost
+	}
+	return &destination{
+		name:    dest.Name,
+		apiKey:  dest.APIKey,
+		apiHost: apiHost,
+		dataset: dest.Dataset,
+		filter:  dest.Filter,
+		sender:  txQueue,
+		metrics: txMetrics,
+		queue:   txQueue,
+		spooler: txSpooler,
+		retries: transport.retries,
+		breaker: transport.breaker,
+		health:  &sendHealth{},
+	}
+}
+
+// matches reports whether ev should be sent to the destination: every field in
+// the destination's filter must be set to one of the filter's values.
+func (d *destination) matches(ev *transmission.Event) bool {
+	for field, values := range d.filter {
+		value, ok := ev.Data[field]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, want := range values {
+			if fmt.Sprint(value) == want {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// full reports whether the destination's ingestion queue is full, or
+// libhoney's pending work queue has recently overflowed.
+func (d *destination) full() bool {
+	return d.queue.Full() || d.metrics.overflowedRecently()
+}
@@ -2,10 +2,12 @@ package eventpublisher
 
 import (
 	"fmt"
-	"net"
 	"net/http"
+	"path/filepath"
+	"time"
 
 	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
 	"github.com/honeycombio/libhoney-go"
 	"github.com/honeycombio/libhoney-go/transmission"
 	"github.com/sirupsen/logrus"
@@ -15,74 +17,250 @@ var (
 	log = logrus.WithFields(logrus.Fields{
 		"source": "hny-lambda-ext-eventpublisher",
 	})
+	// FlushStrategyField is added to every event with the flush strategy in use
+	FlushStrategyField = "lambda_extension.flush_strategy"
 )
 
-// Client is an event publisher that is just a light wrapper around libhoney
+// primaryDestinationName names the destination set by LIBHONEY_API_KEY and
+// LIBHONEY_DATASET, when there are others
+const primaryDestinationName = "primary"
+
+// Client is an event publisher that is just a light wrapper around libhoney,
+// sending every event to one or more destinations
 type Client struct {
 	libhoneyClient *libhoney.Client
+	destinations   []*destination
+	flushStrategy  extension.FlushStrategy
+	responses      chan transmission.Response
 }
 
 // New returns a configured Client
 func New(config extension.Config, version string) (*Client, error) {
-	if config.APIKey == "" || config.Dataset == "" {
+	var dests []extension.Destination
+	if config.APIKey != "" && config.Dataset != "" {
+		dests = append(dests, extension.Destination{
+			Name:    primaryDestinationName,
+			APIKey:  config.APIKey,
+			APIHost: config.APIHost,
+			Dataset: config.Dataset,
+		})
+	}
+	dests = append(dests, config.Destinations...)
+
+	if len(dests) == 0 {
 		log.Warnln("APIKey or Dataset not set, disabling libhoney")
 		libhoneyClient, err := libhoney.NewClient(libhoney.ClientConfig{})
 		if err != nil {
 			return nil, err
 		}
-		return &Client{libhoneyClient: libhoneyClient}, nil
+		client := &Client{
+			libhoneyClient: libhoneyClient,
+			responses:      make(chan transmission.Response, libhoney.DefaultPendingWorkCapacity*2),
+		}
+		go client.readResponses()
+		return client, nil
 	}
 
-	// httpTransport uses settings from http.DefaultTransport as starting point, but
-	// overrides the dialer connect timeout
-	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
-	httpTransport.DialContext = (&net.Dialer{
-		Timeout: config.ConnectTimeout,
-	}).DialContext
+	// with more than one destination, a destination that can't keep up drops
+	// its own events rather than holding up the others, and the queue's memory
+	// is shared between them
+	policy := config.QueuePolicy
+	queueMaxBytes := config.QueueMaxBytes
+	if len(dests) > 1 {
+		if policy != extension.QueuePolicyDropOldest {
+			policy = extension.QueuePolicyDropNewest
+		}
+		queueMaxBytes /= len(dests)
+	}
+	destinations := make([]*destination, len(dests))
+	for i, dest := range dests {
+		spoolDir := config.SpoolDir
+		if i > 0 {
+			spoolDir = filepath.Join(config.SpoolDir, dest.Name)
+		}
+		// only the key from a secret or a parameter can be fetched again,
+		// such as once it's rotated
+		var resolve func() (string, error)
+		if i == 0 && dest.Name == primaryDestinationName && apiKeyRefreshable(config.APIKeySource) {
+			resolve = func() (string, error) { return resolveAPIKey(config) }
+		}
+		destinations[i] = newDestination(config, dest, spoolDir, policy, queueMaxBytes, version, resolve)
+		if len(dests) > 1 {
+			destinations[i].health.destination = dest.Name
+		}
+	}
 
+	primary := destinations[0]
 	libhoneyClient, err := libhoney.NewClient(libhoney.ClientConfig{
-		APIKey:  config.APIKey,
-		Dataset: config.Dataset,
-		APIHost: config.APIHost,
-		Transmission: &transmission.Honeycomb{
-			MaxBatchSize:          libhoney.DefaultMaxBatchSize,
-			BatchTimeout:          libhoney.DefaultBatchTimeout,
-			MaxConcurrentBatches:  libhoney.DefaultMaxConcurrentBatches,
-			PendingWorkCapacity:   libhoney.DefaultPendingWorkCapacity,
-			UserAgentAddition:     fmt.Sprintf("honeycomb-lambda-extension/%s", version),
-			EnableMsgpackEncoding: true,
-			BatchSendTimeout:      config.BatchSendTimeout,
-			Transport:             httpTransport,
-		},
+		APIKey:       primary.apiKey,
+		Dataset:      primary.dataset,
+		APIHost:      primary.apiHost,
+		Transmission: newFanout(destinations),
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	publisher := &Client{libhoneyClient: libhoneyClient}
+	// record how events were flushed so that delivery latency can be explained
+	// when looking at the data
+	flushStrategy := config.FlushStrategy
+	if flushStrategy == "" {
+		flushStrategy = extension.FlushStrategySync
+	}
 
-	if config.Debug {
-		go publisher.readResponses()
+	client := &Client{
+		libhoneyClient: libhoneyClient,
+		destinations:   destinations,
+		flushStrategy:  flushStrategy,
+		responses:      make(chan transmission.Response, libhoney.DefaultPendingWorkCapacity*2),
 	}
 
-	return publisher, nil
+	// responses are always read, so that failures are logged and libhoney
+	// never has to drop responses for want of a reader
+	go client.readResponses()
+
+	return client, nil
 }
 
-func (c *Client) NewEvent() *libhoney.Event {
-	return c.libhoneyClient.NewEvent()
+// NewEvent returns an event with the flush strategy, and the state of the
+// primary destination's circuit breaker if it has one, already set.
+func (c *Client) NewEvent() *publisher.Event {
+	ev := &publisher.Event{}
+	if c.flushStrategy != "" {
+		ev.AddField(FlushStrategyField, string(c.flushStrategy))
+	}
+	if len(c.destinations) > 0 && c.destinations[0].breaker != nil {
+		ev.AddField(BreakerStateField, c.destinations[0].breaker.State().String())
+	}
+	return ev
+}
+
+// Publish hands ev to libhoney to be sent as it is, without sampling it again.
+// While the publisher is Full, ev is refused with an error instead, so that
+// the batch it came in can be retried rather than dropped.
+func (c *Client) Publish(ev *publisher.Event) error {
+	if c.Full() {
+		return errQueueFull
+	}
+	libhoneyEvent := c.libhoneyClient.NewEvent()
+	if !ev.Timestamp.IsZero() {
+		libhoneyEvent.Timestamp = ev.Timestamp
+	}
+	if ev.Dataset != "" {
+		libhoneyEvent.Dataset = ev.Dataset
+	}
+	if ev.SampleRate != 0 {
+		libhoneyEvent.SampleRate = ev.SampleRate
+	}
+	libhoneyEvent.Metadata = ev.Metadata
+	libhoneyEvent.AddFields(ev.Fields())
+	return libhoneyEvent.SendPresampled()
 }
 
 func (c *Client) Flush() {
 	c.libhoneyClient.Flush()
 }
 
+// Full reports whether the publisher should refuse new events for now, because
+// the ingestion queue is full or libhoney's pending work queue has recently
+// overflowed and dropped events. With more than one destination, it is only
+// full when every destination is.
+func (c *Client) Full() bool {
+	if len(c.destinations) == 0 {
+		return false
+	}
+	for _, d := range c.destinations {
+		if !d.full() {
+			return false
+		}
+	}
+	return true
+}
+
+// DroppedSinceLastReport returns the number of events the ingestion queues
+// have dropped since it was last called.
+func (c *Client) DroppedSinceLastReport() int64 {
+	var dropped int64
+	for _, d := range c.destinations {
+		dropped += d.queue.DroppedSinceLastReport()
+	}
+	return dropped
+}
+
+// ReplaySpool hands every spooled event to libhoney, unless sends are
+// currently failing, and flushes them.
+func (c *Client) ReplaySpool() {
+	replayed := false
+	for _, d := range c.destinations {
+		if d.spooler != nil {
+			d.spooler.replay()
+			replayed = true
+		}
+	}
+	if replayed {
+		c.Flush()
+	}
+}
+
+// SetDeadline stops retries of failed batch sends from running past deadline,
+// such as the end of the invocation in progress, and flushes from waiting on
+// responses past HONEYCOMB_FLUSH_MIN_REMAINING before it.
+func (c *Client) SetDeadline(deadline time.Time) {
+	for _, d := range c.destinations {
+		if d.retries != nil {
+			d.retries.SetDeadline(deadline)
+		}
+		if d.spooler != nil {
+			d.spooler.SetDeadline(deadline)
+		}
+	}
+}
+
+// SpooledEvents returns the number of events waiting in the spools
+func (c *Client) SpooledEvents() int {
+	spooled := 0
+	for _, d := range c.destinations {
+		if d.spooler != nil {
+			spooled += d.spooler.spool.pending()
+		}
+	}
+	return spooled
+}
+
+// TxResponses returns the responses to sent events once the publisher has
+// read them. Responses are dropped if they aren't read in time.
 func (c *Client) TxResponses() chan transmission.Response {
-	return c.libhoneyClient.TxResponses()
+	return c.responses
 }
 
-// read batch send responses from Honeycomb and log success/failures
+// Degraded returns an error while sends are persistently failing in a way that
+// won't fix itself, such as Honeycomb rejecting the API key, or nil otherwise.
+// With more than one destination, it is only degraded when every destination
+// is.
+func (c *Client) Degraded() error {
+	if len(c.destinations) == 0 {
+		return nil
+	}
+	var err error
+	for _, d := range c.destinations {
+		if err = d.health.degraded(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// read batch send responses from Honeycomb, count them and log success/failures.
+// Failures are logged at warn level at a limited rate, and every response is
+// logged at debug level.
 func (c *Client) readResponses() {
-	for r := range c.TxResponses() {
+	defer close(c.responses)
+	for r := range c.libhoneyClient.TxResponses() {
+		recordResponse(r)
+		select {
+		case c.responses <- r:
+		default:
+		}
 		var metadata string
 		if r.Metadata != nil {
 			metadata = fmt.Sprintf("%s", r.Metadata)
@@ -13,6 +13,8 @@ import (
 	"time"
 
 	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -123,6 +125,124 @@ func TestEventPublisherUserAgent(t *testing.T) {
 	assert.Nil(t, err, "unexpected error sending test event")
 }
 
+func TestEventPublisherFlushStrategyField(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		flushStrategy extension.FlushStrategy
+		expected      string
+	}{
+		{desc: "default", flushStrategy: "", expected: "sync"},
+		{desc: "async", flushStrategy: extension.FlushStrategyAsync, expected: "async"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			testConfig := extension.Config{
+				APIKey:        "test-api-key",
+				Dataset:       "test-dataset",
+				FlushStrategy: tC.flushStrategy,
+			}
+
+			eventpublisherClient, err := New(testConfig, "test-version")
+			assert.Nil(t, err, "unexpected error when creating client")
+
+			ev := eventpublisherClient.NewEvent()
+			assert.Equal(t, tC.expected, ev.Fields()[FlushStrategyField])
+		})
+	}
+}
+
+func TestEventPublisherSpoolsFailedSends(t *testing.T) {
+	testHandler := &TestHandler{responseCode: http.StatusInternalServerError}
+	testServer := httptest.NewServer(testHandler)
+	defer testServer.Close()
+
+	testConfig := extension.Config{
+		APIKey:        "test-api-key",
+		Dataset:       "test-dataset",
+		APIHost:       testServer.URL,
+		SpoolEnabled:  true,
+		SpoolDir:      t.TempDir(),
+		SpoolMaxBytes: 1 << 20,
+		SpoolMaxAge:   time.Hour,
+	}
+
+	eventpublisherClient, err := New(testConfig, "test-version")
+	assert.Nil(t, err, "unexpected error when creating client")
+
+	err = sendTestEvent(eventpublisherClient)
+	assert.Nil(t, err, "unexpected error sending test event")
+	assert.Equal(t, 1, eventpublisherClient.SpooledEvents())
+
+	// the spool is only replayed once sends are succeeding again
+	testHandler.responseCode = http.StatusOK
+	testHandler.response = []byte(`[{"status":200}]`)
+	err = sendTestEvent(eventpublisherClient)
+	assert.Nil(t, err, "unexpected error sending test event")
+	eventpublisherClient.ReplaySpool()
+	assert.Equal(t, 0, eventpublisherClient.SpooledEvents())
+	assert.Equal(t, 3, int(atomic.LoadInt64(&testHandler.callCount)), "expected the spooled event to be sent again")
+}
+
+func TestEventPublisherCircuitBreakerSpoolsWithoutSending(t *testing.T) {
+	testHandler := &TestHandler{responseCode: http.StatusInternalServerError}
+	testServer := httptest.NewServer(testHandler)
+	defer testServer.Close()
+
+	testConfig := extension.Config{
+		APIKey:                  "test-api-key",
+		Dataset:                 "test-dataset",
+		APIHost:                 testServer.URL,
+		SpoolEnabled:            true,
+		SpoolDir:                t.TempDir(),
+		SpoolMaxBytes:           1 << 20,
+		SpoolMaxAge:             time.Hour,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCooldown:  time.Minute,
+	}
+
+	eventpublisherClient, err := New(testConfig, "test-version")
+	assert.Nil(t, err, "unexpected error when creating client")
+	assert.Equal(t, "closed", eventpublisherClient.NewEvent().Fields()[BreakerStateField])
+
+	err = sendTestEvent(eventpublisherClient)
+	assert.Nil(t, err, "unexpected error sending test event")
+	assert.Equal(t, "open", eventpublisherClient.NewEvent().Fields()[BreakerStateField])
+
+	err = sendTestEvent(eventpublisherClient)
+	assert.Nil(t, err, "unexpected error sending test event")
+	assert.Equal(t, 1, int(atomic.LoadInt64(&testHandler.callCount)), "expected no request while the breaker is open")
+	assert.Equal(t, 2, eventpublisherClient.SpooledEvents())
+}
+
+func TestEventPublisherFansOutToDestinations(t *testing.T) {
+	primaryHandler := &TestHandler{response: []byte(`[{"status":200}]`)}
+	primaryServer := httptest.NewServer(primaryHandler)
+	defer primaryServer.Close()
+	failingHandler := &TestHandler{responseCode: http.StatusInternalServerError}
+	failingServer := httptest.NewServer(failingHandler)
+	defer failingServer.Close()
+
+	testConfig := extension.Config{
+		APIKey:  "test-api-key",
+		Dataset: "test-dataset",
+		APIHost: primaryServer.URL,
+		Destinations: []extension.Destination{{
+			Name:    "failing",
+			APIKey:  "other-api-key",
+			APIHost: failingServer.URL,
+			Dataset: "other-dataset",
+		}},
+	}
+
+	eventpublisherClient, err := New(testConfig, "test-version")
+	assert.Nil(t, err, "unexpected error when creating client")
+
+	err = sendTestEvent(eventpublisherClient)
+	assert.Nil(t, err, "unexpected error sending test event")
+	assert.Equal(t, 1, int(atomic.LoadInt64(&primaryHandler.callCount)), "expected the event to be sent to the primary destination")
+	assert.Equal(t, 1, int(atomic.LoadInt64(&failingHandler.callCount)), "expected the event to be sent to the other destination")
+}
+
 // ###########################################
 // Test implementations
 // ###########################################
@@ -130,12 +250,12 @@ func TestEventPublisherUserAgent(t *testing.T) {
 // sendTestEvent creates a test event and flushes it
 func sendTestEvent(client *Client) error {
 	ev := client.NewEvent()
-	ev.Add(map[string]interface{}{
+	ev.AddFields(map[string]interface{}{
 		"duration_ms": 153.12,
 		"method":      "test",
 	})
 
-	err := ev.Send()
+	err := client.Publish(ev)
 	if err != nil {
 		return err
 	}
@@ -178,3 +298,55 @@ func (h *TestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func TestEventPublisherPublish(t *testing.T) {
+	testTx := &transmission.MockSender{}
+	libhoneyClient, _ := libhoney.NewClient(libhoney.ClientConfig{
+		APIKey:       "test-api-key",
+		Dataset:      "test-dataset",
+		Transmission: testTx,
+	})
+	client := &Client{libhoneyClient: libhoneyClient}
+	timestamp := time.Date(2020, 12, 25, 12, 34, 56, 0, time.UTC)
+
+	plain := client.NewEvent()
+	plain.AddField("method", "plain")
+	assert.NoError(t, client.Publish(plain))
+	overridden := client.NewEvent()
+	overridden.AddField("method", "overridden")
+	overridden.Timestamp = timestamp
+	overridden.Dataset = "other-dataset"
+	overridden.SampleRate = 10
+	overridden.Metadata = "span-name"
+	assert.NoError(t, client.Publish(overridden))
+
+	events := testTx.Events()
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "test-dataset", events[0].Dataset)
+		assert.EqualValues(t, 1, events[0].SampleRate)
+		assert.Equal(t, "plain", events[0].Data["method"])
+		assert.Equal(t, "other-dataset", events[1].Dataset)
+		assert.Equal(t, timestamp, events[1].Timestamp)
+		assert.EqualValues(t, 10, events[1].SampleRate, "expected the event to be sent as already sampled")
+		assert.Equal(t, "span-name", events[1].Metadata)
+	}
+}
+
+func TestEventPublisherRefusesEventsWhileFull(t *testing.T) {
+	client, err := New(extension.Config{
+		APIKey:      "test-api-key",
+		Dataset:     "test-dataset",
+		APIHost:     "http://127.0.0.1:1",
+		QueuePolicy: extension.QueuePolicyDropNewest,
+	}, "test-version")
+	assert.NoError(t, err)
+
+	q := client.destinations[0].queue
+	q.mu.Lock()
+	q.full = true
+	q.mu.Unlock()
+
+	ev := client.NewEvent()
+	ev.AddField("name", "refused")
+	assert.ErrorIs(t, client.Publish(ev), errQueueFull)
+}
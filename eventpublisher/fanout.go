@@ -0,0 +1,147 @@
+package eventpublisher
+
+import (
+	"errors"
+	"maps"
+	"sync"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// defaultAPIHost is where events are sent when a destination has no API host
+const defaultAPIHost = "https://api.honeycomb.io/"
+
+// fanout is a transmission.Sender that hands every event to each destination
+// whose filter it matches. The first destination is the one libhoney is
+// configured with, and is handed events as they are. Every other destination
+// is handed a copy with its own API key, host and dataset, so that no
+// destination waits on another. An event sent to a dataset other than the
+// first destination's keeps its dataset in every destination.
+type fanout struct {
+	destinations []*destination
+	responses    chan transmission.Response
+	readers      sync.WaitGroup
+}
+
+func newFanout(destinations []*destination) *fanout {
+	return &fanout{destinations: destinations}
+}
+
+// Start starts every destination, and begins passing on their responses
+func (f *fanout) Start() error {
+	for _, d := range f.destinations {
+		if err := d.sender.Start(); err != nil {
+			return err
+		}
+	}
+	f.responses = make(chan transmission.Response, libhoney.DefaultPendingWorkCapacity*2)
+	for _, d := range f.destinations {
+		f.readers.Go(func() { f.readResponses(d) })
+	}
+	go func() {
+		f.readers.Wait()
+		close(f.responses)
+	}()
+	return nil
+}
+
+// Stop stops every destination, sending what each has pending
+func (f *fanout) Stop() error {
+	errs := make([]error, len(f.destinations))
+	var wg sync.WaitGroup
+	for i, d := range f.destinations {
+		wg.Go(func() { errs[i] = d.sender.Stop() })
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Add hands ev to every destination it matches. Copies are made before ev is
+// handed to the first destination, which may change it once it has it.
+func (f *fanout) Add(ev *transmission.Event) {
+	primary := f.destinations[0]
+	for _, d := range f.destinations[1:] {
+		if d.matches(ev) {
+			d.sender.Add(d.copyEvent(ev, primary.dataset))
+		}
+	}
+	if primary.matches(ev) {
+		primary.sender.Add(ev)
+	}
+}
+
+// Flush flushes every destination at once, and waits for them all
+func (f *fanout) Flush() error {
+	errs := make([]error, len(f.destinations))
+	var wg sync.WaitGroup
+	for i, d := range f.destinations {
+		wg.Go(func() { errs[i] = d.sender.Flush() })
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (f *fanout) TxResponses() chan transmission.Response {
+	return f.responses
+}
+
+func (f *fanout) SendResponse(r transmission.Response) bool {
+	select {
+	case f.responses <- r:
+		return false
+	default:
+		return true
+	}
+}
+
+// readResponses tracks the health of d from its responses, and passes them on
+func (f *fanout) readResponses(d *destination) {
+	for r := range d.sender.TxResponses() {
+		d.health.record(r)
+		if len(f.destinations) > 1 {
+			recordDestinationResponse(d.name, r)
+		}
+		f.SendResponse(r)
+	}
+}
+
+// copyEvent returns a copy of ev addressed to the destination. The copy's data
+// is a shallow copy of ev's, so that fields can be set on it alone.
+func (d *destination) copyEvent(ev *transmission.Event, primaryDataset string) *transmission.Event {
+	dataset := d.dataset
+	if ev.Dataset != primaryDataset {
+		dataset = ev.Dataset
+	}
+	data := maps.Clone(ev.Data)
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	if d.breaker != nil {
+		data[BreakerStateField] = d.breaker.State().String()
+	}
+	return &transmission.Event{
+		APIKey:     d.apiKey,
+		APIHost:    d.apiHost,
+		Dataset:    dataset,
+		SampleRate: ev.SampleRate,
+		Timestamp:  ev.Timestamp,
+		Metadata:   ev.Metadata,
+		Data:       data,
+	}
+}
+
+// recordDestinationResponse counts a send response as an event sent to or
+// failed by the named destination
+func recordDestinationResponse(name string, r transmission.Response) {
+	if errors.Is(r.Err, errQueueFull) {
+		metrics.Increment("destination." + name + ".events_dropped")
+		return
+	}
+	if r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300 {
+		metrics.Increment("destination." + name + ".events_sent")
+		return
+	}
+	metrics.Increment("destination." + name + ".events_failed")
+}
@@ -0,0 +1,72 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDestination(name, dataset string, filter map[string][]string) (*destination, *respondingSender) {
+	sender := &respondingSender{status: http.StatusOK}
+	return &destination{
+		name:    name,
+		apiKey:  name + "-key",
+		apiHost: "https://" + name + ".example.com/",
+		dataset: dataset,
+		filter:  filter,
+		sender:  sender,
+		health:  &sendHealth{destination: name},
+	}, sender
+}
+
+func TestFanoutSendsToMatchingDestinations(t *testing.T) {
+	primary, primarySender := newTestDestination("primary", "lambda", nil)
+	other, otherSender := newTestDestination("other", "lambda-copy", nil)
+	functionOnly, functionOnlySender := newTestDestination("function-only", "functions", map[string][]string{
+		"lambda_extension.type": {"function"},
+	})
+	f := newFanout([]*destination{primary, other, functionOnly})
+	assert.NoError(t, f.Start())
+
+	f.Add(&transmission.Event{APIKey: "primary-key", Dataset: "lambda", Data: map[string]interface{}{"lambda_extension.type": "function"}})
+	f.Add(&transmission.Event{APIKey: "primary-key", Dataset: "lambda", Data: map[string]interface{}{"lambda_extension.type": "platform.report"}})
+	f.Add(&transmission.Event{APIKey: "primary-key", Dataset: "self", Data: map[string]interface{}{"lambda_extension.type": "extension.self_telemetry"}})
+	assert.NoError(t, f.Flush())
+
+	_, sent := primarySender.counts()
+	assert.Equal(t, 3, sent)
+	_, sent = otherSender.counts()
+	assert.Equal(t, 3, sent)
+	_, sent = functionOnlySender.counts()
+	assert.Equal(t, 1, sent, "expected only events matching the filter")
+
+	copied := otherSender.sent[0]
+	assert.Equal(t, "other-key", copied.APIKey)
+	assert.Equal(t, "https://other.example.com/", copied.APIHost)
+	assert.Equal(t, "lambda-copy", copied.Dataset)
+	assert.Equal(t, "self", otherSender.sent[2].Dataset, "expected an event sent to its own dataset to keep it")
+	assert.Equal(t, "primary-key", primarySender.sent[0].APIKey)
+	assert.NoError(t, f.Stop())
+}
+
+func TestFanoutTracksHealthPerDestination(t *testing.T) {
+	primary, _ := newTestDestination("primary", "lambda", nil)
+	rejected, rejectedSender := newTestDestination("rejected", "lambda", nil)
+	rejectedSender.status = http.StatusUnauthorized
+	f := newFanout([]*destination{primary, rejected})
+	assert.NoError(t, f.Start())
+
+	for range authFailureThreshold {
+		f.Add(&transmission.Event{Dataset: "lambda", Data: map[string]interface{}{}})
+	}
+	assert.NoError(t, f.Flush())
+	for range authFailureThreshold * 2 {
+		<-f.TxResponses()
+	}
+
+	assert.NoError(t, primary.health.degraded())
+	assert.ErrorIs(t, rejected.health.degraded(), ErrAPIKeyRejected)
+	assert.NoError(t, f.Stop())
+}
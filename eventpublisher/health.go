@@ -0,0 +1,110 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// failureLogInterval is the least time between warnings about events
+	// that failed to send. Failures in between are counted in the next one.
+	failureLogInterval = 10 * time.Second
+
+	// authFailureThreshold is the number of send responses in a row rejecting
+	// the API key after which the publisher is considered degraded
+	authFailureThreshold = 10
+)
+
+// ErrAPIKeyRejected is returned by Degraded while Honeycomb keeps rejecting
+// the API key
+var ErrAPIKeyRejected = errors.New("Honeycomb is rejecting the API key, events are not being sent")
+
+// sendHealth follows the responses to events sent to Honeycomb, warning about
+// failures at a limited rate, and noting when the API key is persistently
+// rejected.
+type sendHealth struct {
+	// destination names the destination in logs, if there is more than one
+	destination string
+	// endpoint is logged alongside failures when events aren't sent to the
+	// Events API, such as by the OTLP exporter
+	endpoint string
+
+	mu             sync.Mutex
+	lastWarning    time.Time
+	suppressed     int
+	authFailures   int
+	apiKeyRejected bool
+}
+
+// record takes note of the response to an event
+func (h *sendHealth) record(r transmission.Response) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case errors.Is(r.Err, errQueueFull):
+		// already counted and reported by the queue
+	case r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300:
+		h.authFailures = 0
+		if h.apiKeyRejected {
+			h.apiKeyRejected = false
+			h.logger().Info("Honeycomb is accepting the API key again, events are being sent")
+		}
+	case r.StatusCode == http.StatusUnauthorized:
+		h.authFailures++
+		if !h.apiKeyRejected && h.authFailures >= authFailureThreshold {
+			h.apiKeyRejected = true
+			h.logger().WithField("responses", h.authFailures).Error("Extension degraded: ", ErrAPIKeyRejected, ", please verify the API key")
+		}
+		h.warn(r)
+	default:
+		h.warn(r)
+	}
+}
+
+// warn logs a failed send, unless one was logged within failureLogInterval.
+// The caller must hold h.mu.
+func (h *sendHealth) warn(r transmission.Response) {
+	if time.Since(h.lastWarning) < failureLogInterval {
+		h.suppressed++
+		return
+	}
+	h.lastWarning = time.Now()
+	fields := logrus.Fields{
+		"status_code": r.StatusCode,
+		"suppressed":  h.suppressed,
+	}
+	if r.Err != nil {
+		fields["error"] = r.Err.Error()
+	}
+	if len(r.Body) > 0 {
+		fields["body"] = string(r.Body)
+	}
+	h.suppressed = 0
+	h.logger().WithFields(fields).Warn("Failed to send events")
+}
+
+func (h *sendHealth) logger() *logrus.Entry {
+	entry := log
+	if h.destination != "" {
+		entry = entry.WithField("destination", h.destination)
+	}
+	if h.endpoint != "" {
+		entry = entry.WithField("endpoint", h.endpoint)
+	}
+	return entry
+}
+
+// degraded returns ErrAPIKeyRejected while the API key is being rejected
+func (h *sendHealth) degraded() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.apiKeyRejected {
+		return ErrAPIKeyRejected
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendHealthDegradesOnPersistentAuthFailures(t *testing.T) {
+	h := &sendHealth{}
+	unauthorized := transmission.Response{StatusCode: http.StatusUnauthorized}
+
+	for range authFailureThreshold - 1 {
+		h.record(unauthorized)
+	}
+	assert.NoError(t, h.degraded())
+
+	h.record(unauthorized)
+	assert.ErrorIs(t, h.degraded(), ErrAPIKeyRejected)
+
+	h.record(transmission.Response{StatusCode: http.StatusOK})
+	assert.NoError(t, h.degraded(), "expected a success to end the degraded state")
+}
+
+func TestSendHealthOtherFailuresDoNotDegrade(t *testing.T) {
+	h := &sendHealth{}
+	unauthorized := transmission.Response{StatusCode: http.StatusUnauthorized}
+
+	for range authFailureThreshold - 1 {
+		h.record(unauthorized)
+	}
+	h.record(transmission.Response{StatusCode: http.StatusInternalServerError})
+	h.record(transmission.Response{Err: errQueueFull})
+	h.record(unauthorized)
+	assert.ErrorIs(t, h.degraded(), ErrAPIKeyRejected, "expected failures other than a success to leave the count alone")
+
+	h = &sendHealth{}
+	for range authFailureThreshold {
+		h.record(transmission.Response{StatusCode: http.StatusBadRequest})
+	}
+	assert.NoError(t, h.degraded())
+}
+
+func TestSendHealthRateLimitsWarnings(t *testing.T) {
+	h := &sendHealth{}
+
+	h.record(transmission.Response{Err: errors.New("connection refused")})
+	assert.Equal(t, 0, h.suppressed)
+	for range 5 {
+		h.record(transmission.Response{StatusCode: http.StatusBadRequest})
+	}
+	assert.Equal(t, 5, h.suppressed, "expected failures within the interval to be counted, not logged")
+
+	h.lastWarning = h.lastWarning.Add(-failureLogInterval)
+	h.record(transmission.Response{StatusCode: http.StatusBadRequest})
+	assert.Equal(t, 0, h.suppressed)
+}
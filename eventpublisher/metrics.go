@@ -0,0 +1,103 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// Self-metrics describing what the publisher has sent. Events are counted
+// the same as by the other backends.
+const (
+	MetricEventsSent   = publisher.MetricEventsSent
+	MetricEventsFailed = publisher.MetricEventsFailed
+	MetricBytesSent    = "publisher.bytes_sent"
+)
+
+const (
+	// libhoneyMetricPrefix namespaces libhoney's transmission metrics among
+	// the extension's self-metrics
+	libhoneyMetricPrefix = "libhoney."
+
+	// backpressureWindow is how long the publisher reports itself full after
+	// libhoney's pending work queue last overflowed
+	backpressureWindow = time.Second
+)
+
+// libhoneyMetrics implements libhoney's transmission.Metrics, recording its
+// metrics as self-metrics and noting when its pending work queue overflows.
+type libhoneyMetrics struct {
+	lastOverflow atomic.Int64 // unix nanoseconds
+}
+
+func (m *libhoneyMetrics) Gauge(name string, val interface{}) {
+	if v, ok := toInt64(val); ok {
+		metrics.Gauge(libhoneyMetricPrefix+name, v)
+	}
+}
+
+func (m *libhoneyMetrics) Increment(name string) {
+	if name == "queue_overflow" {
+		m.lastOverflow.Store(time.Now().UnixNano())
+	}
+	metrics.Increment(libhoneyMetricPrefix + name)
+}
+
+func (m *libhoneyMetrics) Count(name string, val interface{}) {
+	if v, ok := toInt64(val); ok {
+		metrics.Add(libhoneyMetricPrefix+name, v)
+	}
+}
+
+// overflowedRecently reports whether the pending work queue overflowed within
+// the backpressure window
+func (m *libhoneyMetrics) overflowedRecently() bool {
+	last := m.lastOverflow.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) < backpressureWindow
+}
+
+// countingTransport is an http.RoundTripper that counts the bytes of request
+// bodies sent to Honeycomb, retries included
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength > 0 {
+		metrics.Add(MetricBytesSent, req.ContentLength)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// recordResponse counts a send response as an event sent or failed. Events
+// dropped by the ingestion queue are already counted as dropped.
+func recordResponse(r transmission.Response) {
+	if errors.Is(r.Err, errQueueFull) {
+		return
+	}
+	if r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300 {
+		metrics.Increment(MetricEventsSent)
+		return
+	}
+	metrics.Increment(MetricEventsFailed)
+}
+
+func toInt64(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,48 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibhoneyMetrics(t *testing.T) {
+	m := &libhoneyMetrics{}
+	assert.False(t, m.overflowedRecently())
+
+	before := metrics.Default.Counter("libhoney.messages_sent")
+	m.Count("messages_sent", 3)
+	m.Gauge("queue_length", 7)
+	assert.Equal(t, before+3, metrics.Default.Counter("libhoney.messages_sent"))
+	assert.Equal(t, int64(7), metrics.Default.Snapshot()["libhoney.queue_length"])
+
+	m.Increment("queue_overflow")
+	assert.True(t, m.overflowedRecently())
+}
+
+func TestRecordResponse(t *testing.T) {
+	tests := map[string]struct {
+		response       transmission.Response
+		expectedSent   int64
+		expectedFailed int64
+	}{
+		"sent":                {response: transmission.Response{StatusCode: http.StatusAccepted}, expectedSent: 1},
+		"rejected":            {response: transmission.Response{StatusCode: http.StatusUnauthorized}, expectedFailed: 1},
+		"failed":              {response: transmission.Response{Err: errCircuitOpen}, expectedFailed: 1},
+		"dropped, not failed": {response: transmission.Response{Err: errQueueFull}},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sentBefore := metrics.Default.Counter(MetricEventsSent)
+			failedBefore := metrics.Default.Counter(MetricEventsFailed)
+
+			recordResponse(tc.response)
+
+			assert.Equal(t, tc.expectedSent, metrics.Default.Counter(MetricEventsSent)-sentBefore)
+			assert.Equal(t, tc.expectedFailed, metrics.Default.Counter(MetricEventsFailed)-failedBefore)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// OTLPExporter is a publisher.OTLP exporting over the same transport as the
+// Events API, retried behind a circuit breaker, and following the responses
+// to its exports as the Events API's destinations do. Exports are neither
+// queued nor spooled: an export that fails is dropped.
+type OTLPExporter struct {
+	*publisher.OTLP
+	flushStrategy extension.FlushStrategy
+	transport     sendTransport
+	health        *sendHealth
+}
+
+// NewOTLPExporter returns an OTLPExporter configured by config
+func NewOTLPExporter(config extension.Config, version string) *OTLPExporter {
+	flushStrategy := config.FlushStrategy
+	if flushStrategy == "" {
+		flushStrategy = extension.FlushStrategySync
+	}
+	transport := newSendTransport(config)
+	e := &OTLPExporter{
+		flushStrategy: flushStrategy,
+		transport:     transport,
+		health:        &sendHealth{endpoint: config.OTLPEndpoint},
+	}
+	client := &http.Client{Transport: transport, Timeout: transport.timeout}
+	e.OTLP = publisher.NewOTLP(config, version, client, e.record)
+	return e
+}
+
+// NewEvent returns an event with the flush strategy, and the state of the
+// circuit breaker if there is one, already set.
+func (e *OTLPExporter) NewEvent() *publisher.Event {
+	ev := e.OTLP.NewEvent()
+	ev.AddField(FlushStrategyField, string(e.flushStrategy))
+	if e.transport.breaker != nil {
+		ev.AddField(BreakerStateField, e.transport.breaker.State().String())
+	}
+	return ev
+}
+
+// SetDeadline stops retries of failed exports from running past deadline
+func (e *OTLPExporter) SetDeadline(deadline time.Time) {
+	if e.transport.retries != nil {
+		e.transport.retries.SetDeadline(deadline)
+	}
+}
+
+// Degraded returns an error while the endpoint persistently rejects the
+// credentials sent with exports, or nil otherwise.
+func (e *OTLPExporter) Degraded() error {
+	return e.health.degraded()
+}
+
+// record takes note of the response to an export
+func (e *OTLPExporter) record(r publisher.OTLPResponse) {
+	e.health.record(transmission.Response{StatusCode: r.StatusCode, Err: r.Err, Body: r.Body})
+}
@@ -0,0 +1,43 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporterAddsFields(t *testing.T) {
+	exporter := NewOTLPExporter(extension.Config{
+		OTLPEndpoint:            "https://api.honeycomb.io",
+		CircuitBreakerThreshold: 3,
+		CircuitBreakerCooldown:  time.Second,
+	}, "test-version")
+
+	fields := exporter.NewEvent().Fields()
+
+	assert.Equal(t, "sync", fields[FlushStrategyField])
+	assert.Equal(t, "closed", fields[BreakerStateField])
+}
+
+func TestOTLPExporterRecordsFailures(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer testServer.Close()
+
+	exporter := NewOTLPExporter(extension.Config{
+		APIKey:       "rejected-api-key",
+		OTLPEndpoint: testServer.URL,
+	}, "test-version")
+
+	for range authFailureThreshold {
+		assert.NoError(t, exporter.Publish(exporter.NewEvent()))
+		exporter.Flush()
+	}
+
+	assert.ErrorIs(t, exporter.Degraded(), ErrAPIKeyRejected)
+}
@@ -0,0 +1,266 @@
+package eventpublisher
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// Self-metrics describing the ingestion queue
+const (
+	MetricQueueEventsDropped = "queue.events_dropped"
+	MetricQueueBytesDropped  = "queue.bytes_dropped"
+	MetricQueueEvents        = "queue.events"
+	MetricQueueBytes         = "queue.bytes"
+)
+
+const (
+	// defaultQueueMaxBytes is used when the config doesn't size the queue
+	defaultQueueMaxBytes = 8 << 20
+
+	// eventOverhead approximates the bytes an event takes beyond its fields,
+	// such as its timestamp, sample rate and encoding
+	eventOverhead = 64
+)
+
+// errQueueFull is the error in the response for an event dropped by the queue
+var errQueueFull = errors.New("ingestion queue full")
+
+// queue is a transmission.Sender that holds events in a FIFO bounded by their
+// estimated size in bytes, and hands them one at a time to the wrapped Sender.
+// The wrapped Sender should block rather than drop when its own pending work
+// is full, so the queue's policy alone decides what is dropped.
+type queue struct {
+	transmission.Sender
+
+	policy   extension.QueuePolicy
+	maxBytes int
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	items    []queuedEvent
+	bytes    int
+	added    uint64 // events ever enqueued
+	resolved uint64 // enqueued events since handed on or dropped
+	full     bool   // an event didn't fit, and the queue hasn't drained since
+	stopped  bool
+	done     chan struct{}
+
+	droppedSinceReport atomic.Int64
+}
+
+type queuedEvent struct {
+	ev   *transmission.Event
+	size int
+}
+
+// newQueue wraps sender in a queue holding up to maxBytes of events
+func newQueue(sender transmission.Sender, policy extension.QueuePolicy, maxBytes int) *queue {
+	if maxBytes <= 0 {
+		maxBytes = defaultQueueMaxBytes
+	}
+	q := &queue{
+		Sender:   sender,
+		policy:   policy,
+		maxBytes: maxBytes,
+		done:     make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start starts the wrapped Sender and begins handing queued events to it
+func (q *queue) Start() error {
+	if err := q.Sender.Start(); err != nil {
+		return err
+	}
+	go q.run()
+	return nil
+}
+
+// Stop hands every queued event to the wrapped Sender, then stops it
+func (q *queue) Stop() error {
+	q.mu.Lock()
+	q.stopped = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.done
+	return q.Sender.Stop()
+}
+
+// Add enqueues ev, applying the queue's policy if there isn't room for it. An
+// event too large for the queue is still accepted when the queue is empty.
+func (q *queue) Add(ev *transmission.Event) {
+	item := queuedEvent{ev: ev, size: eventSize(ev)}
+	var dropped []queuedEvent
+
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		q.Sender.Add(ev)
+		return
+	}
+	switch q.policy {
+	case extension.QueuePolicyDropNewest:
+		if q.overflows(item.size) {
+			q.full = true
+			q.mu.Unlock()
+			q.drop([]queuedEvent{item})
+			return
+		}
+	case extension.QueuePolicyDropOldest:
+		for q.overflows(item.size) {
+			dropped = append(dropped, q.pop())
+			q.resolved++
+		}
+	default:
+		for q.overflows(item.size) && !q.stopped {
+			q.full = true
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.mu.Unlock()
+			q.Sender.Add(ev)
+			return
+		}
+	}
+	q.items = append(q.items, item)
+	q.bytes += item.size
+	q.added++
+	q.recordDepth()
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	q.drop(dropped)
+}
+
+// Flush waits for every event enqueued before the call to be handed to the
+// wrapped Sender, then flushes it.
+func (q *queue) Flush() error {
+	q.mu.Lock()
+	target := q.added
+	for q.resolved < target {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+	return q.Sender.Flush()
+}
+
+// Full reports whether new batches should be refused until the queue drains.
+// Once an event doesn't fit, the queue stays full until it is down to half its
+// size, so that batches aren't accepted only to be dropped or held up. With the
+// drop-oldest policy room is always made, so it is never full.
+func (q *queue) Full() bool {
+	if q.policy == extension.QueuePolicyDropOldest {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.full
+}
+
+// DroppedSinceLastReport returns the number of events dropped since it was
+// last called.
+func (q *queue) DroppedSinceLastReport() int64 {
+	return q.droppedSinceReport.Swap(0)
+}
+
+// run hands queued events to the wrapped Sender until the queue is stopped
+// and empty.
+func (q *queue) run() {
+	defer close(q.done)
+	for {
+		q.mu.Lock()
+		for len(q.items) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		item := q.pop()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		q.Sender.Add(item.ev)
+
+		q.mu.Lock()
+		q.resolved++
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// overflows reports whether an event of the given size doesn't fit alongside
+// those already queued. The caller must hold q.mu.
+func (q *queue) overflows(size int) bool {
+	return len(q.items) > 0 && q.bytes+size > q.maxBytes
+}
+
+// pop removes the oldest queued event. The caller must hold q.mu.
+func (q *queue) pop() queuedEvent {
+	item := q.items[0]
+	q.items[0] = queuedEvent{}
+	q.items = q.items[1:]
+	q.bytes -= item.size
+	if q.bytes <= q.maxBytes/2 {
+		q.full = false
+	}
+	q.recordDepth()
+	return item
+}
+
+// recordDepth updates the queue depth gauges. The caller must hold q.mu.
+func (q *queue) recordDepth() {
+	metrics.Gauge(MetricQueueEvents, int64(len(q.items)))
+	metrics.Gauge(MetricQueueBytes, int64(q.bytes))
+}
+
+// drop counts dropped events and reports them on the response channel, as
+// libhoney does for events it can't send.
+func (q *queue) drop(items []queuedEvent) {
+	for _, item := range items {
+		q.droppedSinceReport.Add(1)
+		metrics.Increment(MetricQueueEventsDropped)
+		metrics.Add(MetricQueueBytesDropped, int64(item.size))
+		q.Sender.SendResponse(transmission.Response{
+			Err:      errQueueFull,
+			Metadata: item.ev.Metadata,
+		})
+	}
+	if len(items) > 0 {
+		log.Debugf("Ingestion queue full, dropped %d events", len(items))
+	}
+}
+
+// eventSize estimates the encoded size of an event from its fields
+func eventSize(ev *transmission.Event) int {
+	return eventOverhead + valueSize(ev.Data)
+}
+
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case map[string]interface{}:
+		size := 0
+		for key, elem := range v {
+			size += len(key) + valueSize(elem)
+		}
+		return size
+	case []interface{}:
+		size := 0
+		for _, elem := range v {
+			size += valueSize(elem)
+		}
+		return size
+	default:
+		return 8
+	}
+}
@@ -0,0 +1,128 @@
+package eventpublisher
+
+import (
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedSender is a MockSender whose Add blocks until release is closed,
+// standing in for libhoney with BlockOnSend while Honeycomb is slow.
+type gatedSender struct {
+	*transmission.MockSender
+	entered chan struct{}
+	release chan struct{}
+}
+
+func newGatedSender() *gatedSender {
+	return &gatedSender{
+		MockSender: &transmission.MockSender{},
+		entered:    make(chan struct{}, 10),
+		release:    make(chan struct{}),
+	}
+}
+
+func (g *gatedSender) Add(ev *transmission.Event) {
+	g.entered <- struct{}{}
+	<-g.release
+	g.MockSender.Add(ev)
+}
+
+func testEvent(n int) *transmission.Event {
+	return &transmission.Event{Data: map[string]interface{}{"n": n}, Metadata: n}
+}
+
+func sentNumbers(sender *gatedSender) []int {
+	var numbers []int
+	for _, ev := range sender.Events() {
+		numbers = append(numbers, ev.Data["n"].(int))
+	}
+	return numbers
+}
+
+// fillQueue adds four events to a queue with room for two while the first is
+// stuck being handed to the sender.
+func fillQueue(t *testing.T, policy extension.QueuePolicy) (*queue, *gatedSender) {
+	sender := newGatedSender()
+	q := newQueue(sender, policy, 2*eventSize(testEvent(0))+1)
+	assert.NoError(t, q.Start())
+
+	q.Add(testEvent(0))
+	<-sender.entered
+	q.Add(testEvent(1))
+	q.Add(testEvent(2))
+	assert.False(t, q.Full())
+	return q, sender
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	q, sender := fillQueue(t, extension.QueuePolicyDropNewest)
+	q.Add(testEvent(3))
+	assert.True(t, q.Full())
+	assert.Equal(t, int64(1), q.DroppedSinceLastReport())
+	assert.Equal(t, int64(0), q.DroppedSinceLastReport())
+
+	res := <-q.TxResponses()
+	assert.Equal(t, errQueueFull, res.Err)
+	assert.Equal(t, 3, res.Metadata)
+
+	close(sender.release)
+	assert.NoError(t, q.Flush())
+	assert.Equal(t, []int{0, 1, 2}, sentNumbers(sender))
+	assert.NoError(t, q.Stop())
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	q, sender := fillQueue(t, extension.QueuePolicyDropOldest)
+	q.Add(testEvent(3))
+	assert.False(t, q.Full())
+	assert.Equal(t, int64(1), q.DroppedSinceLastReport())
+
+	res := <-q.TxResponses()
+	assert.Equal(t, errQueueFull, res.Err)
+	assert.Equal(t, 1, res.Metadata)
+
+	close(sender.release)
+	assert.NoError(t, q.Flush())
+	assert.Equal(t, []int{0, 2, 3}, sentNumbers(sender))
+	assert.NoError(t, q.Stop())
+}
+
+func TestQueueBlock(t *testing.T) {
+	q, sender := fillQueue(t, extension.QueuePolicyBlock)
+
+	added := make(chan struct{})
+	go func() {
+		q.Add(testEvent(3))
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Add returned while the queue was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.True(t, q.Full())
+
+	close(sender.release)
+	<-added
+	assert.NoError(t, q.Flush())
+	assert.Equal(t, []int{0, 1, 2, 3}, sentNumbers(sender))
+	assert.Equal(t, int64(0), q.DroppedSinceLastReport())
+	assert.NoError(t, q.Stop())
+}
+
+func TestQueueAcceptsOversizedEventWhenEmpty(t *testing.T) {
+	sender := newGatedSender()
+	close(sender.release)
+	q := newQueue(sender, extension.QueuePolicyDropNewest, 1)
+	assert.NoError(t, q.Start())
+
+	q.Add(testEvent(0))
+	assert.NoError(t, q.Flush())
+	assert.Equal(t, []int{0}, sentNumbers(sender))
+	assert.Equal(t, int64(0), q.DroppedSinceLastReport())
+	assert.NoError(t, q.Stop())
+}
@@ -0,0 +1,238 @@
+package eventpublisher
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// Self-metrics describing retries of batch sends
+const (
+	MetricRetries             = "retry.attempts"
+	MetricRetryGiveUps        = "retry.give_ups"
+	MetricRetryBudgetExceeded = "retry.budget_exceeded"
+)
+
+// retryPolicy decides whether and when a failed batch send is retried
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	budget         time.Duration
+	attemptTimeout time.Duration
+}
+
+func retryPolicyFromConfig(config extension.Config) retryPolicy {
+	return retryPolicy{
+		maxAttempts:    config.RetryMaxAttempts,
+		initialBackoff: config.RetryInitialBackoff,
+		maxBackoff:     config.RetryMaxBackoff,
+		jitter:         min(max(config.RetryJitter, 0), 1),
+		budget:         config.RetryBudget,
+		attemptTimeout: config.BatchSendTimeout,
+	}
+}
+
+// backoff returns how long to wait before the given attempt, counting from 1
+// for the first send. Each backoff doubles the last, up to maxBackoff, less a
+// random fraction of up to jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.initialBackoff
+	for i := 2; i < attempt && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, p.maxBackoff)
+	return d - time.Duration(rand.Float64()*p.jitter*float64(d))
+}
+
+// retryTransport is an http.RoundTripper that retries batch sends that fail
+// with a 429, a 5xx or a network error, following a retryPolicy. Other
+// responses, including 400 and 401, are returned as they are. When it gives up
+// on a retryable failure, it returns an error rather than the response, so
+// libhoney doesn't retry the batch again on top.
+//
+// Each attempt is given the policy's attempt timeout, and retries are also cut
+// short at the end of the budget or the deadline.
+type retryTransport struct {
+	next   http.RoundTripper
+	policy retryPolicy
+
+	// deadline is the time, in unix nanoseconds, that no retry may run past,
+	// or zero if there isn't one
+	deadline atomic.Int64
+}
+
+func newRetryTransport(next http.RoundTripper, policy retryPolicy) *retryTransport {
+	return &retryTransport{next: next, policy: policy}
+}
+
+// SetDeadline stops retries from running past t, such as the deadline of the
+// invocation in progress. The zero time removes the deadline.
+func (t *retryTransport) SetDeadline(deadline time.Time) {
+	if deadline.IsZero() {
+		t.deadline.Store(0)
+		return
+	}
+	t.deadline.Store(deadline.UnixNano())
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		res, err := t.attempt(req, t.attemptDeadline(start, attempt))
+		if !retryable(res, err) || ctx.Err() != nil {
+			return res, err
+		}
+
+		wait := t.policy.backoff(attempt + 1)
+		if after, ok := retryAfter(res); ok {
+			wait = after
+		}
+		if attempt >= t.policy.maxAttempts || req.GetBody == nil {
+			metrics.Increment(MetricRetryGiveUps)
+			return giveUp(res, err, attempt)
+		}
+		if !t.allows(start, wait) {
+			metrics.Increment(MetricRetryBudgetExceeded)
+			metrics.Increment(MetricRetryGiveUps)
+			return giveUp(res, err, attempt)
+		}
+		if res != nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(ctx)
+		req.Body = body
+		metrics.Increment(MetricRetries)
+		log.Debugf("Retrying batch send, attempt %d after %s", attempt+1, wait)
+	}
+}
+
+// attempt sends req, giving up at deadline if it isn't zero. The response body
+// can be read until it is closed.
+func (t *retryTransport) attempt(req *http.Request, deadline time.Time) (*http.Response, error) {
+	if deadline.IsZero() {
+		return t.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithDeadline(req.Context(), deadline)
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// attemptDeadline returns when the given attempt of a send that began at start
+// must give up. The first attempt only has the attempt timeout, while retries
+// also end with the budget and the deadline.
+func (t *retryTransport) attemptDeadline(start time.Time, attempt int) time.Time {
+	var deadline time.Time
+	if t.policy.attemptTimeout > 0 {
+		deadline = time.Now().Add(t.policy.attemptTimeout)
+	}
+	if attempt == 1 {
+		return deadline
+	}
+	limit := t.limit(start)
+	if !limit.IsZero() && (deadline.IsZero() || limit.Before(deadline)) {
+		deadline = limit
+	}
+	return deadline
+}
+
+// limit returns the time no retry of a send that began at start may run past,
+// or the zero time if there isn't one
+func (t *retryTransport) limit(start time.Time) time.Time {
+	var limit time.Time
+	if t.policy.budget > 0 {
+		limit = start.Add(t.policy.budget)
+	}
+	if deadline := t.deadline.Load(); deadline != 0 {
+		if at := time.Unix(0, deadline); limit.IsZero() || at.Before(limit) {
+			limit = at
+		}
+	}
+	return limit
+}
+
+// allows reports whether a retry after waiting wait would start within the
+// budget for a send that began at start, and before the deadline
+func (t *retryTransport) allows(start time.Time, wait time.Duration) bool {
+	limit := t.limit(start)
+	return limit.IsZero() || time.Now().Add(wait).Before(limit)
+}
+
+// cancelOnClose cancels an attempt's context once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// retryable reports whether a send failed in a way that may pass: a network
+// error, a 429 or a 5xx.
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// retryAfter returns the wait asked for by a 429 or 503's Retry-After header,
+// given either in seconds or as a date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res == nil || (res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+	return 0, false
+}
+
+// giveUp ends a send that is still failing after its last attempt
+func giveUp(res *http.Response, err error, attempts int) (*http.Response, error) {
+	if res != nil {
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("giving up after %d attempts: %s", attempts, res.Status)
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %v", attempts, err)
+}
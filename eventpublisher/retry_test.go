@@ -0,0 +1,183 @@
+package eventpublisher
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRetryPolicy = retryPolicy{
+	maxAttempts:    3,
+	initialBackoff: time.Millisecond,
+	maxBackoff:     10 * time.Millisecond,
+	budget:         time.Second,
+	attemptTimeout: time.Second,
+}
+
+// statusServer answers each request with the next of statuses, repeating the
+// last one, and counts the requests it gets.
+func statusServer(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int64) {
+	calls := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "batch", string(body), "expected every attempt to send the whole batch")
+		n := int(calls.Add(1))
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func sendBatch(client *http.Client, url string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader([]byte("batch")))
+	res, err := client.Do(req)
+	if err == nil {
+		res.Body.Close()
+	}
+	return res, err
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := map[string]struct {
+		statuses      []int
+		expectedCalls int64
+		expectedCode  int
+	}{
+		"succeeds without retrying": {
+			statuses:      []int{http.StatusOK},
+			expectedCalls: 1,
+			expectedCode:  http.StatusOK,
+		},
+		"retries a server error": {
+			statuses:      []int{http.StatusInternalServerError, http.StatusOK},
+			expectedCalls: 2,
+			expectedCode:  http.StatusOK,
+		},
+		"retries a 429": {
+			statuses:      []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusOK},
+			expectedCalls: 3,
+			expectedCode:  http.StatusOK,
+		},
+		"gives up after max attempts": {
+			statuses:      []int{http.StatusServiceUnavailable},
+			expectedCalls: 3,
+		},
+		"does not retry a bad request": {
+			statuses:      []int{http.StatusBadRequest},
+			expectedCalls: 1,
+			expectedCode:  http.StatusBadRequest,
+		},
+		"does not retry a rejected API key": {
+			statuses:      []int{http.StatusUnauthorized},
+			expectedCalls: 1,
+			expectedCode:  http.StatusUnauthorized,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			server, calls := statusServer(t, nil, tc.statuses...)
+			client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, testRetryPolicy)}
+
+			res, err := sendBatch(client, server.URL)
+
+			assert.Equal(t, tc.expectedCalls, calls.Load())
+			if tc.expectedCode == 0 {
+				assert.ErrorContains(t, err, "giving up after 3 attempts")
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expectedCode, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestRetryTransportRecordsMetrics(t *testing.T) {
+	retriesBefore := metrics.Default.Counter(MetricRetries)
+	giveUpsBefore := metrics.Default.Counter(MetricRetryGiveUps)
+	server, _ := statusServer(t, nil, http.StatusInternalServerError)
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, testRetryPolicy)}
+
+	_, err := sendBatch(client, server.URL)
+
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), metrics.Default.Counter(MetricRetries)-retriesBefore)
+	assert.Equal(t, int64(1), metrics.Default.Counter(MetricRetryGiveUps)-giveUpsBefore)
+}
+
+func TestRetryTransportHonorsRetryAfter(t *testing.T) {
+	server, calls := statusServer(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests, http.StatusOK)
+	policy := testRetryPolicy
+	policy.budget = 5 * time.Second
+	client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, policy)}
+
+	start := time.Now()
+	res, err := sendBatch(client, server.URL)
+
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, int64(2), calls.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "expected the retry to wait as asked")
+}
+
+func TestRetryTransportStopsAtBudgetAndDeadline(t *testing.T) {
+	tests := map[string]struct {
+		budget   time.Duration
+		deadline time.Time
+	}{
+		"budget": {
+			budget: 500 * time.Millisecond,
+		},
+		"deadline": {
+			budget:   time.Minute,
+			deadline: time.Now().Add(500 * time.Millisecond),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			before := metrics.Default.Counter(MetricRetryBudgetExceeded)
+			// Retry-After asks for a longer wait than the budget or deadline allow
+			server, calls := statusServer(t, http.Header{"Retry-After": {"2"}}, http.StatusServiceUnavailable)
+			policy := testRetryPolicy
+			policy.budget = tc.budget
+			transport := newRetryTransport(http.DefaultTransport, policy)
+			transport.SetDeadline(tc.deadline)
+			client := &http.Client{Transport: transport}
+
+			start := time.Now()
+			_, err := sendBatch(client, server.URL)
+
+			assert.ErrorContains(t, err, "giving up after 1 attempts")
+			assert.Equal(t, int64(1), calls.Load())
+			assert.Less(t, time.Since(start), time.Second)
+			assert.Equal(t, int64(1), metrics.Default.Counter(MetricRetryBudgetExceeded)-before)
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{initialBackoff: 100 * time.Millisecond, maxBackoff: time.Second, jitter: 0.5}
+	tests := map[int]time.Duration{
+		2: 100 * time.Millisecond,
+		3: 200 * time.Millisecond,
+		4: 400 * time.Millisecond,
+		5: 800 * time.Millisecond,
+		6: time.Second,
+		9: time.Second,
+	}
+	for attempt, expected := range tests {
+		backoff := policy.backoff(attempt)
+		assert.LessOrEqual(t, backoff, expected, "attempt %d", attempt)
+		assert.GreaterOrEqual(t, backoff, expected/2, "attempt %d", attempt)
+	}
+}
@@ -0,0 +1,285 @@
+package eventpublisher
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// Self-metrics describing the spool
+const (
+	MetricSpoolEventsWritten  = "spool.events_written"
+	MetricSpoolEventsReplayed = "spool.events_replayed"
+	MetricSpoolEventsExpired  = "spool.events_expired"
+	MetricSpoolEventsEvicted  = "spool.events_evicted"
+	MetricSpoolWriteErrors    = "spool.write_errors"
+	MetricSpoolBytes          = "spool.bytes"
+)
+
+const (
+	spoolExt     = ".json"
+	spoolGzipExt = ".json.gz"
+	spoolTmpExt  = ".tmp"
+)
+
+// spooledEvent is an event as kept on disk. The API key isn't kept, and is
+// supplied again when the event is replayed.
+type spooledEvent struct {
+	APIHost    string                 `json:"apiHost"`
+	Dataset    string                 `json:"dataset"`
+	SampleRate uint                   `json:"sampleRate"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// spool keeps batches of events on disk, one file per batch, named so that
+// they sort oldest first and record how many events they hold. Files are
+// written to a temporary name and renamed into place, so a batch is either
+// wholly in the spool or not at all, even if the sandbox is frozen or killed
+// partway through.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	compress bool
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+type spoolFile struct {
+	name    string
+	created time.Time
+	events  int
+	size    int64
+}
+
+// newSpool returns a spool keeping batches in dir, creating it if needed
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, compress bool) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, compress: compress}, nil
+}
+
+// write adds a batch of events to the spool, then evicts the oldest batches
+// if the spool has grown past its size bound.
+func (s *spool) write(events []spooledEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	ext := spoolExt
+	if s.compress {
+		ext = spoolGzipExt
+	}
+	name := fmt.Sprintf("%020d-%06d-%d%s", time.Now().UnixNano(), s.seq, len(events), ext)
+	path := filepath.Join(s.dir, name)
+	if err := s.writeFile(path+spoolTmpExt, events); err != nil {
+		os.Remove(path + spoolTmpExt)
+		metrics.Increment(MetricSpoolWriteErrors)
+		return err
+	}
+	if err := os.Rename(path+spoolTmpExt, path); err != nil {
+		os.Remove(path + spoolTmpExt)
+		metrics.Increment(MetricSpoolWriteErrors)
+		return err
+	}
+	metrics.Add(MetricSpoolEventsWritten, int64(len(events)))
+	s.enforceLimits()
+	return nil
+}
+
+func (s *spool) writeFile(path string, events []spooledEvent) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if s.compress {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// next removes the oldest batch from the spool and returns its events,
+// discarding any batches that have expired on the way. It returns nil once
+// the spool is empty.
+func (s *spool) next() ([]spooledEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		path := filepath.Join(s.dir, file.name)
+		if s.expired(file) {
+			os.Remove(path)
+			metrics.Add(MetricSpoolEventsExpired, int64(file.events))
+			continue
+		}
+		events, err := readSpoolFile(path)
+		os.Remove(path)
+		s.recordSize()
+		if err != nil {
+			return nil, fmt.Errorf("discarding unreadable spool file %s: %w", file.name, err)
+		}
+		return events, nil
+	}
+	s.recordSize()
+	return nil, nil
+}
+
+func readSpoolFile(path string) ([]spooledEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, spoolGzipExt) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var events []spooledEvent
+	if err := json.NewDecoder(r).Decode(&events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// pending returns the number of events in the spool
+func (s *spool) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, _ := s.list()
+	events := 0
+	for _, file := range files {
+		events += file.events
+	}
+	return events
+}
+
+// enforceLimits removes expired batches, then the oldest batches until the
+// spool fits in maxBytes. The caller must hold s.mu.
+func (s *spool) enforceLimits() {
+	files, err := s.list()
+	if err != nil {
+		return
+	}
+	var total int64
+	var kept []spoolFile
+	for _, file := range files {
+		if s.expired(file) {
+			os.Remove(filepath.Join(s.dir, file.name))
+			metrics.Add(MetricSpoolEventsExpired, int64(file.events))
+			continue
+		}
+		total += file.size
+		kept = append(kept, file)
+	}
+	for _, file := range kept {
+		if total <= s.maxBytes {
+			break
+		}
+		os.Remove(filepath.Join(s.dir, file.name))
+		metrics.Add(MetricSpoolEventsEvicted, int64(file.events))
+		total -= file.size
+	}
+	metrics.Gauge(MetricSpoolBytes, total)
+}
+
+// recordSize updates the spool size gauge. The caller must hold s.mu.
+func (s *spool) recordSize() {
+	files, err := s.list()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	metrics.Gauge(MetricSpoolBytes, total)
+}
+
+func (s *spool) expired(file spoolFile) bool {
+	return s.maxAge > 0 && time.Since(file.created) > s.maxAge
+}
+
+// list returns the batches in the spool, oldest first. Files that aren't
+// spooled batches, such as ones still being written, are skipped. The caller
+// must hold s.mu.
+func (s *spool) list() ([]spoolFile, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []spoolFile
+	for _, entry := range entries {
+		file, ok := parseSpoolFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			file.size = info.Size()
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// parseSpoolFileName parses a name of the form <unix nanos>-<seq>-<events>.json[.gz]
+func parseSpoolFileName(name string) (spoolFile, bool) {
+	base, ok := strings.CutSuffix(name, spoolGzipExt)
+	if !ok {
+		if base, ok = strings.CutSuffix(name, spoolExt); !ok {
+			return spoolFile{}, false
+		}
+	}
+	parts := strings.Split(base, "-")
+	if len(parts) != 3 {
+		return spoolFile{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return spoolFile{}, false
+	}
+	events, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return spoolFile{}, false
+	}
+	return spoolFile{name: name, created: time.Unix(0, nanos), events: events}, true
+}
@@ -0,0 +1,104 @@
+package eventpublisher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSpooledEvents(n int) []spooledEvent {
+	events := make([]spooledEvent, n)
+	for i := range events {
+		events[i] = spooledEvent{
+			APIHost:    "https://api.example.com",
+			Dataset:    "test-dataset",
+			SampleRate: 1,
+			Timestamp:  time.Date(2020, 12, 25, 12, 34, 56, 0, time.UTC),
+			Data:       map[string]interface{}{"n": float64(i), "name": fmt.Sprintf("event-%d", i)},
+		}
+	}
+	return events
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			sp, err := newSpool(t.TempDir(), 1<<20, time.Hour, compress)
+			assert.NoError(t, err)
+
+			assert.NoError(t, sp.write(testSpooledEvents(2)))
+			assert.NoError(t, sp.write(testSpooledEvents(3)))
+			assert.Equal(t, 5, sp.pending())
+
+			events, err := sp.next()
+			assert.NoError(t, err)
+			assert.Equal(t, testSpooledEvents(2), events, "expected the oldest batch first")
+			events, err = sp.next()
+			assert.NoError(t, err)
+			assert.Equal(t, testSpooledEvents(3), events)
+
+			events, err = sp.next()
+			assert.NoError(t, err)
+			assert.Nil(t, events)
+			assert.Equal(t, 0, sp.pending())
+		})
+	}
+}
+
+func TestSpoolEvictsOldestWhenFull(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := newSpool(dir, 1<<20, time.Hour, false)
+	assert.NoError(t, err)
+	assert.NoError(t, sp.write(testSpooledEvents(1)))
+	files, _ := os.ReadDir(dir)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	info, _ := files[0].Info()
+
+	// room for two batches of one event
+	sp.maxBytes = 2 * info.Size()
+	assert.NoError(t, sp.write(testSpooledEvents(1)))
+	assert.NoError(t, sp.write(testSpooledEvents(1)))
+
+	files, _ = os.ReadDir(dir)
+	assert.Len(t, files, 2)
+	assert.NotContains(t, []string{files[0].Name(), files[1].Name()}, info.Name(), "expected the oldest batch to be evicted")
+}
+
+func TestSpoolDiscardsExpiredBatches(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := newSpool(dir, 1<<20, time.Minute, true)
+	assert.NoError(t, err)
+	assert.NoError(t, sp.write(testSpooledEvents(2)))
+
+	files, _ := os.ReadDir(dir)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	old := fmt.Sprintf("%020d-%06d-%d%s", time.Now().Add(-time.Hour).UnixNano(), 0, 2, spoolGzipExt)
+	assert.NoError(t, os.Rename(filepath.Join(dir, files[0].Name()), filepath.Join(dir, old)))
+
+	events, err := sp.next()
+	assert.NoError(t, err)
+	assert.Nil(t, events)
+	files, _ = os.ReadDir(dir)
+	assert.Empty(t, files)
+}
+
+func TestSpoolIgnoresPartialWrites(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := newSpool(dir, 1<<20, time.Hour, true)
+	assert.NoError(t, err)
+	partial := fmt.Sprintf("%020d-%06d-%d%s%s", time.Now().UnixNano(), 0, 5, spoolGzipExt, spoolTmpExt)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, partial), []byte("{"), 0o600))
+
+	assert.Equal(t, 0, sp.pending())
+	events, err := sp.next()
+	assert.NoError(t, err)
+	assert.Nil(t, events)
+}
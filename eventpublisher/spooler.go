@@ -0,0 +1,344 @@
+package eventpublisher
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/libhoney-go"
+	"github.com/honeycombio/libhoney-go/transmission"
+)
+
+// spoolTag stands in for an event's metadata while the spooler waits for the
+// event's response, so the response can be matched back to the event.
+type spoolTag struct {
+	id       uint64
+	metadata interface{}
+}
+
+// spooler is a transmission.Sender that keeps track of the events it hands to
+// the wrapped Sender until their responses come back. Events that fail to send
+// for reasons that may pass, such as a timeout or a 5xx, are written to the
+// spool when the Sender is flushed. Once a flush goes by with every send
+// succeeding, spooled events are replayed in the background, ahead of any new
+// events. Events whose responses haven't come back by the time a flush stops
+// waiting for them are spooled too, so they may be sent twice should a
+// response turn out to be a success after all.
+//
+// The wrapped Sender must not drop responses, so that every event is resolved.
+type spooler struct {
+	transmission.Sender
+
+	spool           *spool
+	apiKey          string
+	responseTimeout time.Duration
+	minRemaining    time.Duration
+	responses       chan transmission.Response
+
+	// deadline is the deadline set by SetDeadline, in unix nanoseconds, or 0
+	// if there is none
+	deadline atomic.Int64
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	nextID     uint64
+	pending    map[uint64]*transmission.Event
+	failed     []*transmission.Event
+	sawSuccess bool
+	sawFailure bool
+	// lastFlushFailed is true if a send failed in the lead up to the last flush
+	lastFlushFailed bool
+
+	// replayMu is held while a spooled batch is handed on, so that it goes
+	// ahead of new events
+	replayMu       sync.Mutex
+	replayRequests chan struct{}
+	stop           chan struct{}
+}
+
+// newSpooler wraps sender, spooling events that fail to send to sp. Replayed
+// events are sent with apiKey. Flush waits up to responseTimeout for the
+// responses to the events it flushed, and never past minRemaining before the
+// deadline set by SetDeadline.
+func newSpooler(sender transmission.Sender, sp *spool, apiKey string, responseTimeout, minRemaining time.Duration) *spooler {
+	s := &spooler{
+		Sender:          sender,
+		spool:           sp,
+		apiKey:          apiKey,
+		responseTimeout: responseTimeout,
+		minRemaining:    minRemaining,
+		pending:         make(map[uint64]*transmission.Event),
+		replayRequests:  make(chan struct{}, 1),
+		stop:            make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *spooler) Start() error {
+	if err := s.Sender.Start(); err != nil {
+		return err
+	}
+	s.responses = make(chan transmission.Response, libhoney.DefaultPendingWorkCapacity*2)
+	go s.readResponses()
+	go s.replayer()
+	return nil
+}
+
+func (s *spooler) Stop() error {
+	close(s.stop)
+	return s.Sender.Stop()
+}
+
+// Add hands ev to the wrapped Sender, waiting for any spooled batch being
+// replayed to be handed on first.
+func (s *spooler) Add(ev *transmission.Event) {
+	s.replayMu.Lock()
+	s.replayMu.Unlock()
+	s.add(ev)
+}
+
+func (s *spooler) add(ev *transmission.Event) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.pending[id] = ev
+	s.mu.Unlock()
+
+	ev.Metadata = spoolTag{id: id, metadata: ev.Metadata}
+	s.Sender.Add(ev)
+}
+
+// SetDeadline bounds how long Flush waits for responses, such as by the
+// deadline of the invocation in progress. The zero time removes the deadline.
+func (s *spooler) SetDeadline(deadline time.Time) {
+	if deadline.IsZero() {
+		s.deadline.Store(0)
+		return
+	}
+	s.deadline.Store(deadline.UnixNano())
+}
+
+// Flush flushes the wrapped Sender and waits for the responses to everything
+// it flushed, then spools the events that failed or haven't been answered. If
+// every send succeeded, spooled events are replayed in the background.
+func (s *spooler) Flush() error {
+	s.mu.Lock()
+	mark := s.nextID
+	s.mu.Unlock()
+
+	err := s.Sender.Flush()
+	if !s.awaitResponses(mark) {
+		s.abandonBefore(mark)
+	}
+	s.spillFailed()
+
+	s.mu.Lock()
+	healthy := s.sawSuccess && !s.sawFailure
+	s.lastFlushFailed = s.sawFailure
+	s.sawSuccess, s.sawFailure = false, false
+	s.mu.Unlock()
+	if healthy && s.spool.pending() > 0 {
+		select {
+		case s.replayRequests <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (s *spooler) TxResponses() chan transmission.Response {
+	return s.responses
+}
+
+func (s *spooler) SendResponse(r transmission.Response) bool {
+	select {
+	case s.responses <- r:
+		return false
+	default:
+		return true
+	}
+}
+
+// readResponses resolves the events that responses are for, and passes the
+// responses on with their original metadata.
+func (s *spooler) readResponses() {
+	defer close(s.responses)
+	for r := range s.Sender.TxResponses() {
+		if tag, ok := r.Metadata.(spoolTag); ok {
+			r.Metadata = tag.metadata
+			s.resolve(tag.id, r)
+		}
+		s.SendResponse(r)
+	}
+}
+
+func (s *spooler) resolve(id uint64, r transmission.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ev, ok := s.pending[id]
+	if !ok {
+		return
+	}
+	delete(s.pending, id)
+	switch {
+	case shouldSpool(r):
+		s.failed = append(s.failed, ev)
+		s.sawFailure = true
+	case r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300:
+		s.sawSuccess = true
+	}
+	s.cond.Broadcast()
+}
+
+// shouldSpool reports whether a send failed for a reason that may pass. Other
+// client errors, such as a rejected API key or a malformed event, would only
+// fail again.
+func shouldSpool(r transmission.Response) bool {
+	if r.StatusCode == http.StatusTooManyRequests || r.StatusCode >= 500 {
+		return true
+	}
+	return r.Err != nil && r.StatusCode < 400
+}
+
+// awaitResponses waits for every event added before mark to be resolved, and
+// reports whether they were. It gives up once the response timeout passes, or
+// once there's only minRemaining left before the deadline.
+func (s *spooler) awaitResponses(mark uint64) bool {
+	wait := s.responseTimeout
+	if deadline := s.deadline.Load(); deadline != 0 {
+		wait = min(wait, max(time.Until(time.Unix(0, deadline))-s.minRemaining, 0))
+	}
+	timedOut := false
+	timer := time.AfterFunc(wait, func() {
+		s.mu.Lock()
+		timedOut = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !timedOut && s.pendingBefore(mark) {
+		s.cond.Wait()
+	}
+	return !s.pendingBefore(mark)
+}
+
+// abandonBefore stops waiting for the responses to the events added before
+// mark that are unresolved, and counts them as failed to be spooled. Their
+// responses are ignored should they come back later.
+func (s *spooler) abandonBefore(mark uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ev := range s.pending {
+		if id < mark {
+			delete(s.pending, id)
+			s.failed = append(s.failed, ev)
+			s.sawFailure = true
+		}
+	}
+}
+
+// pendingBefore reports whether any event added before mark is unresolved.
+// The caller must hold s.mu.
+func (s *spooler) pendingBefore(mark uint64) bool {
+	for id := range s.pending {
+		if id < mark {
+			return true
+		}
+	}
+	return false
+}
+
+// spillFailed writes the events that have failed to send to the spool
+func (s *spooler) spillFailed() {
+	s.mu.Lock()
+	failed := s.failed
+	s.failed = nil
+	s.mu.Unlock()
+	if len(failed) == 0 {
+		return
+	}
+
+	events := make([]spooledEvent, len(failed))
+	for i, ev := range failed {
+		events[i] = spooledEvent{
+			APIHost:    ev.APIHost,
+			Dataset:    ev.Dataset,
+			SampleRate: ev.SampleRate,
+			Timestamp:  ev.Timestamp,
+			Data:       ev.Data,
+		}
+	}
+	if err := s.spool.write(events); err != nil {
+		log.Warnf("Unable to spool %d events that failed to send, they will be lost: %v", len(events), err)
+		return
+	}
+	log.Debugf("Spooled %d events that failed to send", len(events))
+}
+
+// replayer replays the spool each time it is asked to, until stopped
+func (s *spooler) replayer() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.replayRequests:
+			s.replay()
+		}
+	}
+}
+
+// replay hands spooled batches to the wrapped Sender, oldest first, until the
+// spool is empty, a send fails, or the spooler is stopped.
+func (s *spooler) replay() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.mu.Lock()
+		failing := s.sawFailure || s.lastFlushFailed
+		s.mu.Unlock()
+		if failing {
+			return
+		}
+		if !s.replayNext() {
+			return
+		}
+	}
+}
+
+// replayNext hands the oldest spooled batch to the wrapped Sender, and reports
+// whether there was one.
+func (s *spooler) replayNext() bool {
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	events, err := s.spool.next()
+	if err != nil {
+		log.Warn("Unable to replay spooled events: ", err)
+		return false
+	}
+	if events == nil {
+		return false
+	}
+	for _, spooled := range events {
+		s.add(&transmission.Event{
+			APIHost:    spooled.APIHost,
+			APIKey:     s.apiKey,
+			Dataset:    spooled.Dataset,
+			SampleRate: spooled.SampleRate,
+			Timestamp:  spooled.Timestamp,
+			Data:       spooled.Data,
+		})
+	}
+	metrics.Add(MetricSpoolEventsReplayed, int64(len(events)))
+	log.Debugf("Replayed %d spooled events", len(events))
+	return true
+}
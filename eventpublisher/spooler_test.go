@@ -0,0 +1,189 @@
+package eventpublisher
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/honeycombio/libhoney-go/transmission"
+	"github.com/stretchr/testify/assert"
+)
+
+// respondingSender answers every event added since the last flush with
+// status when flushed, the way libhoney does once a batch has been sent. While
+// silent, it holds on to them without answering.
+type respondingSender struct {
+	mu        sync.Mutex
+	status    int
+	silent    bool
+	unflushed []*transmission.Event
+	sent      []*transmission.Event
+	responses chan transmission.Response
+}
+
+func (r *respondingSender) Start() error {
+	r.responses = make(chan transmission.Response, 100)
+	return nil
+}
+
+func (r *respondingSender) Stop() error {
+	close(r.responses)
+	return nil
+}
+
+func (r *respondingSender) Add(ev *transmission.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unflushed = append(r.unflushed, ev)
+}
+
+func (r *respondingSender) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.silent {
+		return nil
+	}
+	for _, ev := range r.unflushed {
+		if r.status == http.StatusOK {
+			r.sent = append(r.sent, ev)
+		}
+		r.responses <- transmission.Response{StatusCode: r.status, Metadata: ev.Metadata}
+	}
+	r.unflushed = nil
+	return nil
+}
+
+func (r *respondingSender) TxResponses() chan transmission.Response {
+	return r.responses
+}
+
+func (r *respondingSender) SendResponse(resp transmission.Response) bool {
+	r.responses <- resp
+	return false
+}
+
+func (r *respondingSender) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *respondingSender) counts() (unflushed, sent int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.unflushed), len(r.sent)
+}
+
+func newTestSpooler(t *testing.T) (*spooler, *respondingSender) {
+	sp, err := newSpool(t.TempDir(), 1<<20, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &respondingSender{}
+	s := newSpooler(sender, sp, "test-api-key", time.Second, 100*time.Millisecond)
+	assert.NoError(t, s.Start())
+	t.Cleanup(func() { s.Stop() })
+	return s, sender
+}
+
+func drainResponses(s *spooler, n int) []transmission.Response {
+	responses := make([]transmission.Response, n)
+	for i := range responses {
+		responses[i] = <-s.TxResponses()
+	}
+	return responses
+}
+
+func TestSpoolerSpoolsAndReplaysFailedEvents(t *testing.T) {
+	s, sender := newTestSpooler(t)
+
+	sender.setStatus(http.StatusServiceUnavailable)
+	for i := 0; i < 3; i++ {
+		s.Add(testEvent(i))
+	}
+	assert.NoError(t, s.Flush())
+	responses := drainResponses(s, 3)
+	assert.Equal(t, 0, responses[0].Metadata, "expected the original metadata to be passed on")
+	assert.Equal(t, 3, s.spool.pending(), "expected failed events to be spooled")
+
+	// once sends succeed again, the spool is replayed in the background
+	sender.setStatus(http.StatusOK)
+	s.Add(testEvent(3))
+	assert.NoError(t, s.Flush())
+	drainResponses(s, 1)
+	assert.Eventually(t, func() bool {
+		unflushed, _ := sender.counts()
+		return unflushed == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, s.spool.pending())
+
+	assert.NoError(t, s.Flush())
+	drainResponses(s, 3)
+	_, sent := sender.counts()
+	assert.Equal(t, 4, sent)
+	replayed := sender.sent[1]
+	assert.Equal(t, "test-api-key", replayed.APIKey)
+	assert.Equal(t, float64(0), replayed.Data["n"])
+}
+
+func TestSpoolerStopsWaitingAheadOfTheDeadline(t *testing.T) {
+	s, sender := newTestSpooler(t)
+
+	// the sender doesn't answer, as with a send stuck on a slow network
+	sender.mu.Lock()
+	sender.silent = true
+	sender.mu.Unlock()
+	s.Add(testEvent(0))
+	s.SetDeadline(time.Now().Add(150 * time.Millisecond))
+	start := time.Now()
+	assert.NoError(t, s.Flush())
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "expected the flush to stop waiting minRemaining before the deadline")
+	assert.Equal(t, 1, s.spool.pending(), "expected the unanswered event to be spooled")
+
+	// a late response to the spooled event is still passed on, and the event
+	// is replayed once sends succeed
+	sender.mu.Lock()
+	sender.silent = false
+	sender.status = http.StatusOK
+	sender.mu.Unlock()
+	s.SetDeadline(time.Time{})
+	s.Add(testEvent(1))
+	assert.NoError(t, s.Flush())
+	drainResponses(s, 2)
+	assert.Eventually(t, func() bool {
+		unflushed, _ := sender.counts()
+		return unflushed == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, s.spool.pending())
+}
+
+func TestSpoolerDoesNotSpoolClientErrors(t *testing.T) {
+	s, sender := newTestSpooler(t)
+
+	sender.setStatus(http.StatusBadRequest)
+	s.Add(testEvent(0))
+	assert.NoError(t, s.Flush())
+	drainResponses(s, 1)
+	assert.Equal(t, 0, s.spool.pending())
+}
+
+func TestShouldSpool(t *testing.T) {
+	testCases := map[string]struct {
+		response transmission.Response
+		expected bool
+	}{
+		"success":      {response: transmission.Response{StatusCode: 200}, expected: false},
+		"timeout":      {response: transmission.Response{Err: errors.New("timeout")}, expected: true},
+		"rate limited": {response: transmission.Response{StatusCode: 429}, expected: true},
+		"server error": {response: transmission.Response{StatusCode: 502}, expected: true},
+		"bad request":  {response: transmission.Response{StatusCode: 400}, expected: false},
+		"bad api key":  {response: transmission.Response{StatusCode: 401}, expected: false},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, shouldSpool(tc.response))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -35,8 +36,71 @@ const (
 	extensionNameHeader = "Lambda-Extension-Name"
 	// extensionIdentifierHeader is a uuid that is required on subsequent requests
 	extensionIdentifierHeader = "Lambda-Extension-Identifier"
+	// extensionErrorTypeHeader carries the error type when reporting errors
+	extensionErrorTypeHeader = "Lambda-Extension-Function-Error-Type"
 )
 
+// ErrorKind classifies a failed request to the Extensions API
+type ErrorKind string
+
+const (
+	// ErrorKindNetwork means no response was received from the Extensions API
+	ErrorKindNetwork ErrorKind = "network"
+	// ErrorKindServer means the Extensions API responded with a 5xx or 429 status
+	ErrorKindServer ErrorKind = "server"
+	// ErrorKindClient means the Extensions API rejected the request with a 4xx
+	// status, such as an unknown extension identifier. Retrying will not help.
+	ErrorKindClient ErrorKind = "client"
+	// ErrorKindResponse means the response could not be read or decoded
+	ErrorKindResponse ErrorKind = "response"
+)
+
+// APIError is returned when a request to the Extensions API fails
+type APIError struct {
+	Kind       ErrorKind
+	StatusCode int // zero if no response was received
+	Err        error
+}
+
+func (e *APIError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("extensions API %s error (status %d): %v", e.Kind, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("extensions API %s error: %v", e.Kind, e.Err)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the request that failed may succeed if retried
+func (e *APIError) Retryable() bool {
+	return e.Kind != ErrorKindClient
+}
+
+// IsRetryable reports whether err is worth retrying. Errors that have not been
+// classified as an APIError are assumed to be transient.
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return true
+}
+
+// newStatusError classifies a non-successful HTTP response
+func newStatusError(res *http.Response) *APIError {
+	kind := ErrorKindClient
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests {
+		kind = ErrorKindServer
+	}
+	return &APIError{
+		Kind:       kind,
+		StatusCode: res.StatusCode,
+		Err:        fmt.Errorf("request failed with status %s", res.Status),
+	}
+}
+
 var (
 	// set up logging defaults for our own logging output
 	log = logrus.WithFields(logrus.Fields{
@@ -138,6 +202,8 @@ func (c *Client) Register(ctx context.Context, managedInstances bool) (*Register
 // NextEvent blocks while long polling for the next lambda invoke or shutdown
 // By default, the Go HTTP client has no timeout, and in this case this is actually
 // the desired behavior to enable long polling of the Extensions API.
+//
+// Failures are returned as an *APIError so callers can decide whether to retry.
 func (c *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) {
 	httpReq, err := http.NewRequestWithContext(ctx, "GET", c.url("/event/next"), nil)
 	if err != nil {
@@ -146,24 +212,75 @@ func (c *Client) NextEvent(ctx context.Context) (*NextEventResponse, error) {
 	httpReq.Header.Set(extensionIdentifierHeader, c.ExtensionID)
 	httpRes, err := c.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, err
+		return nil, &APIError{Kind: ErrorKindNetwork, Err: err}
 	}
 	defer httpRes.Body.Close()
 	if httpRes.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed with status %s", httpRes.Status)
+		return nil, newStatusError(httpRes)
 	}
 	body, err := ioutil.ReadAll(httpRes.Body)
 	if err != nil {
-		return nil, err
+		return nil, &APIError{Kind: ErrorKindResponse, StatusCode: httpRes.StatusCode, Err: err}
 	}
 	res := NextEventResponse{}
 	err = json.Unmarshal(body, &res)
 	if err != nil {
-		return nil, err
+		return nil, &APIError{Kind: ErrorKindResponse, StatusCode: httpRes.StatusCode, Err: err}
 	}
 	return &res, nil
 }
 
+// ErrorResponse is the body sent when reporting an error to the Extensions API
+type ErrorResponse struct {
+	ErrorMessage string   `json:"errorMessage"`
+	ErrorType    string   `json:"errorType"`
+	StackTrace   []string `json:"stackTrace"`
+}
+
+// InitError reports to the Extensions API that the extension failed to
+// initialize because of err. errorType should be of the form "Extension.Reason".
+// Lambda will fail the function's init phase and surface the error type, after
+// which the extension should exit.
+func (c *Client) InitError(ctx context.Context, errorType string, err error) error {
+	return c.reportError(ctx, "/init/error", errorType, err)
+}
+
+// ExitError reports to the Extensions API that the extension is about to exit
+// because of err. errorType should be of the form "Extension.Reason". After
+// reporting, the extension should exit; Lambda will reset the execution
+// environment.
+func (c *Client) ExitError(ctx context.Context, errorType string, err error) error {
+	return c.reportError(ctx, "/exit/error", errorType, err)
+}
+
+// reportError posts an ErrorResponse for err to one of the Extensions API
+// error endpoints.
+func (c *Client) reportError(ctx context.Context, requestPath string, errorType string, err error) error {
+	reqBody, marshalErr := json.Marshal(ErrorResponse{
+		ErrorMessage: err.Error(),
+		ErrorType:    errorType,
+		StackTrace:   []string{},
+	})
+	if marshalErr != nil {
+		return marshalErr
+	}
+	httpReq, reqErr := http.NewRequestWithContext(ctx, "POST", c.url(requestPath), bytes.NewBuffer(reqBody))
+	if reqErr != nil {
+		return reqErr
+	}
+	httpReq.Header.Set(extensionIdentifierHeader, c.ExtensionID)
+	httpReq.Header.Set(extensionErrorTypeHeader, errorType)
+	httpRes, doErr := c.httpClient.Do(httpReq)
+	if doErr != nil {
+		return &APIError{Kind: ErrorKindNetwork, Err: doErr}
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusAccepted && httpRes.StatusCode != http.StatusOK {
+		return newStatusError(httpRes)
+	}
+	return nil
+}
+
 // url is a helper function to build urls out of relative paths
 func (c *Client) url(requestPath string) string {
 	newURL, err := url.Parse(c.baseURL)
@@ -3,6 +3,7 @@ package extension
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -212,3 +213,108 @@ func TestURL(t *testing.T) {
 	assert.Equal(t, "https://mywebsite.com:9000/2020-01-01/extension", client.baseURL)
 	assert.Equal(t, "https://mywebsite.com:9000/2020-01-01/extension/foo/bar", client.url("foo/bar"))
 }
+
+func TestNextEventErrorClassification(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		statusCode    int
+		body          string
+		expectedKind  ErrorKind
+		expectedRetry bool
+	}{
+		{desc: "server error", statusCode: http.StatusInternalServerError, expectedKind: ErrorKindServer, expectedRetry: true},
+		{desc: "throttled", statusCode: http.StatusTooManyRequests, expectedKind: ErrorKindServer, expectedRetry: true},
+		{desc: "forbidden", statusCode: http.StatusForbidden, expectedKind: ErrorKindClient, expectedRetry: false},
+		{desc: "malformed body", statusCode: http.StatusOK, body: "{not json", expectedKind: ErrorKindResponse, expectedRetry: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tC.statusCode)
+				w.Write([]byte(tC.body))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, testName)
+			_, err := client.NextEvent(context.TODO())
+
+			var apiErr *APIError
+			if assert.ErrorAs(t, err, &apiErr) {
+				assert.Equal(t, tC.expectedKind, apiErr.Kind)
+			}
+			assert.Equal(t, tC.expectedRetry, IsRetryable(err))
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		client := NewClient(server.URL, testName)
+		_, err := client.NextEvent(context.TODO())
+
+		var apiErr *APIError
+		if assert.ErrorAs(t, err, &apiErr) {
+			assert.Equal(t, ErrorKindNetwork, apiErr.Kind)
+		}
+		assert.True(t, IsRetryable(err))
+	})
+}
+
+func TestExitError(t *testing.T) {
+	var received ErrorResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2020-01-01/extension/exit/error", r.URL.Path)
+		assert.Equal(t, testIdentifier, r.Header.Get(extensionIdentifierHeader))
+		assert.Equal(t, "Extension.TestFailure", r.Header.Get(extensionErrorTypeHeader))
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, testName)
+	client.ExtensionID = testIdentifier
+	err := client.ExitError(context.TODO(), "Extension.TestFailure", errors.New("something broke"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "something broke", received.ErrorMessage)
+	assert.Equal(t, "Extension.TestFailure", received.ErrorType)
+}
+
+func TestInitError(t *testing.T) {
+	var received ErrorResponse
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/2020-01-01/extension/init/error", r.URL.Path)
+		assert.Equal(t, testIdentifier, r.Header.Get(extensionIdentifierHeader))
+		assert.Equal(t, ErrorTypeMissingAPIKey, r.Header.Get(extensionErrorTypeHeader))
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, testName)
+	client.ExtensionID = testIdentifier
+	err := client.InitError(context.TODO(), ErrorTypeMissingAPIKey, errors.New("LIBHONEY_API_KEY is not set"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "LIBHONEY_API_KEY is not set", received.ErrorMessage)
+	assert.Equal(t, ErrorTypeMissingAPIKey, received.ErrorType)
+	assert.Equal(t, []string{}, received.StackTrace)
+}
+
+func TestReportErrorRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL, testName)
+	err := client.InitError(context.TODO(), ErrorTypeMissingAPIKey, errors.New("no key"))
+
+	var apiErr *APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	}
+}
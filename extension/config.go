@@ -1,14 +1,14 @@
 package extension
 
 import (
-	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/kms"
 )
 
 const (
@@ -26,17 +26,175 @@ const (
 	// to be established in this time.
 	defaultConnectTimeout = time.Second * 3
 
+	// On Lambda Managed Instances there is no INVOKE event to flush on, so
+	// events are flushed on a timer or once enough bytes have been received.
+	defaultFlushInterval = time.Second * 1
+	defaultFlushMaxBytes = 524288
+
+	// After an INVOKE, the extension waits up to this long for the Telemetry API
+	// to deliver the invocation's platform.runtimeDone, so the invocation's events
+	// can be flushed before the sandbox is frozen.
+	defaultPostInvokeTimeout = time.Second * 2
+
+	// With the async flush strategy, flush in the background after this many
+	// invocations, and synchronously when an invocation has less than
+	// defaultFlushMinRemaining left before its deadline.
+	defaultFlushEveryInvocations = 10
+	defaultFlushMinRemaining     = time.Millisecond * 500
+
+	// The ingestion queue between the receiver and libhoney is sized at
+	// 1/queueMemoryFraction of the function's memory, within these bounds.
+	// defaultFunctionMemoryMB is assumed when AWS_LAMBDA_FUNCTION_MEMORY_SIZE
+	// is missing or unparseable.
+	queueMemoryFraction     = 16
+	minQueueMaxBytes        = 1 << 20
+	maxQueueMaxBytes        = 64 << 20
+	defaultFunctionMemoryMB = 128
+
+	// Batches that fail to send are spooled to disk under defaultSpoolDir, up
+	// to defaultSpoolMaxBytes, and discarded once older than defaultSpoolMaxAge.
+	defaultSpoolDir      = "/tmp/honeycomb-lambda-extension/spool"
+	defaultSpoolMaxBytes = 64 << 20
+	defaultSpoolMaxAge   = time.Hour
+
+	// Failed batch sends are retried up to defaultRetryMaxAttempts times in
+	// all, backing off exponentially from defaultRetryInitialBackoff to
+	// defaultRetryMaxBackoff, with up to defaultRetryJitter of each backoff
+	// taken off at random. Retrying a batch stops once defaultRetryBudget has
+	// been spent on it.
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = time.Millisecond * 100
+	defaultRetryMaxBackoff     = time.Second * 2
+	defaultRetryJitter         = 0.5
+	defaultRetryBudget         = time.Second * 5
+
+	// The circuit breaker opens after defaultCircuitBreakerThreshold batch
+	// sends in a row fail, and stays open for defaultCircuitBreakerCooldown
+	// before a send is let through to probe whether Honeycomb is back.
+	defaultCircuitBreakerThreshold = 5
+	defaultCircuitBreakerCooldown  = time.Second * 30
+
+	// The otlp backend exports to Honeycomb's OTLP endpoint by default
+	defaultOTLPEndpoint = "https://api.honeycomb.io"
+
+	// Syslog messages are written in batches of up to defaultSyslogBatchSize,
+	// with fields in a structured data element named
+	// defaultSyslogStructuredDataID. 32473 is the private enterprise number
+	// set aside for examples, so receivers can tell these elements apart.
+	defaultSyslogBatchSize        = 100
+	defaultSyslogStructuredDataID = "lambda@32473"
+
 	// AWS_LAMBDA_INITIALIZATION_TYPE is "lambda-managed-instances" on LMI, vs.
 	// "on-demand"/"provisioned-concurrency"/"snap-start" for Lambda (default).
 	initializationTypeManagedInstances = "lambda-managed-instances"
 )
 
+// FlushStrategy decides when buffered events are flushed to Honeycomb
+type FlushStrategy string
+
+const (
+	// FlushStrategySync flushes at the end of every invocation, before polling
+	// for the next event.
+	FlushStrategySync FlushStrategy = "sync"
+	// FlushStrategyAsync flushes in the background every FlushEveryInvocations
+	// invocations, every FlushInterval, or once FlushMaxBytes are pending, so
+	// the extension never delays polling for the next event on HTTP.
+	FlushStrategyAsync FlushStrategy = "async"
+)
+
+// QueuePolicy decides what happens to an event that doesn't fit in the
+// ingestion queue
+type QueuePolicy string
+
+const (
+	// QueuePolicyBlock makes the receiver wait for room in the queue, and
+	// refuse new batches with a 503 while the queue is full.
+	QueuePolicyBlock QueuePolicy = "block"
+	// QueuePolicyDropNewest drops events that don't fit, and refuses new
+	// batches with a 503 while the queue is full.
+	QueuePolicyDropNewest QueuePolicy = "drop-newest"
+	// QueuePolicyDropOldest makes room by dropping the oldest queued events,
+	// so new batches are always accepted.
+	QueuePolicyDropOldest QueuePolicy = "drop-oldest"
+)
+
+// Backend decides where events are published
+type Backend string
+
+const (
+	// BackendHoneycomb sends events to Honeycomb's Events API with libhoney.
+	BackendHoneycomb Backend = "honeycomb"
+	// BackendJSONLines writes every event as a line of JSON to
+	// BackendFile, or to stdout, for debugging locally.
+	BackendJSONLines Backend = "jsonlines"
+	// BackendOTLP exports events over OTLP/HTTP to OTLPEndpoint, which may be
+	// Honeycomb's OTLP endpoint or any OpenTelemetry collector.
+	BackendOTLP Backend = "otlp"
+	// BackendSyslog forwards events to SyslogAddress as RFC5424 syslog
+	// messages, and nowhere else.
+	BackendSyslog Backend = "syslog"
+)
+
+// APIKeySource is where the API key is found
+type APIKeySource string
+
+const (
+	// APIKeySourceEnvironment is LIBHONEY_API_KEY, in plaintext.
+	APIKeySourceEnvironment APIKeySource = "environment"
+	// APIKeySourceKMS is LIBHONEY_API_KEY, as ciphertext decrypted with KMS.
+	APIKeySourceKMS APIKeySource = "kms"
+	// APIKeySourceSecretsManager is the secret in HONEYCOMB_API_KEY_SECRET_ARN.
+	APIKeySourceSecretsManager APIKeySource = "secretsmanager"
+	// APIKeySourceSSM is the parameter in HONEYCOMB_API_KEY_SSM_PARAMETER.
+	APIKeySourceSSM APIKeySource = "ssm"
+)
+
+// Destination is a Honeycomb team and dataset that events are sent to, in
+// addition to the one set by LIBHONEY_API_KEY and LIBHONEY_DATASET. Filter,
+// if not empty, limits the events sent to the destination to those with every
+// field in the filter set to one of the listed values.
+type Destination struct {
+	Name    string              `json:"name" yaml:"name"`
+	APIKey  string              `json:"apiKey" yaml:"apiKey"`
+	APIHost string              `json:"apiHost" yaml:"apiHost"`
+	Dataset string              `json:"dataset" yaml:"dataset"`
+	Filter  map[string][]string `json:"filter" yaml:"filter"`
+}
+
+// Error types reported to the Extensions API when the extension can't be
+// initialized as configured.
+const (
+	ErrorTypeMissingAPIKey      = "Extension.MissingAPIKey"
+	ErrorTypeInvalidAPIKey      = "Extension.InvalidAPIKeyCiphertext"
+	ErrorTypeAPIKeyDecryption   = "Extension.APIKeyDecryptionFailed"
+	ErrorTypeAPIKeyAccessDenied = "Extension.APIKeyAccessDenied"
+	ErrorTypeAPIKeyRejected     = "Extension.APIKeyRejected"
+	ErrorTypeAPIKeyFetch        = "Extension.APIKeyFetchFailed"
+	ErrorTypeSubscribeFailed    = "Extension.TelemetrySubscribeFailed"
+)
+
+// ConfigError is a configuration problem that leaves the extension unable to
+// send events. Type is suitable for reporting to the Extensions API.
+type ConfigError struct {
+	Type string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
 type Config struct {
-	APIKey     string // Honeycomb API key
-	Dataset    string // target dataset at Honeycomb to receive events
-	APIHost    string // Honeycomb API URL to which to send events
-	Debug      bool   // Enable debug log output from the extension
-	RuntimeAPI string // Set by AWS in extension environment. Expected to be hostname:port.
+	APIKey       string       // Honeycomb API key
+	APIKeySource APIKeySource // where APIKey was found, and fetched again from by RefreshAPIKey
+	Dataset      string       // target dataset at Honeycomb to receive events
+	APIHost      string       // Honeycomb API URL to which to send events
+	Debug        bool         // Enable debug log output from the extension
+	RuntimeAPI   string       // Set by AWS in extension environment. Expected to be hostname:port.
 	// IsManagedInstances is true on Lambda Managed Instances, which only allows
 	// extensions to register for the SHUTDOWN event (not INVOKE) because a single
 	// execution environment handles concurrent invocations.
@@ -55,26 +213,271 @@ type Config struct {
 	// is critical to help reduce impact caused by connectivity issues as it allows us to
 	// fail fast and not have to wait for the much longer HTTP client timeout to occur.
 	ConnectTimeout time.Duration
+
+	// How often to flush events when there is no INVOKE event to flush on, as
+	// is the case on Lambda Managed Instances.
+	FlushInterval time.Duration
+
+	// Flush early, ahead of FlushInterval, once this many bytes of telemetry
+	// have been received since the last flush.
+	FlushMaxBytes int
+
+	// The longest the extension will wait after an INVOKE for the invocation's
+	// telemetry to be delivered before flushing and polling for the next event.
+	// Zero disables waiting.
+	PostInvokeTimeout time.Duration
+
+	// FlushStrategy chooses between flushing synchronously at the end of every
+	// invocation and flushing in the background. Sync is the default.
+	FlushStrategy FlushStrategy
+
+	// With the async flush strategy, flush after this many invocations.
+	FlushEveryInvocations int
+
+	// With the async flush strategy, flush synchronously when an invocation has
+	// less than this long left before its deadline. Zero never flushes
+	// synchronously ahead of a deadline.
+	FlushMinRemaining time.Duration
+
+	// QueueMaxBytes bounds the estimated size of events waiting to be handed
+	// to libhoney. It defaults to a fraction of the function's memory.
+	QueueMaxBytes int
+
+	// QueuePolicy chooses what to do with events that don't fit in the queue.
+	// Block is the default.
+	QueuePolicy QueuePolicy
+
+	// SpoolEnabled turns on spooling events that fail to send to SpoolDir, to
+	// be replayed once sending succeeds again.
+	SpoolEnabled bool
+	SpoolDir     string
+
+	// The spool is bounded by SpoolMaxBytes on disk, evicting the oldest
+	// batches first, and by SpoolMaxAge, after which batches are discarded.
+	SpoolMaxBytes int
+	SpoolMaxAge   time.Duration
+
+	// SpoolCompress gzips spooled batches.
+	SpoolCompress bool
+
+	// RetryMaxAttempts is the most times a batch is sent before giving up on
+	// a 429, a 5xx or a network error. 1 leaves retries to libhoney.
+	RetryMaxAttempts int
+
+	// Retries back off exponentially from RetryInitialBackoff up to
+	// RetryMaxBackoff, less a random fraction of up to RetryJitter, unless
+	// Honeycomb asks for a different wait with Retry-After.
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryJitter         float64
+
+	// RetryBudget bounds the time spent sending a batch, retries included. No
+	// retry is made that would run past the budget or the invocation deadline.
+	RetryBudget time.Duration
+
+	// CircuitBreakerThreshold is the number of batch sends in a row that may
+	// fail with a 5xx or a network error before the circuit breaker opens.
+	// While it is open, batches fail at once without a request being made,
+	// and are spooled or dropped. 0 disables the circuit breaker.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown is how long the circuit breaker stays open
+	// before letting a single batch send through as a probe.
+	CircuitBreakerCooldown time.Duration
+
+	// SelfTelemetryEnabled sends events describing the extension itself, such
+	// as the events it has received, sent and dropped, alongside the
+	// function's telemetry.
+	SelfTelemetryEnabled bool
+
+	// SelfTelemetryDataset is the dataset self-telemetry events are sent to.
+	// Empty means the same dataset as the function's telemetry.
+	SelfTelemetryDataset string
+
+	// SelfTelemetryInterval is the least time between self-telemetry events.
+	// 0 sends one with every flush, which is once per invocation with the sync
+	// flush strategy.
+	SelfTelemetryInterval time.Duration
+
+	// ExitOnAuthFailure makes the extension report an exit error through the
+	// Extensions API and exit once Honeycomb persistently rejects the API key,
+	// instead of carrying on without sending anything.
+	ExitOnAuthFailure bool
+
+	// Backend chooses where events are published. Honeycomb is the default.
+	Backend Backend
+
+	// BackendFile is the file the jsonlines backend appends events to. Empty
+	// means stdout.
+	BackendFile string
+
+	// OTLPEndpoint is the base URL the otlp backend exports to, with logs
+	// sent to /v1/logs and spans to /v1/traces.
+	OTLPEndpoint string
+
+	// OTLPHeaders are sent with every OTLP export, after the
+	// x-honeycomb-team and x-honeycomb-dataset headers set from APIKey and
+	// Dataset, so they can override them or add other authentication.
+	OTLPHeaders map[string]string
+
+	// SyslogAddress is the host:port of a syslog receiver, such as a SIEM,
+	// that every event is forwarded to as an RFC5424 message, in addition to
+	// the backend. Empty disables forwarding, unless Backend is syslog.
+	SyslogAddress string
+
+	// SyslogTLS connects to SyslogAddress over TLS, verified against the
+	// system's roots or the PEM certificates in SyslogCAFile if set.
+	SyslogTLS    bool
+	SyslogCAFile string
+
+	// SyslogBatchSize is the most messages held before they are written to
+	// the syslog receiver without waiting for a flush.
+	SyslogBatchSize int
+
+	// SyslogStructuredDataID is the SD-ID of the structured data element
+	// carrying each event's fields.
+	SyslogStructuredDataID string
+
+	// Destinations are further Honeycomb destinations that every event, or
+	// every event matching the destination's filter, is also sent to. Each
+	// is batched, flushed, retried and spooled independently.
+	Destinations []Destination
+
+	// FailOnInitError makes misconfiguration, such as a missing API key or a
+	// failed telemetry subscription, fail the function's init phase through the
+	// Extensions API instead of leaving the extension running but disabled.
+	FailOnInitError bool
+
+	// ValidateAPIKey checks the API key with Honeycomb at init, recording the
+	// outcome on the platform.initReport event. A rejected key fails init if
+	// FailOnInitError is set. It's on unless turned off.
+	ValidateAPIKey bool
+
+	// StrictConfig makes problems found by Validate fail the function's init
+	// phase through the Extensions API, instead of being logged and replaced
+	// by defaults.
+	StrictConfig bool
+
+	// ConfigFile is the path of the config file settings were loaded from,
+	// or empty if there wasn't one. Environment variables take precedence
+	// over its settings.
+	ConfigFile string
+
+	// apiKeyErr holds the reason APIKey couldn't be determined, if any
+	apiKeyErr error
+
+	// configFileErr describes the settings in ConfigFile that aren't valid
+	configFileErr error
+
+	// loader is what the config was loaded with, which holds the settings
+	// from ConfigFile and the settings that couldn't be used
+	loader *configLoader
+}
+
+// APIKeyError returns a *ConfigError describing why APIKey could not be
+// determined from the environment, or nil if it was.
+func (c Config) APIKeyError() error {
+	return c.apiKeyErr
+}
+
+// ConfigFileError returns a *ConfigError describing the settings in
+// ConfigFile that couldn't be read or aren't valid, or nil if there were none.
+// Those settings are left at their defaults.
+func (c Config) ConfigFileError() error {
+	return c.configFileErr
 }
 
 // Returns a new Honeycomb extension config with values populated
-// from environment variables.
+// from environment variables, and from the config file, if there is one,
+// for those that aren't set.
 func NewConfigFromEnvironment() Config {
+	configFile, settings, configFileErr := loadConfigFile()
+	if configFileErr != nil {
+		log.Errorf("Ignoring invalid settings in config file: %v", configFileErr)
+	} else if configFile != "" {
+		log.Infof("Loaded settings from config file %s", configFile)
+	}
+	l := &configLoader{fileSettings: settings}
+
+	destinations := l.destinationsFromEnv("HONEYCOMB_DESTINATIONS")
+	apiKey, apiKeyErr := l.getApiKey()
+	var configErr *ConfigError
+	if errors.As(apiKeyErr, &configErr) && configErr.Type == ErrorTypeMissingAPIKey {
+		if len(destinations) > 0 {
+			// every destination brings its own key, so events still have
+			// somewhere to go
+			log.Info("LIBHONEY_API_KEY is not set, sending events to HONEYCOMB_DESTINATIONS only")
+			apiKeyErr = nil
+		} else {
+			log.Error("LIBHONEY_API_KEY is not set. Please set it to your Honeycomb API key, or fetch it with HONEYCOMB_API_KEY_SECRET_ARN or HONEYCOMB_API_KEY_SSM_PARAMETER.")
+		}
+	}
 	return Config{
-		APIKey:                         getApiKey(),
-		Dataset:                        os.Getenv("LIBHONEY_DATASET"),
-		APIHost:                        os.Getenv("LIBHONEY_API_HOST"),
-		Debug:                          envOrElseBool("HONEYCOMB_DEBUG", false),
+		APIKey:                         apiKey,
+		APIKeySource:                   l.apiKeySourceFromEnv(),
+		Dataset:                        l.getenv("LIBHONEY_DATASET"),
+		APIHost:                        l.getenv("LIBHONEY_API_HOST"),
+		Debug:                          l.envOrElseBool("HONEYCOMB_DEBUG", false),
 		RuntimeAPI:                     os.Getenv("AWS_LAMBDA_RUNTIME_API"),
 		IsManagedInstances:             os.Getenv("AWS_LAMBDA_INITIALIZATION_TYPE") == initializationTypeManagedInstances,
 		LogsReceiverPort:               3000, // a constant for now
-		LogsAPITimeoutMS:               envOrElseInt("LOGS_API_TIMEOUT_MS", defaultTimeoutMS),
-		LogsAPIMaxBytes:                envOrElseInt("LOGS_API_MAX_BYTES", defaultMaxBytes),
-		LogsAPIMaxItems:                envOrElseInt("LOGS_API_MAX_ITEMS", defaultMaxItems),
-		LogsAPIDisablePlatformMessages: envOrElseBool("LOGS_API_DISABLE_PLATFORM_MSGS", false),
-		BatchSendTimeout:               envOrElseDuration("HONEYCOMB_BATCH_SEND_TIMEOUT", defaultBatchSendTimeout),
-		ConnectTimeout:                 envOrElseDuration("HONEYCOMB_CONNECT_TIMEOUT", defaultConnectTimeout),
+		LogsAPITimeoutMS:               l.envOrElseInt("LOGS_API_TIMEOUT_MS", defaultTimeoutMS),
+		LogsAPIMaxBytes:                l.envOrElseInt("LOGS_API_MAX_BYTES", defaultMaxBytes),
+		LogsAPIMaxItems:                l.envOrElseInt("LOGS_API_MAX_ITEMS", defaultMaxItems),
+		LogsAPIDisablePlatformMessages: l.envOrElseBool("LOGS_API_DISABLE_PLATFORM_MSGS", false),
+		BatchSendTimeout:               l.envOrElseDuration("HONEYCOMB_BATCH_SEND_TIMEOUT", defaultBatchSendTimeout),
+		ConnectTimeout:                 l.envOrElseDuration("HONEYCOMB_CONNECT_TIMEOUT", defaultConnectTimeout),
+		FlushInterval:                  l.envOrElseDuration("HONEYCOMB_FLUSH_INTERVAL", defaultFlushInterval),
+		FlushMaxBytes:                  l.envOrElseInt("HONEYCOMB_FLUSH_MAX_BYTES", defaultFlushMaxBytes),
+		PostInvokeTimeout:              l.envOrElseDurationOrZero("HONEYCOMB_POST_INVOKE_TIMEOUT", defaultPostInvokeTimeout),
+		FlushStrategy:                  l.flushStrategyFromEnv("HONEYCOMB_FLUSH_STRATEGY"),
+		FlushEveryInvocations:          l.envOrElseInt("HONEYCOMB_FLUSH_EVERY_INVOCATIONS", defaultFlushEveryInvocations),
+		FlushMinRemaining:              l.envOrElseDurationOrZero("HONEYCOMB_FLUSH_MIN_REMAINING", defaultFlushMinRemaining),
+		QueueMaxBytes:                  l.envOrElseInt("HONEYCOMB_QUEUE_MAX_BYTES", queueMaxBytesForMemory(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"))),
+		QueuePolicy:                    l.queuePolicyFromEnv("HONEYCOMB_QUEUE_POLICY"),
+		SpoolEnabled:                   l.envOrElseBool("HONEYCOMB_SPOOL_ENABLED", false),
+		SpoolDir:                       l.envOrElse("HONEYCOMB_SPOOL_DIR", defaultSpoolDir),
+		SpoolMaxBytes:                  l.envOrElseInt("HONEYCOMB_SPOOL_MAX_BYTES", defaultSpoolMaxBytes),
+		SpoolMaxAge:                    l.envOrElseDuration("HONEYCOMB_SPOOL_MAX_AGE", defaultSpoolMaxAge),
+		SpoolCompress:                  l.envOrElseBool("HONEYCOMB_SPOOL_COMPRESS", true),
+		RetryMaxAttempts:               l.envOrElseInt("HONEYCOMB_RETRY_MAX_ATTEMPTS", defaultRetryMaxAttempts),
+		RetryInitialBackoff:            l.envOrElseDuration("HONEYCOMB_RETRY_INITIAL_BACKOFF", defaultRetryInitialBackoff),
+		RetryMaxBackoff:                l.envOrElseDuration("HONEYCOMB_RETRY_MAX_BACKOFF", defaultRetryMaxBackoff),
+		RetryJitter:                    l.envOrElseFloat("HONEYCOMB_RETRY_JITTER", defaultRetryJitter),
+		RetryBudget:                    l.envOrElseDuration("HONEYCOMB_RETRY_BUDGET", defaultRetryBudget),
+		CircuitBreakerThreshold:        l.envOrElseInt("HONEYCOMB_CIRCUIT_BREAKER_THRESHOLD", defaultCircuitBreakerThreshold),
+		CircuitBreakerCooldown:         l.envOrElseDuration("HONEYCOMB_CIRCUIT_BREAKER_COOLDOWN", defaultCircuitBreakerCooldown),
+		SelfTelemetryEnabled:           l.envOrElseBool("HONEYCOMB_SELF_TELEMETRY_ENABLED", false),
+		SelfTelemetryDataset:           l.getenv("HONEYCOMB_SELF_TELEMETRY_DATASET"),
+		SelfTelemetryInterval:          l.envOrElseDuration("HONEYCOMB_SELF_TELEMETRY_INTERVAL", 0),
+		ExitOnAuthFailure:              l.envOrElseBool("HONEYCOMB_EXIT_ON_AUTH_FAILURE", false),
+		Destinations:                   destinations,
+		Backend:                        l.backendFromEnv("HONEYCOMB_BACKEND"),
+		BackendFile:                    l.getenv("HONEYCOMB_BACKEND_FILE"),
+		OTLPEndpoint:                   l.envOrElse("HONEYCOMB_OTLP_ENDPOINT", defaultOTLPEndpoint),
+		OTLPHeaders:                    l.headersFromEnv("HONEYCOMB_OTLP_HEADERS"),
+		SyslogAddress:                  l.getenv("HONEYCOMB_SYSLOG_ADDRESS"),
+		SyslogTLS:                      l.envOrElseBool("HONEYCOMB_SYSLOG_TLS", true),
+		SyslogCAFile:                   l.getenv("HONEYCOMB_SYSLOG_CA_FILE"),
+		SyslogBatchSize:                l.envOrElseInt("HONEYCOMB_SYSLOG_BATCH_SIZE", defaultSyslogBatchSize),
+		SyslogStructuredDataID:         l.envOrElse("HONEYCOMB_SYSLOG_SD_ID", defaultSyslogStructuredDataID),
+		FailOnInitError:                l.envOrElseBool("HONEYCOMB_FAIL_ON_INIT_ERROR", false),
+		ValidateAPIKey:                 l.envOrElseBool("HONEYCOMB_VALIDATE_API_KEY", true),
+		StrictConfig:                   l.envOrElseBool("HONEYCOMB_STRICT_CONFIG", false),
+		ConfigFile:                     configFile,
+		apiKeyErr:                      apiKeyErr,
+		configFileErr:                  configFileErr,
+		loader:                         l,
+	}
+}
+
+// envOrElse retrieves an environment variable value by the given key,
+// returning the given fallback string if it is unset or empty.
+func (l *configLoader) envOrElse(key string, fallback string) string {
+	if value := l.getenv(key); value != "" {
+		return value
 	}
+	return fallback
 }
 
 // envOrElseInt retrieves an environment variable value by the given key,
@@ -82,11 +485,55 @@ func NewConfigFromEnvironment() Config {
 //
 // If env var cannot be found by the key or value fails to cast to an int,
 // return the given fallback integer.
-func envOrElseInt(key string, fallback int) int {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) envOrElseInt(key string, fallback int) int {
+	if value, ok := l.lookupEnv(key); ok {
 		v, err := strconv.Atoi(value)
 		if err != nil {
-			log.Warnf("%s was set to '%s', but failed to parse to an integer. Falling back to default of %d.", key, value, fallback)
+			l.warnInvalidSetting("%s was set to '%s', but failed to parse to an integer. Falling back to default of %d.", key, value, fallback)
+			return fallback
+		}
+		return v
+	}
+	return fallback
+}
+
+// destinationsFromEnv parses the JSON array of destinations in the given
+// environment variable. Destinations without an API key or a dataset are
+// skipped, and nothing is returned if the value can't be parsed.
+func (l *configLoader) destinationsFromEnv(key string) []Destination {
+	value := l.getenv(key)
+	if value == "" {
+		return nil
+	}
+	var parsed []Destination
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		l.warnInvalidSetting("%s could not be parsed as a JSON array of destinations, ignoring it: %v", key, err)
+		return nil
+	}
+	var destinations []Destination
+	for i, destination := range parsed {
+		if destination.APIKey == "" || destination.Dataset == "" {
+			l.warnInvalidSetting("Destination %d in %s has no apiKey or dataset, ignoring it", i, key)
+			continue
+		}
+		if destination.Name == "" {
+			destination.Name = fmt.Sprintf("destination-%d", i+1)
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations
+}
+
+// envOrElseFloat retrieves an environment variable value by the given key,
+// return a float based on that value.
+//
+// If env var cannot be found by the key or value fails to cast to a float,
+// return the given fallback float.
+func (l *configLoader) envOrElseFloat(key string, fallback float64) float64 {
+	if value, ok := l.lookupEnv(key); ok {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			l.warnInvalidSetting("%s was set to '%s', but failed to parse to a number. Falling back to default of %g.", key, value, fallback)
 			return fallback
 		}
 		return v
@@ -99,11 +546,11 @@ func envOrElseInt(key string, fallback int) int {
 //
 // If env var cannot be found by the key or value fails to cast to a bool,
 // return the given fallback boolean.
-func envOrElseBool(key string, fallback bool) bool {
-	if value, ok := os.LookupEnv(key); ok {
+func (l *configLoader) envOrElseBool(key string, fallback bool) bool {
+	if value, ok := l.lookupEnv(key); ok {
 		v, err := strconv.ParseBool(value)
 		if err != nil {
-			log.Warnf("%s was set to '%s', but failed to parse to true or false. Falling back to default of %t.", key, value, fallback)
+			l.warnInvalidSetting("%s was set to '%s', but failed to parse to true or false. Falling back to default of %t.", key, value, fallback)
 			return fallback
 		}
 		return v
@@ -119,15 +566,15 @@ func envOrElseBool(key string, fallback bool) bool {
 //
 // If env var cannot be found by the key,
 // or the value fails to parse as a duration or integer,
-// or the result is a duration of 0,
+// or the result is a duration of 0 when the fallback isn't,
 // return the given fallback duration.
-func envOrElseDuration(key string, fallback time.Duration) time.Duration {
-	value, ok := os.LookupEnv(key)
+func (l *configLoader) envOrElseDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := l.lookupEnv(key)
 	if ok {
 		dur, err := time.ParseDuration(value)
 		if err == nil {
-			if dur == 0 {
-				log.Warnf("%s was set to '%s', which is an unusable duration for the extension. Falling back to default of %s.", key, value, fallback)
+			if dur == 0 && fallback != 0 {
+				l.warnInvalidSetting("%s was set to '%s', which is an unusable duration for the extension. Falling back to default of %s.", key, value, fallback)
 				return fallback
 			} else {
 				return dur
@@ -140,52 +587,154 @@ func envOrElseDuration(key string, fallback time.Duration) time.Duration {
 			log.Warnf("%s was set to %d (an integer, not a duration). Assuming 'seconds' as unit, resulting in %s.", key, v, dur_s)
 			return dur_s
 		}
-		log.Warnf("%s was set to '%s', but failed to parse to a duration. Falling back to default of %s.", key, value, fallback)
+		l.warnInvalidSetting("%s was set to '%s', but failed to parse to a duration. Falling back to default of %s.", key, value, fallback)
 	}
 	return fallback
 }
 
-// kmsDecryptFunc is a function that can be mocked in tests to
-// avoid making actual calls to AWS.
-var kmsDecryptFunc = func(svc *kms.KMS, input *kms.DecryptInput) (*kms.DecryptOutput, error) {
-	return svc.Decrypt(input)
+// envOrElseDurationOrZero is like envOrElseDuration, but returns a duration
+// of 0 when the value is one, for settings where 0 turns something off.
+func (l *configLoader) envOrElseDurationOrZero(key string, fallback time.Duration) time.Duration {
+	if value, ok := l.lookupEnv(key); ok {
+		if dur, err := time.ParseDuration(value); err == nil && dur == 0 {
+			return 0
+		}
+	}
+	return l.envOrElseDuration(key, fallback)
+}
+
+// flushStrategyFromEnv retrieves the flush strategy from the environment
+// variable with the given key.
+//
+// If env var cannot be found by the key or isn't a known strategy,
+// return FlushStrategySync.
+func (l *configLoader) flushStrategyFromEnv(key string) FlushStrategy {
+	value, ok := l.lookupEnv(key)
+	if !ok {
+		return FlushStrategySync
+	}
+	switch strategy := FlushStrategy(value); strategy {
+	case FlushStrategySync, FlushStrategyAsync:
+		return strategy
+	default:
+		l.warnInvalidSetting("%s was set to '%s', but must be one of '%s' or '%s'. Falling back to default of %s.", key, value, FlushStrategySync, FlushStrategyAsync, FlushStrategySync)
+		return FlushStrategySync
+	}
 }
 
-// getApiKey checks if KMS_KEY_ID is supplied, and if it is, we assume we are dealing with a KMS-encrypted API key.
-// If KMS_KEY_ID is supplied, we must also have a base64 encrypted LIBHONEY_API_KEY.
-func getApiKey() string {
-	apiKey := os.Getenv("LIBHONEY_API_KEY")
-	if apiKey == "" {
-		log.Error("LIBHONEY_API_KEY is not set. Please set it to your Honeycomb API key.")
-		return ""
+// queuePolicyFromEnv retrieves the queue policy from the environment variable
+// with the given key.
+//
+// If env var cannot be found by the key or isn't a known policy,
+// return QueuePolicyBlock.
+func (l *configLoader) queuePolicyFromEnv(key string) QueuePolicy {
+	value, ok := l.lookupEnv(key)
+	if !ok {
+		return QueuePolicyBlock
 	}
+	switch policy := QueuePolicy(value); policy {
+	case QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest:
+		return policy
+	default:
+		l.warnInvalidSetting("%s was set to '%s', but must be one of '%s', '%s' or '%s'. Falling back to default of %s.", key, value, QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest, QueuePolicyBlock)
+		return QueuePolicyBlock
+	}
+}
 
-	kmsKeyId := os.Getenv("KMS_KEY_ID")
-	if kmsKeyId == "" {
-		// return unencrypted API Key, no KMS decryption needed
-		return apiKey
+// backendFromEnv retrieves the backend from the environment variable with the
+// given key.
+//
+// If env var cannot be found by the key or isn't a known backend,
+// return BackendHoneycomb.
+func (l *configLoader) backendFromEnv(key string) Backend {
+	value, ok := l.lookupEnv(key)
+	if !ok {
+		return BackendHoneycomb
+	}
+	switch backend := Backend(value); backend {
+	case BackendHoneycomb, BackendJSONLines, BackendOTLP, BackendSyslog:
+		return backend
+	default:
+		l.warnInvalidSetting("%s was set to '%s', but must be one of '%s', '%s', '%s' or '%s'. Falling back to default of %s.", key, value, BackendHoneycomb, BackendJSONLines, BackendOTLP, BackendSyslog, BackendHoneycomb)
+		return BackendHoneycomb
+	}
+}
+
+// headersFromEnv retrieves HTTP headers from the environment variable with the
+// given key, given as comma-separated name=value pairs as in
+// OTEL_EXPORTER_OTLP_HEADERS. Values may be URL-encoded. Pairs without a name
+// are skipped.
+func (l *configLoader) headersFromEnv(key string) map[string]string {
+	value := l.getenv(key)
+	if value == "" {
+		return nil
+	}
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		name, headerValue, _ := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			l.warnInvalidSetting("%s has a header with no name, ignoring it", key)
+			continue
+		}
+		if unescaped, err := url.QueryUnescape(strings.TrimSpace(headerValue)); err == nil {
+			headerValue = unescaped
+		}
+		headers[name] = strings.TrimSpace(headerValue)
 	}
+	return headers
+}
 
-	// decrypt the API key using KMS
-	kmsSession := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(os.Getenv("AWS_REGION")),
-	}))
+// queueMaxBytesForMemory returns the default ingestion queue size for a
+// function with the given memory size in MB, as found in
+// AWS_LAMBDA_FUNCTION_MEMORY_SIZE.
+func queueMaxBytesForMemory(memoryMB string) int {
+	mb, err := strconv.Atoi(memoryMB)
+	if err != nil || mb <= 0 {
+		mb = defaultFunctionMemoryMB
+	}
+	return min(max(mb<<20/queueMemoryFraction, minQueueMaxBytes), maxQueueMaxBytes)
+}
 
-	config := &aws.Config{}
-	svc := kms.New(kmsSession, config)
-	ciphertext, err := base64.StdEncoding.DecodeString(apiKey)
-	if err != nil {
-		log.Errorf("unable to decode ciphertext in Honeycomb API key: %v", err)
-		return ""
+// getApiKey fetches the API key from the Secrets Manager secret in HONEYCOMB_API_KEY_SECRET_ARN
+// or the SSM parameter in HONEYCOMB_API_KEY_SSM_PARAMETER, if either is set, and otherwise reads LIBHONEY_API_KEY.
+// If KMS_KEY_ID is supplied, we assume we are dealing with a KMS-encrypted API key,
+// and we must also have a base64 encrypted LIBHONEY_API_KEY.
+//
+// When no usable key can be found, the returned error is a *ConfigError.
+func (l *configLoader) getApiKey() (string, error) {
+	secretARN := l.getenv("HONEYCOMB_API_KEY_SECRET_ARN")
+	ssmParameter := l.getenv("HONEYCOMB_API_KEY_SSM_PARAMETER")
+	if secretARN != "" {
+		if ssmParameter != "" {
+			log.Warn("Both HONEYCOMB_API_KEY_SECRET_ARN and HONEYCOMB_API_KEY_SSM_PARAMETER are set, using the secret.")
+		}
+		apiKey, err := l.apiKeyFromSecretsManager(secretARN)
+		if err != nil {
+			log.Errorf("Failed to fetch Honeycomb API key from secret %s: %v", secretARN, err)
+			return "", &ConfigError{Type: ErrorTypeAPIKeyFetch, Err: fmt.Errorf("failed to fetch Honeycomb API key from secret %s: %w", secretARN, err)}
+		}
+		return apiKey, nil
+	}
+	if ssmParameter != "" {
+		apiKey, err := l.apiKeyFromSSM(ssmParameter)
+		if err != nil {
+			log.Errorf("Failed to fetch Honeycomb API key from SSM parameter %s: %v", ssmParameter, err)
+			return "", &ConfigError{Type: ErrorTypeAPIKeyFetch, Err: fmt.Errorf("failed to fetch Honeycomb API key from SSM parameter %s: %w", ssmParameter, err)}
+		}
+		return apiKey, nil
 	}
 
-	resp, err := kmsDecryptFunc(svc, &kms.DecryptInput{
-		CiphertextBlob: ciphertext,
-	})
+	apiKey := l.getenv("LIBHONEY_API_KEY")
+	if apiKey == "" {
+		return "", &ConfigError{Type: ErrorTypeMissingAPIKey, Err: errors.New("LIBHONEY_API_KEY is not set")}
+	}
 
-	if err != nil {
-		log.Errorf("Failed to decrypt Honeycomb API key: %v", err)
-		return ""
+	kmsKeyId := l.getenv("KMS_KEY_ID")
+	if kmsKeyId == "" {
+		// return unencrypted API Key, no KMS decryption needed
+		return apiKey, nil
 	}
-	return string(resp.Plaintext)
+
+	return l.apiKeyFromKMS(apiKey, kmsKeyId)
 }
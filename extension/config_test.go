@@ -2,6 +2,7 @@ package extension
 
 import (
 	"encoding/base64"
+	"errors"
 	"testing"
 	"time"
 
@@ -42,7 +43,29 @@ func Test_EnvOrElseInt(t *testing.T) {
 			if tC.envValue != "not-set" {
 				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
 			}
-			assert.Equal(t, tC.expectedValue, envOrElseInt("SOME_TEST_ENV_VAR", aDefaultInt))
+			assert.Equal(t, tC.expectedValue, new(configLoader).envOrElseInt("SOME_TEST_ENV_VAR", aDefaultInt))
+		})
+	}
+}
+
+func Test_EnvOrElseFloat(t *testing.T) {
+	aDefaultFloat := 0.5
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue float64
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: aDefaultFloat},
+		{desc: "set by user: float", envValue: "0.25", expectedValue: 0.25},
+		{desc: "set by user: integer", envValue: "1", expectedValue: 1},
+		{desc: "bad input: words", envValue: "a quarter", expectedValue: aDefaultFloat},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).envOrElseFloat("SOME_TEST_ENV_VAR", aDefaultFloat))
 		})
 	}
 }
@@ -85,7 +108,7 @@ func Test_EnvOrElseBool(t *testing.T) {
 			if tC.envValue != "not-set" {
 				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
 			}
-			assert.Equal(t, tC.expectedValue, envOrElseBool("SOME_TEST_ENV_VAR", aDefaultBool))
+			assert.Equal(t, tC.expectedValue, new(configLoader).envOrElseBool("SOME_TEST_ENV_VAR", aDefaultBool))
 		})
 	}
 }
@@ -143,7 +166,50 @@ func Test_EnvOrElseDuration(t *testing.T) {
 			if tC.envValue != "not-set" {
 				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
 			}
-			assert.Equal(t, tC.expectedValue, envOrElseDuration("SOME_TEST_ENV_VAR", aDefaultDuration))
+			assert.Equal(t, tC.expectedValue, new(configLoader).envOrElseDuration("SOME_TEST_ENV_VAR", aDefaultDuration))
+		})
+	}
+}
+
+func Test_EnvOrElseDurationOrZero(t *testing.T) {
+	aDefaultDuration := 42 * time.Second
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue time.Duration
+	}{
+		{
+			desc:          "default",
+			envValue:      "not-set",
+			expectedValue: aDefaultDuration,
+		},
+		{
+			desc:          "set by user: duration zero",
+			envValue:      "0s",
+			expectedValue: 0,
+		},
+		{
+			desc:          "set by user: integer zero",
+			envValue:      "0",
+			expectedValue: 0,
+		},
+		{
+			desc:          "set by user: duration",
+			envValue:      "250ms",
+			expectedValue: 250 * time.Millisecond,
+		},
+		{
+			desc:          "bad input: words",
+			envValue:      "none",
+			expectedValue: aDefaultDuration,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).envOrElseDurationOrZero("SOME_TEST_ENV_VAR", aDefaultDuration))
 		})
 	}
 }
@@ -200,7 +266,7 @@ func Test_GetApiKey(t *testing.T) {
 		envSetup      func(t *testing.T)
 		mockSetup     func(t *testing.T)
 		expectedValue string
-		expectError   bool
+		expectError   string
 	}{
 		{
 			desc: "regular libhoney api key",
@@ -209,7 +275,6 @@ func Test_GetApiKey(t *testing.T) {
 				t.Setenv("KMS_KEY_ID", "")
 			},
 			expectedValue: originalApiKey,
-			expectError:   false,
 		},
 		{
 			desc: "kms-encrypted api key",
@@ -225,7 +290,6 @@ func Test_GetApiKey(t *testing.T) {
 				}
 			},
 			expectedValue: originalApiKey,
-			expectError:   false,
 		},
 		{
 			desc: "invalid base64 in encrypted api key",
@@ -233,7 +297,20 @@ func Test_GetApiKey(t *testing.T) {
 				t.Setenv("LIBHONEY_API_KEY", "not-valid-base64")
 				t.Setenv("KMS_KEY_ID", "some-key-id")
 			},
-			expectError: true,
+			expectError: ErrorTypeInvalidAPIKey,
+		},
+		{
+			desc: "KMS decryption fails",
+			envSetup: func(t *testing.T) {
+				t.Setenv("LIBHONEY_API_KEY", encodedApiKey)
+				t.Setenv("KMS_KEY_ID", "some-key-id")
+			},
+			mockSetup: func(t *testing.T) {
+				kmsDecryptFunc = func(svc *kms.KMS, input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+					return nil, errors.New("AccessDeniedException")
+				}
+			},
+			expectError: ErrorTypeAPIKeyDecryption,
 		},
 		{
 			desc: "KMS_KEY_ID set but not LIBHONEY_API_KEY",
@@ -241,7 +318,7 @@ func Test_GetApiKey(t *testing.T) {
 				t.Setenv("LIBHONEY_API_KEY", "")
 				t.Setenv("KMS_KEY_ID", "some-key-id")
 			},
-			expectError: true,
+			expectError: ErrorTypeMissingAPIKey,
 		},
 		{
 			desc: "neither LIBHONEY_API_KEY or KMS_KEY_ID set",
@@ -249,7 +326,7 @@ func Test_GetApiKey(t *testing.T) {
 				t.Setenv("LIBHONEY_API_KEY", "")
 				t.Setenv("KMS_KEY_ID", "")
 			},
-			expectError: true,
+			expectError: ErrorTypeMissingAPIKey,
 		},
 	}
 
@@ -259,12 +336,192 @@ func Test_GetApiKey(t *testing.T) {
 			if tC.mockSetup != nil {
 				tC.mockSetup(t)
 			}
-			apiKey := getApiKey()
-			if tC.expectError {
+			apiKey, err := new(configLoader).getApiKey()
+			if tC.expectError != "" {
 				assert.Empty(t, apiKey, "Expected empty API key due to error condition")
+				var configErr *ConfigError
+				if assert.ErrorAs(t, err, &configErr) {
+					assert.Equal(t, tC.expectError, configErr.Type)
+				}
 			} else {
+				assert.NoError(t, err)
 				assert.Equal(t, tC.expectedValue, apiKey)
 			}
 		})
 	}
 }
+
+func Test_FlushStrategyFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue FlushStrategy
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: FlushStrategySync},
+		{desc: "sync", envValue: "sync", expectedValue: FlushStrategySync},
+		{desc: "async", envValue: "async", expectedValue: FlushStrategyAsync},
+		{desc: "bad input", envValue: "eventually", expectedValue: FlushStrategySync},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).flushStrategyFromEnv("SOME_TEST_ENV_VAR"))
+		})
+	}
+}
+
+func Test_ValidateAPIKeyFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue bool
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: true},
+		{desc: "opted out", envValue: "false", expectedValue: false},
+		{desc: "bad input", envValue: "maybe", expectedValue: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("HONEYCOMB_VALIDATE_API_KEY", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, NewConfigFromEnvironment().ValidateAPIKey)
+		})
+	}
+}
+
+func Test_QueuePolicyFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue QueuePolicy
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: QueuePolicyBlock},
+		{desc: "block", envValue: "block", expectedValue: QueuePolicyBlock},
+		{desc: "drop newest", envValue: "drop-newest", expectedValue: QueuePolicyDropNewest},
+		{desc: "drop oldest", envValue: "drop-oldest", expectedValue: QueuePolicyDropOldest},
+		{desc: "bad input", envValue: "drop-everything", expectedValue: QueuePolicyBlock},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).queuePolicyFromEnv("SOME_TEST_ENV_VAR"))
+		})
+	}
+}
+
+func Test_BackendFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue Backend
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: BackendHoneycomb},
+		{desc: "honeycomb", envValue: "honeycomb", expectedValue: BackendHoneycomb},
+		{desc: "jsonlines", envValue: "jsonlines", expectedValue: BackendJSONLines},
+		{desc: "otlp", envValue: "otlp", expectedValue: BackendOTLP},
+		{desc: "syslog", envValue: "syslog", expectedValue: BackendSyslog},
+		{desc: "bad input", envValue: "carrier-pigeon", expectedValue: BackendHoneycomb},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).backendFromEnv("SOME_TEST_ENV_VAR"))
+		})
+	}
+}
+
+func Test_HeadersFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue map[string]string
+	}{
+		{desc: "not set", envValue: "", expectedValue: nil},
+		{desc: "single header", envValue: "x-honeycomb-team=abc123", expectedValue: map[string]string{"x-honeycomb-team": "abc123"}},
+		{
+			desc:     "several headers with spaces and encoding",
+			envValue: " x-honeycomb-dataset = lambda , authorization=Basic%20dXNlcjpwYXNz==",
+			expectedValue: map[string]string{
+				"x-honeycomb-dataset": "lambda",
+				"authorization":       "Basic dXNlcjpwYXNz==",
+			},
+		},
+		{desc: "header without a name", envValue: "=value,x-custom=1", expectedValue: map[string]string{"x-custom": "1"}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			assert.Equal(t, tC.expectedValue, new(configLoader).headersFromEnv("SOME_TEST_ENV_VAR"))
+		})
+	}
+}
+
+func Test_QueueMaxBytesForMemory(t *testing.T) {
+	testCases := map[string]int{
+		"":      8 << 20,
+		"bogus": 8 << 20,
+		"128":   8 << 20,
+		"1024":  64 << 20,
+		"10240": 64 << 20,
+		"32":    2 << 20,
+		"8":     1 << 20,
+	}
+	for memory, expected := range testCases {
+		t.Run(memory, func(t *testing.T) {
+			assert.Equal(t, expected, queueMaxBytesForMemory(memory))
+		})
+	}
+}
+
+func Test_DestinationsFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		envValue      string
+		expectedValue []Destination
+	}{
+		{desc: "default", envValue: "not-set", expectedValue: nil},
+		{desc: "bad input", envValue: `{"apiKey": "key"}`, expectedValue: nil},
+		{
+			desc:     "destinations",
+			envValue: `[{"apiKey": "key-1", "dataset": "one"}, {"name": "siem", "apiKey": "key-2", "apiHost": "https://api.eu1.honeycomb.io/", "dataset": "two", "filter": {"lambda_extension.type": ["function"]}}]`,
+			expectedValue: []Destination{
+				{Name: "destination-1", APIKey: "key-1", Dataset: "one"},
+				{Name: "siem", APIKey: "key-2", APIHost: "https://api.eu1.honeycomb.io/", Dataset: "two", Filter: map[string][]string{"lambda_extension.type": {"function"}}},
+			},
+		},
+		{
+			desc:          "missing dataset",
+			envValue:      `[{"apiKey": "key-1"}, {"apiKey": "key-2", "dataset": "two"}]`,
+			expectedValue: []Destination{{Name: "destination-2", APIKey: "key-2", Dataset: "two"}},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if tC.envValue != "not-set" {
+				t.Setenv("SOME_TEST_ENV_VAR", tC.envValue)
+			}
+			assert.Equal(t, tC.expectedValue, new(configLoader).destinationsFromEnv("SOME_TEST_ENV_VAR"))
+		})
+	}
+}
+
+func Test_MissingAPIKeyWithDestinations(t *testing.T) {
+	t.Setenv("LIBHONEY_API_KEY", "")
+
+	var configErr *ConfigError
+	if assert.ErrorAs(t, NewConfigFromEnvironment().APIKeyError(), &configErr) {
+		assert.Equal(t, ErrorTypeMissingAPIKey, configErr.Type)
+	}
+
+	t.Setenv("HONEYCOMB_DESTINATIONS", `[{"name":"security","apiKey":"security-api-key","dataset":"audit"}]`)
+	config := NewConfigFromEnvironment()
+	assert.NoError(t, config.APIKeyError(), "expected no API key to be needed when every destination has its own")
+	assert.Equal(t, "", config.APIKey)
+}
@@ -0,0 +1,389 @@
+package extension
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileVersion is the version of the config file schema this extension
+// reads. Files must declare it with a top-level version key.
+const ConfigFileVersion = 1
+
+// ErrorTypeInvalidConfigFile is reported to the Extensions API when the config
+// file can't be read, or has settings that aren't valid.
+const ErrorTypeInvalidConfigFile = "Extension.InvalidConfigFile"
+
+// configFileEnv names the config file to load. Without it, the first of
+// defaultConfigFiles that exists is loaded, so a file in the function's own
+// code takes precedence over one in a layer.
+const configFileEnv = "HONEYCOMB_CONFIG_FILE"
+
+var defaultConfigFiles = []string{
+	"/var/task/honeycomb.yaml",
+	"/var/task/honeycomb.yml",
+	"/var/task/honeycomb.json",
+	"/opt/honeycomb/config.yaml",
+	"/opt/honeycomb/config.yml",
+	"/opt/honeycomb/config.json",
+}
+
+// settingKind is the type of value a config file setting takes
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindBool
+	kindInt
+	kindFloat
+	kindDuration
+	kindEnum
+	kindJSONObject   // an object of strings, set as JSON
+	kindHeaders      // an object of strings, set as name=value pairs
+	kindDestinations // a list of destinations, set as JSON
+)
+
+// configFileSetting is a setting in the config file, and the environment
+// variable it stands in for
+type configFileSetting struct {
+	env    string
+	kind   settingKind
+	values []string // the allowed values of a kindEnum
+}
+
+// configFileSchema has every setting of ConfigFileVersion, keyed by its path
+// in the file. Settings in sections, such as flush.interval, are nested
+// under the section's key.
+var configFileSchema = map[string]configFileSetting{
+	"apiKey":                             {env: "LIBHONEY_API_KEY", kind: kindString},
+	"apiKeySecretArn":                    {env: "HONEYCOMB_API_KEY_SECRET_ARN", kind: kindString},
+	"apiKeySsmParameter":                 {env: "HONEYCOMB_API_KEY_SSM_PARAMETER", kind: kindString},
+	"parametersSecretsEndpoint":          {env: "HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT", kind: kindString},
+	"kms.keyId":                          {env: "KMS_KEY_ID", kind: kindString},
+	"kms.encryptionContext":              {env: "HONEYCOMB_KMS_ENCRYPTION_CONTEXT", kind: kindJSONObject},
+	"kms.endpoint":                       {env: "HONEYCOMB_KMS_ENDPOINT", kind: kindString},
+	"dataset":                            {env: "LIBHONEY_DATASET", kind: kindString},
+	"apiHost":                            {env: "LIBHONEY_API_HOST", kind: kindString},
+	"debug":                              {env: "HONEYCOMB_DEBUG", kind: kindBool},
+	"validateApiKey":                     {env: "HONEYCOMB_VALIDATE_API_KEY", kind: kindBool},
+	"failOnInitError":                    {env: "HONEYCOMB_FAIL_ON_INIT_ERROR", kind: kindBool},
+	"exitOnAuthFailure":                  {env: "HONEYCOMB_EXIT_ON_AUTH_FAILURE", kind: kindBool},
+	"strictConfig":                       {env: "HONEYCOMB_STRICT_CONFIG", kind: kindBool},
+	"telemetryApi.timeoutMs":             {env: "LOGS_API_TIMEOUT_MS", kind: kindInt},
+	"telemetryApi.maxBytes":              {env: "LOGS_API_MAX_BYTES", kind: kindInt},
+	"telemetryApi.maxItems":              {env: "LOGS_API_MAX_ITEMS", kind: kindInt},
+	"telemetryApi.disablePlatformEvents": {env: "LOGS_API_DISABLE_PLATFORM_MSGS", kind: kindBool},
+	"batchSendTimeout":                   {env: "HONEYCOMB_BATCH_SEND_TIMEOUT", kind: kindDuration},
+	"connectTimeout":                     {env: "HONEYCOMB_CONNECT_TIMEOUT", kind: kindDuration},
+	"postInvokeTimeout":                  {env: "HONEYCOMB_POST_INVOKE_TIMEOUT", kind: kindDuration},
+	"flush.strategy":                     {env: "HONEYCOMB_FLUSH_STRATEGY", kind: kindEnum, values: []string{string(FlushStrategySync), string(FlushStrategyAsync)}},
+	"flush.interval":                     {env: "HONEYCOMB_FLUSH_INTERVAL", kind: kindDuration},
+	"flush.maxBytes":                     {env: "HONEYCOMB_FLUSH_MAX_BYTES", kind: kindInt},
+	"flush.everyInvocations":             {env: "HONEYCOMB_FLUSH_EVERY_INVOCATIONS", kind: kindInt},
+	"flush.minRemaining":                 {env: "HONEYCOMB_FLUSH_MIN_REMAINING", kind: kindDuration},
+	"queue.maxBytes":                     {env: "HONEYCOMB_QUEUE_MAX_BYTES", kind: kindInt},
+	"queue.policy":                       {env: "HONEYCOMB_QUEUE_POLICY", kind: kindEnum, values: []string{string(QueuePolicyBlock), string(QueuePolicyDropNewest), string(QueuePolicyDropOldest)}},
+	"spool.enabled":                      {env: "HONEYCOMB_SPOOL_ENABLED", kind: kindBool},
+	"spool.dir":                          {env: "HONEYCOMB_SPOOL_DIR", kind: kindString},
+	"spool.maxBytes":                     {env: "HONEYCOMB_SPOOL_MAX_BYTES", kind: kindInt},
+	"spool.maxAge":                       {env: "HONEYCOMB_SPOOL_MAX_AGE", kind: kindDuration},
+	"spool.compress":                     {env: "HONEYCOMB_SPOOL_COMPRESS", kind: kindBool},
+	"retry.maxAttempts":                  {env: "HONEYCOMB_RETRY_MAX_ATTEMPTS", kind: kindInt},
+	"retry.initialBackoff":               {env: "HONEYCOMB_RETRY_INITIAL_BACKOFF", kind: kindDuration},
+	"retry.maxBackoff":                   {env: "HONEYCOMB_RETRY_MAX_BACKOFF", kind: kindDuration},
+	"retry.jitter":                       {env: "HONEYCOMB_RETRY_JITTER", kind: kindFloat},
+	"retry.budget":                       {env: "HONEYCOMB_RETRY_BUDGET", kind: kindDuration},
+	"circuitBreaker.threshold":           {env: "HONEYCOMB_CIRCUIT_BREAKER_THRESHOLD", kind: kindInt},
+	"circuitBreaker.cooldown":            {env: "HONEYCOMB_CIRCUIT_BREAKER_COOLDOWN", kind: kindDuration},
+	"selfTelemetry.enabled":              {env: "HONEYCOMB_SELF_TELEMETRY_ENABLED", kind: kindBool},
+	"selfTelemetry.dataset":              {env: "HONEYCOMB_SELF_TELEMETRY_DATASET", kind: kindString},
+	"selfTelemetry.interval":             {env: "HONEYCOMB_SELF_TELEMETRY_INTERVAL", kind: kindDuration},
+	"destinations":                       {env: "HONEYCOMB_DESTINATIONS", kind: kindDestinations},
+	"backend":                            {env: "HONEYCOMB_BACKEND", kind: kindEnum, values: []string{string(BackendHoneycomb), string(BackendJSONLines), string(BackendOTLP), string(BackendSyslog)}},
+	"backendFile":                        {env: "HONEYCOMB_BACKEND_FILE", kind: kindString},
+	"otlp.endpoint":                      {env: "HONEYCOMB_OTLP_ENDPOINT", kind: kindString},
+	"otlp.headers":                       {env: "HONEYCOMB_OTLP_HEADERS", kind: kindHeaders},
+	"syslog.address":                     {env: "HONEYCOMB_SYSLOG_ADDRESS", kind: kindString},
+	"syslog.tls":                         {env: "HONEYCOMB_SYSLOG_TLS", kind: kindBool},
+	"syslog.caFile":                      {env: "HONEYCOMB_SYSLOG_CA_FILE", kind: kindString},
+	"syslog.batchSize":                   {env: "HONEYCOMB_SYSLOG_BATCH_SIZE", kind: kindInt},
+	"syslog.structuredDataId":            {env: "HONEYCOMB_SYSLOG_SD_ID", kind: kindString},
+}
+
+// destinationKeys are the keys a destination in the config file may have
+var destinationKeys = []string{"name", "apiKey", "apiHost", "dataset", "filter"}
+
+// configLoader reads settings from environment variables, falling back on
+// those loaded from the config file, and collects the settings that can't be
+// used. A nil configLoader reads environment variables alone.
+type configLoader struct {
+	// fileSettings holds the settings loaded from the config file, keyed by
+	// the environment variable each one stands in for
+	fileSettings map[string]string
+
+	// invalid holds the settings found to be unusable, each of which was
+	// replaced by its default
+	invalid []error
+}
+
+// lookupEnv retrieves the value of the environment variable with the given
+// key or, if it's not set, of the config file setting standing in for it.
+// Environment variables take precedence over the config file.
+func (l *configLoader) lookupEnv(key string) (string, bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
+	}
+	if l == nil {
+		return "", false
+	}
+	value, ok := l.fileSettings[key]
+	return value, ok
+}
+
+// getenv is like os.Getenv, but falls back on the config file like lookupEnv
+func (l *configLoader) getenv(key string) string {
+	value, _ := l.lookupEnv(key)
+	return value
+}
+
+// loadConfigFile loads the config file named by HONEYCOMB_CONFIG_FILE, or
+// else the first of defaultConfigFiles that exists, returning its path and
+// settings. The path is empty if there's no file to load.
+//
+// Settings that aren't valid are left out, and described by the returned
+// error, which is a *ConfigError. A file with an unsupported version has no
+// settings.
+func loadConfigFile() (string, map[string]string, error) {
+	path := os.Getenv(configFileEnv)
+	if path == "" {
+		for _, candidate := range defaultConfigFiles {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path == "" {
+		return "", nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return path, nil, &ConfigError{Type: ErrorTypeInvalidConfigFile, Err: fmt.Errorf("failed to read config file: %w", err)}
+	}
+	settings, err := parseConfigFile(path, data)
+	if err != nil {
+		return path, settings, &ConfigError{Type: ErrorTypeInvalidConfigFile, Err: err}
+	}
+	return path, settings, nil
+}
+
+// configFileError is a problem with a config file, at the given line
+type configFileError struct {
+	path string
+	line int
+	msg  string
+}
+
+func (e *configFileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.path, e.line, e.msg)
+}
+
+// parseConfigFile parses the YAML or JSON config file at path, returning its
+// settings keyed by the environment variable each stands in for. Every
+// problem found is returned, joined into one error, with the settings that
+// were valid.
+func parseConfigFile(path string, data []byte) (map[string]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, &configFileError{path: path, line: 1, msg: "version is required"}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &configFileError{path: path, line: root.Line, msg: "expected an object of settings"}
+	}
+
+	p := &configFileParser{path: path, settings: make(map[string]string)}
+	version := mappingValue(root, "version")
+	if version == nil {
+		return nil, p.fail(root, "version is required")
+	}
+	var v int
+	if version.Decode(&v) != nil || v != ConfigFileVersion {
+		return nil, p.fail(version, fmt.Sprintf("unsupported version %q, expected %d", version.Value, ConfigFileVersion))
+	}
+	p.section(root, "")
+	return p.settings, errors.Join(p.errs...)
+}
+
+// configFileParser collects the settings and problems found in a config file
+type configFileParser struct {
+	path     string
+	settings map[string]string
+	errs     []error
+}
+
+func (p *configFileParser) fail(node *yaml.Node, msg string) error {
+	err := &configFileError{path: p.path, line: node.Line, msg: msg}
+	p.errs = append(p.errs, err)
+	return err
+}
+
+// section parses the settings in the mapping node at the given path prefix
+func (p *configFileParser) section(node *yaml.Node, prefix string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valueNode := node.Content[i], node.Content[i+1]
+		key := prefix + keyNode.Value
+		if key == "version" {
+			continue
+		}
+		if setting, ok := configFileSchema[key]; ok {
+			p.setting(key, setting, valueNode)
+			continue
+		}
+		if isConfigFileSection(key) {
+			if valueNode.Kind != yaml.MappingNode {
+				p.fail(valueNode, fmt.Sprintf("%s must be an object", key))
+				continue
+			}
+			p.section(valueNode, key+".")
+			continue
+		}
+		p.fail(keyNode, fmt.Sprintf("unknown setting %s", key))
+	}
+}
+
+// setting checks the value of a setting, recording it as its environment
+// variable would be set. A null value leaves the setting unset.
+func (p *configFileParser) setting(key string, setting configFileSetting, node *yaml.Node) {
+	if node.Tag == "!!null" {
+		return
+	}
+	value, err := settingValue(setting, node)
+	if err != nil {
+		p.fail(node, fmt.Sprintf("%s %s", key, err))
+		return
+	}
+	p.settings[setting.env] = value
+}
+
+// settingValue returns the value of node as the environment variable for
+// setting would be set, or an error saying what it must be instead
+func settingValue(setting configFileSetting, node *yaml.Node) (string, error) {
+	switch setting.kind {
+	case kindJSONObject, kindHeaders:
+		var object map[string]string
+		if node.Kind != yaml.MappingNode || node.Decode(&object) != nil {
+			return "", errors.New("must be an object of strings")
+		}
+		if setting.kind == kindJSONObject {
+			encoded, err := json.Marshal(object)
+			return string(encoded), err
+		}
+		pairs := make([]string, 0, len(object))
+		for name, value := range object {
+			pairs = append(pairs, name+"="+url.QueryEscape(value))
+		}
+		slices.Sort(pairs)
+		return strings.Join(pairs, ","), nil
+	case kindDestinations:
+		return destinationsValue(node)
+	}
+
+	if node.Kind != yaml.ScalarNode {
+		return "", errors.New("must be a single value")
+	}
+	switch setting.kind {
+	case kindBool:
+		var b bool
+		if node.Decode(&b) != nil {
+			return "", errors.New("must be true or false")
+		}
+		return strconv.FormatBool(b), nil
+	case kindInt:
+		var i int
+		if node.Decode(&i) != nil {
+			return "", errors.New("must be an integer")
+		}
+		return strconv.Itoa(i), nil
+	case kindFloat:
+		var f float64
+		if node.Decode(&f) != nil {
+			return "", errors.New("must be a number")
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case kindDuration:
+		// a bare integer is a number of seconds, as with environment variables
+		var seconds int
+		if node.Tag == "!!int" && node.Decode(&seconds) == nil {
+			return (time.Duration(seconds) * time.Second).String(), nil
+		}
+		if _, err := time.ParseDuration(node.Value); err != nil {
+			return "", errors.New(`must be a duration, such as "500ms" or "2s"`)
+		}
+		return node.Value, nil
+	case kindEnum:
+		if !slices.Contains(setting.values, node.Value) {
+			return "", fmt.Errorf("must be one of %s", strings.Join(setting.values, ", "))
+		}
+		return node.Value, nil
+	default:
+		return node.Value, nil
+	}
+}
+
+// destinationsValue returns the list of destinations in node as JSON, as
+// HONEYCOMB_DESTINATIONS would be set
+func destinationsValue(node *yaml.Node) (string, error) {
+	if node.Kind != yaml.SequenceNode {
+		return "", errors.New("must be a list of destinations")
+	}
+	destinations := make([]Destination, 0, len(node.Content))
+	for i, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return "", fmt.Errorf("destination %d must be an object", i+1)
+		}
+		for j := 0; j < len(item.Content); j += 2 {
+			if !slices.Contains(destinationKeys, item.Content[j].Value) {
+				return "", fmt.Errorf("destination %d has unknown setting %s", i+1, item.Content[j].Value)
+			}
+		}
+		var destination Destination
+		if err := item.Decode(&destination); err != nil {
+			return "", fmt.Errorf("destination %d must have string settings and a filter of lists of strings", i+1)
+		}
+		destinations = append(destinations, destination)
+	}
+	encoded, err := json.Marshal(destinations)
+	return string(encoded), err
+}
+
+// isConfigFileSection reports whether key is a section of settings
+func isConfigFileSection(key string) bool {
+	for path := range configFileSchema {
+		if strings.HasPrefix(path, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingValue returns the value of key in the mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package extension
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseConfigFile(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		data             string
+		expectedSettings map[string]string
+		expectedErrors   []string
+	}{
+		{
+			desc: "yaml",
+			data: `
+version: 1
+dataset: lambda-logs
+debug: true
+flush:
+  strategy: async
+  interval: 250ms
+  everyInvocations: 5
+retry:
+  jitter: 0.25
+  budget: 10
+otlp:
+  headers:
+    authorization: Bearer a,b
+kms:
+  encryptionContext:
+    LambdaFunctionName: my-function
+destinations:
+  - name: security
+    apiKey: another-key
+    dataset: audit
+    filter:
+      level: [error, warn]
+selfTelemetry:
+  dataset: ~
+`,
+			expectedSettings: map[string]string{
+				"LIBHONEY_DATASET":                  "lambda-logs",
+				"HONEYCOMB_DEBUG":                   "true",
+				"HONEYCOMB_FLUSH_STRATEGY":          "async",
+				"HONEYCOMB_FLUSH_INTERVAL":          "250ms",
+				"HONEYCOMB_FLUSH_EVERY_INVOCATIONS": "5",
+				"HONEYCOMB_RETRY_JITTER":            "0.25",
+				"HONEYCOMB_RETRY_BUDGET":            "10s",
+				"HONEYCOMB_OTLP_HEADERS":            "authorization=Bearer+a%2Cb",
+				"HONEYCOMB_KMS_ENCRYPTION_CONTEXT":  `{"LambdaFunctionName":"my-function"}`,
+				"HONEYCOMB_DESTINATIONS":            `[{"name":"security","apiKey":"another-key","apiHost":"","dataset":"audit","filter":{"level":["error","warn"]}}]`,
+			},
+		},
+		{
+			desc: "json",
+			data: "{\n\t\"version\": 1,\n\t\"apiHost\": \"https://api.eu1.honeycomb.io\",\n\t\"telemetryApi\": {\"maxItems\": 500}\n}\n",
+			expectedSettings: map[string]string{
+				"LIBHONEY_API_HOST":  "https://api.eu1.honeycomb.io",
+				"LOGS_API_MAX_ITEMS": "500",
+			},
+		},
+		{
+			desc: "invalid settings are left out",
+			data: `version: 1
+dataset: lambda-logs
+debug: sometimes
+flush:
+  interval: soon
+  strategy: eventually
+queue: drop-oldest
+unknown: true
+destinations:
+  - dataset: audit
+    apiKeys: oops
+`,
+			expectedSettings: map[string]string{"LIBHONEY_DATASET": "lambda-logs"},
+			expectedErrors: []string{
+				"honeycomb.yaml:3: debug must be true or false",
+				`honeycomb.yaml:5: flush.interval must be a duration, such as "500ms" or "2s"`,
+				"honeycomb.yaml:6: flush.strategy must be one of sync, async",
+				"honeycomb.yaml:7: queue must be an object",
+				"honeycomb.yaml:8: unknown setting unknown",
+				"honeycomb.yaml:10: destinations destination 1 has unknown setting apiKeys",
+			},
+		},
+		{
+			desc:           "missing version",
+			data:           "dataset: lambda-logs\n",
+			expectedErrors: []string{"honeycomb.yaml:1: version is required"},
+		},
+		{
+			desc:           "unsupported version",
+			data:           "dataset: lambda-logs\nversion: 2\n",
+			expectedErrors: []string{`honeycomb.yaml:2: unsupported version "2", expected 1`},
+		},
+		{
+			desc:           "not an object",
+			data:           "- version: 1\n",
+			expectedErrors: []string{"honeycomb.yaml:1: expected an object of settings"},
+		},
+		{
+			desc:           "malformed",
+			data:           "version: 1\ndataset: [\n",
+			expectedErrors: []string{"honeycomb.yaml: yaml: line 2: did not find expected node content"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			settings, err := parseConfigFile("honeycomb.yaml", []byte(tC.data))
+			if tC.expectedSettings == nil {
+				assert.Empty(t, settings)
+			} else {
+				assert.Equal(t, tC.expectedSettings, settings)
+			}
+			if len(tC.expectedErrors) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			var joined interface{ Unwrap() []error }
+			if errors.As(err, &joined) {
+				errs := make([]string, 0, len(joined.Unwrap()))
+				for _, e := range joined.Unwrap() {
+					errs = append(errs, e.Error())
+				}
+				assert.Equal(t, tC.expectedErrors, errs)
+			} else {
+				assert.EqualError(t, err, tC.expectedErrors[0])
+			}
+		})
+	}
+}
+
+func Test_ConfigFileDestinationsMatchEnvironment(t *testing.T) {
+	settings, err := parseConfigFile("honeycomb.yaml", []byte(`version: 1
+destinations:
+  - apiKey: another-key
+    dataset: audit
+  - dataset: no-key
+`))
+	assert.NoError(t, err)
+	l := &configLoader{fileSettings: settings}
+
+	assert.Equal(t, []Destination{{Name: "destination-1", APIKey: "another-key", Dataset: "audit"}}, l.destinationsFromEnv("HONEYCOMB_DESTINATIONS"))
+}
+
+func Test_NewConfigFromConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`version: 1
+apiKey: file-api-key
+dataset: file-dataset
+postInvokeTimeout: 0
+flush:
+  interval: 5s
+  strategy: async
+  minRemaining: 0s
+`), 0o600))
+	t.Setenv("HONEYCOMB_CONFIG_FILE", path)
+	t.Setenv("LIBHONEY_DATASET", "env-dataset")
+
+	config := NewConfigFromEnvironment()
+
+	assert.Equal(t, path, config.ConfigFile)
+	assert.NoError(t, config.ConfigFileError())
+	assert.Equal(t, "file-api-key", config.APIKey)
+	assert.Equal(t, "env-dataset", config.Dataset, "expected environment variables to take precedence")
+	assert.Equal(t, 5*time.Second, config.FlushInterval)
+	assert.Equal(t, FlushStrategyAsync, config.FlushStrategy)
+	assert.Equal(t, time.Duration(0), config.PostInvokeTimeout)
+	assert.Equal(t, time.Duration(0), config.FlushMinRemaining)
+	assert.Equal(t, defaultConnectTimeout, config.ConnectTimeout)
+	assert.True(t, config.ValidateAPIKey, "expected the API key to be checked unless turned off")
+}
+
+func Test_NewConfigFromInvalidConfigFile(t *testing.T) {
+	t.Setenv("HONEYCOMB_CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	t.Setenv("LIBHONEY_API_KEY", "env-api-key")
+
+	config := NewConfigFromEnvironment()
+
+	var configErr *ConfigError
+	if assert.ErrorAs(t, config.ConfigFileError(), &configErr) {
+		assert.Equal(t, ErrorTypeInvalidConfigFile, configErr.Type)
+	}
+	assert.Equal(t, "env-api-key", config.APIKey)
+}
+
+func Test_RefreshAPIKeyFromConfigFile(t *testing.T) {
+	originalSecretsManagerGetFunc := secretsManagerGetFunc
+	defer func() {
+		secretsManagerGetFunc = originalSecretsManagerGetFunc
+	}()
+	secretsManagerGetFunc = func(svc *secretsmanager.SecretsManager, input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+		return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(aws.StringValue(input.SecretId) + "-api-key")}, nil
+	}
+	t.Setenv("HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT", "http://127.0.0.1:1")
+	writeConfig := func(secret string) string {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte("version: 1\napiKeySecretArn: "+secret+"\n"), 0o600))
+		return path
+	}
+
+	t.Setenv("HONEYCOMB_CONFIG_FILE", writeConfig("first"))
+	config := NewConfigFromEnvironment()
+	t.Setenv("HONEYCOMB_CONFIG_FILE", writeConfig("second"))
+	other := NewConfigFromEnvironment()
+
+	apiKey, err := config.RefreshAPIKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "first-api-key", apiKey, "expected each config to keep the settings it was loaded with")
+	apiKey, err = other.RefreshAPIKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "second-api-key", apiKey)
+}
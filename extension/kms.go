@@ -0,0 +1,99 @@
+package extension
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// lambdaFunctionNameContextKey is the encryption context the Lambda console's
+// encryption helpers encrypt environment variables with, set to the function's
+// name
+const lambdaFunctionNameContextKey = "LambdaFunctionName"
+
+// kmsDecryptFunc is a function that can be mocked in tests to
+// avoid making actual calls to AWS.
+var kmsDecryptFunc = func(svc *kms.KMS, input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	return svc.Decrypt(input)
+}
+
+// apiKeyFromKMS decrypts the base64 ciphertext of the API key with the KMS key
+// keyID, using the encryption context in HONEYCOMB_KMS_ENCRYPTION_CONTEXT and
+// the KMS endpoint in HONEYCOMB_KMS_ENDPOINT if they're set.
+//
+// Without a configured encryption context, ciphertext encrypted with none is
+// tried first, then ciphertext encrypted by the Lambda console with the
+// function's name as its context.
+//
+// When the key can't be decrypted, the returned error is a *ConfigError.
+func (l *configLoader) apiKeyFromKMS(apiKey, keyID string) (string, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(apiKey)
+	if err != nil {
+		log.Errorf("unable to decode ciphertext in Honeycomb API key: %v", err)
+		return "", &ConfigError{Type: ErrorTypeInvalidAPIKey, Err: fmt.Errorf("unable to decode ciphertext in Honeycomb API key: %w", err)}
+	}
+	encryptionContext, err := l.encryptionContextFromEnv("HONEYCOMB_KMS_ENCRYPTION_CONTEXT")
+	if err != nil {
+		log.Errorf("Unable to decrypt Honeycomb API key: %v", err)
+		return "", &ConfigError{Type: ErrorTypeAPIKeyDecryption, Err: err}
+	}
+
+	config := &aws.Config{}
+	if endpoint := l.getenv("HONEYCOMB_KMS_ENDPOINT"); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	svc := kms.New(awsSession(), config)
+	input := &kms.DecryptInput{
+		CiphertextBlob:    ciphertext,
+		KeyId:             aws.String(keyID),
+		EncryptionContext: encryptionContext,
+	}
+	resp, err := kmsDecryptFunc(svc, input)
+	if isKMSError(err, kms.ErrCodeInvalidCiphertextException) && encryptionContext == nil {
+		if functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME"); functionName != "" {
+			input.EncryptionContext = map[string]*string{lambdaFunctionNameContextKey: aws.String(functionName)}
+			resp, err = kmsDecryptFunc(svc, input)
+		}
+	}
+
+	switch {
+	case err == nil:
+		return string(resp.Plaintext), nil
+	case isKMSError(err, "AccessDeniedException"):
+		log.Errorf("Not allowed to decrypt Honeycomb API key with KMS key %s, check the function role's permissions and the key policy: %v", keyID, err)
+		return "", &ConfigError{Type: ErrorTypeAPIKeyAccessDenied, Err: fmt.Errorf("not allowed to decrypt Honeycomb API key with KMS key %s: %w", keyID, err)}
+	case isKMSError(err, kms.ErrCodeInvalidCiphertextException), isKMSError(err, kms.ErrCodeIncorrectKeyException):
+		log.Errorf("Honeycomb API key is not ciphertext encrypted with KMS key %s and the configured encryption context: %v", keyID, err)
+		return "", &ConfigError{Type: ErrorTypeInvalidAPIKey, Err: fmt.Errorf("Honeycomb API key is not ciphertext encrypted with KMS key %s and the configured encryption context: %w", keyID, err)}
+	default:
+		log.Errorf("Failed to decrypt Honeycomb API key: %v", err)
+		return "", &ConfigError{Type: ErrorTypeAPIKeyDecryption, Err: fmt.Errorf("failed to decrypt Honeycomb API key: %w", err)}
+	}
+}
+
+// isKMSError reports whether err is an error from KMS with the given code
+func isKMSError(err error, code string) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == code
+}
+
+// encryptionContextFromEnv retrieves a KMS encryption context from the
+// environment variable with the given key, given as a JSON object of strings
+// as with the AWS CLI's --encryption-context, or returns nil if it's not set.
+func (l *configLoader) encryptionContextFromEnv(key string) (map[string]*string, error) {
+	value := l.getenv(key)
+	if value == "" {
+		return nil, nil
+	}
+	var context map[string]string
+	if err := json.Unmarshal([]byte(value), &context); err != nil {
+		return nil, fmt.Errorf("%s must be a JSON object of strings: %w", key, err)
+	}
+	return aws.StringMap(context), nil
+}
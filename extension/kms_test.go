@@ -0,0 +1,126 @@
+package extension
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ApiKeyFromKMS(t *testing.T) {
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	originalKmsDecryptFunc := kmsDecryptFunc
+	defer func() {
+		kmsDecryptFunc = originalKmsDecryptFunc
+	}()
+
+	testCases := []struct {
+		desc              string
+		encryptionContext string
+		endpoint          string
+		functionName      string
+		// keyContext is the encryption context the ciphertext was encrypted with
+		keyContext      map[string]string
+		decryptErr      error
+		expectedCalls   int
+		expectedContext map[string]string
+		expectError     string
+	}{
+		{
+			desc:          "no encryption context",
+			functionName:  "my-function",
+			expectedCalls: 1,
+		},
+		{
+			desc:              "configured encryption context",
+			encryptionContext: `{"Team": "platform", "LambdaFunctionName": "my-function"}`,
+			keyContext:        map[string]string{"Team": "platform", "LambdaFunctionName": "my-function"},
+			expectedCalls:     1,
+			expectedContext:   map[string]string{"Team": "platform", "LambdaFunctionName": "my-function"},
+		},
+		{
+			desc:            "encrypted by the Lambda console",
+			functionName:    "my-function",
+			keyContext:      map[string]string{"LambdaFunctionName": "my-function"},
+			expectedCalls:   2,
+			expectedContext: map[string]string{"LambdaFunctionName": "my-function"},
+		},
+		{
+			desc:          "custom endpoint",
+			endpoint:      "https://vpce-0123.kms.us-east-1.vpce.amazonaws.com",
+			expectedCalls: 1,
+		},
+		{
+			desc:              "wrong encryption context",
+			encryptionContext: `{"Team": "platform"}`,
+			functionName:      "my-function",
+			keyContext:        map[string]string{"LambdaFunctionName": "my-function"},
+			expectedCalls:     1,
+			expectedContext:   map[string]string{"Team": "platform"},
+			expectError:       ErrorTypeInvalidAPIKey,
+		},
+		{
+			desc:          "access denied",
+			decryptErr:    awserr.New("AccessDeniedException", "not authorized to perform kms:Decrypt", nil),
+			expectedCalls: 1,
+			expectError:   ErrorTypeAPIKeyAccessDenied,
+		},
+		{
+			desc:          "key disabled",
+			decryptErr:    awserr.New(kms.ErrCodeDisabledException, "key is disabled", nil),
+			expectedCalls: 1,
+			expectError:   ErrorTypeAPIKeyDecryption,
+		},
+		{
+			desc:              "invalid encryption context",
+			encryptionContext: `LambdaFunctionName=my-function`,
+			expectError:       ErrorTypeAPIKeyDecryption,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("HONEYCOMB_KMS_ENCRYPTION_CONTEXT", tC.encryptionContext)
+			t.Setenv("HONEYCOMB_KMS_ENDPOINT", tC.endpoint)
+			t.Setenv("AWS_LAMBDA_FUNCTION_NAME", tC.functionName)
+			t.Setenv("AWS_REGION", "us-east-1")
+			calls := 0
+			var lastContext map[string]string
+			kmsDecryptFunc = func(svc *kms.KMS, input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+				calls++
+				lastContext = aws.StringValueMap(input.EncryptionContext)
+				if len(lastContext) == 0 {
+					lastContext = nil
+				}
+				assert.Equal(t, "some-key-id", aws.StringValue(input.KeyId))
+				if tC.endpoint != "" {
+					assert.Equal(t, tC.endpoint, svc.Endpoint)
+				}
+				if tC.decryptErr != nil {
+					return nil, tC.decryptErr
+				}
+				if !assert.ObjectsAreEqual(tC.keyContext, lastContext) {
+					return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "", nil)
+				}
+				return &kms.DecryptOutput{Plaintext: []byte("test-api-key")}, nil
+			}
+
+			apiKey, err := new(configLoader).apiKeyFromKMS(ciphertext, "some-key-id")
+			assert.Equal(t, tC.expectedCalls, calls)
+			assert.Equal(t, tC.expectedContext, lastContext)
+			if tC.expectError != "" {
+				assert.Empty(t, apiKey)
+				var configErr *ConfigError
+				if assert.ErrorAs(t, err, &configErr) {
+					assert.Equal(t, tC.expectError, configErr.Type)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "test-api-key", apiKey)
+			}
+		})
+	}
+}
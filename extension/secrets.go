@@ -0,0 +1,186 @@
+package extension
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	// The AWS Parameters and Secrets Lambda Extension serves its cache on
+	// localhost, on this port unless PARAMETERS_SECRETS_EXTENSION_HTTP_PORT
+	// says otherwise, to callers presenting the function's session token.
+	defaultParametersSecretsPort = "2773"
+	parametersSecretsTokenHeader = "X-Aws-Parameters-Secrets-Token"
+
+	// It's quick to answer from a cache on localhost, or to find it's not there
+	parametersSecretsTimeout = time.Second * 2
+)
+
+// secretsManagerGetFunc and ssmGetParameterFunc are functions that can be
+// mocked in tests to avoid making actual calls to AWS.
+var secretsManagerGetFunc = func(svc *secretsmanager.SecretsManager, input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	return svc.GetSecretValue(input)
+}
+
+var ssmGetParameterFunc = func(svc *ssm.SSM, input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+	return svc.GetParameter(input)
+}
+
+// RefreshAPIKey fetches the API key again straight from Secrets Manager or
+// SSM, such as after it has been rotated, bypassing the Parameters and Secrets
+// extension's cache, which may still hold the old key. A key from any other
+// source can't change without the function being redeployed, so it returns
+// an error for those.
+func (c Config) RefreshAPIKey() (string, error) {
+	switch c.APIKeySource {
+	case APIKeySourceSecretsManager:
+		return apiKeyFromSecretsManagerAPI(c.loader.getenv("HONEYCOMB_API_KEY_SECRET_ARN"))
+	case APIKeySourceSSM:
+		return apiKeyFromSSMAPI(c.loader.getenv("HONEYCOMB_API_KEY_SSM_PARAMETER"))
+	default:
+		return "", fmt.Errorf("an API key from %s can't be refreshed", c.APIKeySource)
+	}
+}
+
+// apiKeySourceFromEnv returns where getApiKey finds the API key
+func (l *configLoader) apiKeySourceFromEnv() APIKeySource {
+	switch {
+	case l.getenv("HONEYCOMB_API_KEY_SECRET_ARN") != "":
+		return APIKeySourceSecretsManager
+	case l.getenv("HONEYCOMB_API_KEY_SSM_PARAMETER") != "":
+		return APIKeySourceSSM
+	case l.getenv("KMS_KEY_ID") != "":
+		return APIKeySourceKMS
+	default:
+		return APIKeySourceEnvironment
+	}
+}
+
+// awsSession returns a session for calling AWS in the function's region
+func awsSession() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_REGION")),
+	}))
+}
+
+// apiKeyFromSecretsManager fetches the API key from the Secrets Manager secret
+// with the given ARN or name, from the Parameters and Secrets extension's
+// cache if it's running, or from Secrets Manager otherwise.
+func (l *configLoader) apiKeyFromSecretsManager(secretID string) (string, error) {
+	var secret secretsmanager.GetSecretValueOutput
+	err := l.getFromParametersSecretsCache("/secretsmanager/get", url.Values{"secretId": {secretID}}, &secret)
+	if err != nil {
+		log.Debugf("Unable to fetch secret from the Parameters and Secrets extension, fetching it from Secrets Manager: %v", err)
+		return apiKeyFromSecretsManagerAPI(secretID)
+	}
+	return secretAPIKey(&secret)
+}
+
+// apiKeyFromSecretsManagerAPI fetches the API key from the Secrets Manager
+// secret with the given ARN or name, straight from Secrets Manager
+func apiKeyFromSecretsManagerAPI(secretID string) (string, error) {
+	secret, err := secretsManagerGetFunc(secretsmanager.New(awsSession()), &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return "", err
+	}
+	return secretAPIKey(secret)
+}
+
+// secretAPIKey returns the API key held by secret
+func secretAPIKey(secret *secretsmanager.GetSecretValueOutput) (string, error) {
+	apiKey := string(secret.SecretBinary)
+	if secret.SecretString != nil {
+		apiKey = *secret.SecretString
+	}
+	return nonEmptyAPIKey(apiKey)
+}
+
+// apiKeyFromSSM fetches the API key from the SSM parameter with the given name
+// or ARN, decrypting it if it's a SecureString, from the Parameters and
+// Secrets extension's cache if it's running, or from SSM otherwise.
+func (l *configLoader) apiKeyFromSSM(name string) (string, error) {
+	var parameter ssm.GetParameterOutput
+	err := l.getFromParametersSecretsCache("/systemsmanager/parameters/get", url.Values{"name": {name}, "withDecryption": {"true"}}, &parameter)
+	if err != nil {
+		log.Debugf("Unable to fetch parameter from the Parameters and Secrets extension, fetching it from SSM: %v", err)
+		return apiKeyFromSSMAPI(name)
+	}
+	return parameterAPIKey(&parameter)
+}
+
+// apiKeyFromSSMAPI fetches the API key from the SSM parameter with the given
+// name or ARN, decrypting it if it's a SecureString, straight from SSM
+func apiKeyFromSSMAPI(name string) (string, error) {
+	parameter, err := ssmGetParameterFunc(ssm.New(awsSession()), &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return parameterAPIKey(parameter)
+}
+
+// parameterAPIKey returns the API key held by parameter
+func parameterAPIKey(parameter *ssm.GetParameterOutput) (string, error) {
+	if parameter.Parameter == nil {
+		return "", errors.New("no parameter returned")
+	}
+	return nonEmptyAPIKey(aws.StringValue(parameter.Parameter.Value))
+}
+
+// nonEmptyAPIKey returns apiKey without surrounding whitespace, or an error if
+// that leaves nothing
+func nonEmptyAPIKey(apiKey string) (string, error) {
+	apiKey = strings.TrimSpace(apiKey)
+	if apiKey == "" {
+		return "", errors.New("the API key is empty")
+	}
+	return apiKey, nil
+}
+
+// parametersSecretsEndpoint returns the base URL of the Parameters and Secrets
+// extension's cache, which HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT overrides
+func (l *configLoader) parametersSecretsEndpoint() string {
+	if endpoint := l.getenv("HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	return "http://localhost:" + l.envOrElse("PARAMETERS_SECRETS_EXTENSION_HTTP_PORT", defaultParametersSecretsPort)
+}
+
+// getFromParametersSecretsCache requests path from the Parameters and Secrets
+// extension's cache and decodes the response into out. Its responses have the
+// same shape as the AWS API's.
+func (l *configLoader) getFromParametersSecretsCache(path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, l.parametersSecretsEndpoint()+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(parametersSecretsTokenHeader, os.Getenv("AWS_SESSION_TOKEN"))
+
+	client := &http.Client{Timeout: parametersSecretsTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
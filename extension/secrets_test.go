@@ -0,0 +1,264 @@
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/stretchr/testify/assert"
+)
+
+// parametersSecretsHandler stands in for the Parameters and Secrets extension's
+// cache, serving secrets and parameters to callers with the session token
+type parametersSecretsHandler struct {
+	secrets    map[string]string
+	parameters map[string]string
+}
+
+func (h *parametersSecretsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(parametersSecretsTokenHeader) != "test-session-token" {
+		http.Error(w, "missing session token", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/secretsmanager/get":
+		secret, ok := h.secrets[r.URL.Query().Get("secretId")]
+		if !ok {
+			http.Error(w, "secret not found", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"Name": "honeycomb", "SecretString": %q}`, secret)
+	case "/systemsmanager/parameters/get":
+		parameter, ok := h.parameters[r.URL.Query().Get("name")]
+		if !ok || r.URL.Query().Get("withDecryption") != "true" {
+			http.Error(w, "parameter not found", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"Parameter": {"Name": "honeycomb", "Type": "SecureString", "Value": %q}}`, parameter)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_GetApiKeyFromSecretsManagerOrSSM(t *testing.T) {
+	cache := httptest.NewServer(&parametersSecretsHandler{
+		secrets:    map[string]string{"test-secret": "secret-api-key\n", "empty-secret": ""},
+		parameters: map[string]string{"/test/parameter": "parameter-api-key"},
+	})
+	defer cache.Close()
+	unavailable := httptest.NewServer(http.NotFoundHandler())
+	unavailable.Close()
+
+	originalSecretsManagerGetFunc := secretsManagerGetFunc
+	originalSSMGetParameterFunc := ssmGetParameterFunc
+	defer func() {
+		secretsManagerGetFunc = originalSecretsManagerGetFunc
+		ssmGetParameterFunc = originalSSMGetParameterFunc
+	}()
+	secretsManagerGetFunc = func(svc *secretsmanager.SecretsManager, input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+		if aws.StringValue(input.SecretId) != "test-secret" {
+			return nil, errors.New("ResourceNotFoundException")
+		}
+		return &secretsmanager.GetSecretValueOutput{SecretBinary: []byte("sdk-secret-api-key")}, nil
+	}
+	ssmGetParameterFunc = func(svc *ssm.SSM, input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+		if aws.StringValue(input.Name) != "/test/parameter" || !aws.BoolValue(input.WithDecryption) {
+			return nil, errors.New("ParameterNotFound")
+		}
+		return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String("sdk-parameter-api-key")}}, nil
+	}
+
+	testCases := []struct {
+		desc          string
+		endpoint      string
+		secretARN     string
+		ssmParameter  string
+		expectedValue string
+		expectError   string
+	}{
+		{
+			desc:          "secret from the cache",
+			endpoint:      cache.URL,
+			secretARN:     "test-secret",
+			expectedValue: "secret-api-key",
+		},
+		{
+			desc:          "parameter from the cache",
+			endpoint:      cache.URL,
+			ssmParameter:  "/test/parameter",
+			expectedValue: "parameter-api-key",
+		},
+		{
+			desc:          "secret preferred over parameter",
+			endpoint:      cache.URL,
+			secretARN:     "test-secret",
+			ssmParameter:  "/test/parameter",
+			expectedValue: "secret-api-key",
+		},
+		{
+			desc:          "secret from Secrets Manager without the cache",
+			endpoint:      unavailable.URL,
+			secretARN:     "test-secret",
+			expectedValue: "sdk-secret-api-key",
+		},
+		{
+			desc:          "parameter from SSM without the cache",
+			endpoint:      unavailable.URL,
+			ssmParameter:  "/test/parameter",
+			expectedValue: "sdk-parameter-api-key",
+		},
+		{
+			desc:        "secret not found",
+			endpoint:    cache.URL,
+			secretARN:   "missing-secret",
+			expectError: ErrorTypeAPIKeyFetch,
+		},
+		{
+			desc:         "parameter not found",
+			endpoint:     unavailable.URL,
+			ssmParameter: "/missing/parameter",
+			expectError:  ErrorTypeAPIKeyFetch,
+		},
+		{
+			desc:        "empty secret",
+			endpoint:    cache.URL,
+			secretARN:   "empty-secret",
+			expectError: ErrorTypeAPIKeyFetch,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("AWS_SESSION_TOKEN", "test-session-token")
+			t.Setenv("HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT", tC.endpoint)
+			t.Setenv("HONEYCOMB_API_KEY_SECRET_ARN", tC.secretARN)
+			t.Setenv("HONEYCOMB_API_KEY_SSM_PARAMETER", tC.ssmParameter)
+			t.Setenv("LIBHONEY_API_KEY", "env-api-key")
+
+			apiKey, err := new(configLoader).getApiKey()
+			if tC.expectError != "" {
+				assert.Empty(t, apiKey, "Expected empty API key due to error condition")
+				var configErr *ConfigError
+				if assert.ErrorAs(t, err, &configErr) {
+					assert.Equal(t, tC.expectError, configErr.Type)
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tC.expectedValue, apiKey)
+			}
+		})
+	}
+}
+
+func Test_RefreshAPIKey(t *testing.T) {
+	cache := httptest.NewServer(&parametersSecretsHandler{
+		secrets:    map[string]string{"test-secret": "cached-api-key"},
+		parameters: map[string]string{"/test/parameter": "cached-api-key"},
+	})
+	defer cache.Close()
+	t.Setenv("AWS_SESSION_TOKEN", "test-session-token")
+	t.Setenv("HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT", cache.URL)
+
+	originalSecretsManagerGetFunc := secretsManagerGetFunc
+	originalSSMGetParameterFunc := ssmGetParameterFunc
+	defer func() {
+		secretsManagerGetFunc = originalSecretsManagerGetFunc
+		ssmGetParameterFunc = originalSSMGetParameterFunc
+	}()
+	secretsManagerGetFunc = func(svc *secretsmanager.SecretsManager, input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+		return &secretsmanager.GetSecretValueOutput{SecretString: aws.String("rotated-secret-api-key")}, nil
+	}
+	ssmGetParameterFunc = func(svc *ssm.SSM, input *ssm.GetParameterInput) (*ssm.GetParameterOutput, error) {
+		return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String("rotated-parameter-api-key")}}, nil
+	}
+
+	testCases := []struct {
+		desc          string
+		env           map[string]string
+		expectedValue string
+		expectError   bool
+	}{
+		{
+			desc:          "secret",
+			env:           map[string]string{"HONEYCOMB_API_KEY_SECRET_ARN": "test-secret"},
+			expectedValue: "rotated-secret-api-key",
+		},
+		{
+			desc:          "parameter",
+			env:           map[string]string{"HONEYCOMB_API_KEY_SSM_PARAMETER": "/test/parameter"},
+			expectedValue: "rotated-parameter-api-key",
+		},
+		{
+			desc:        "kms",
+			env:         map[string]string{"LIBHONEY_API_KEY": "ciphertext", "KMS_KEY_ID": "test-key"},
+			expectError: true,
+		},
+		{
+			desc:        "environment",
+			env:         map[string]string{"LIBHONEY_API_KEY": "test-api-key"},
+			expectError: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			l := &configLoader{fileSettings: tC.env}
+			config := Config{APIKeySource: l.apiKeySourceFromEnv(), loader: l}
+
+			apiKey, err := config.RefreshAPIKey()
+			if tC.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.expectedValue, apiKey, "expected the key to be fetched past the cache")
+		})
+	}
+}
+
+func Test_ParametersSecretsEndpoint(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		endpoint string
+		port     string
+		expected string
+	}{
+		{desc: "default", expected: "http://localhost:2773"},
+		{desc: "extension port", port: "8080", expected: "http://localhost:8080"},
+		{desc: "overridden", endpoint: "http://127.0.0.1:9999/", port: "8080", expected: "http://127.0.0.1:9999"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("HONEYCOMB_PARAMETERS_SECRETS_ENDPOINT", tC.endpoint)
+			t.Setenv("PARAMETERS_SECRETS_EXTENSION_HTTP_PORT", tC.port)
+			assert.Equal(t, tC.expected, new(configLoader).parametersSecretsEndpoint())
+		})
+	}
+}
+
+func Test_APIKeySourceFromEnv(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		secretARN    string
+		ssmParameter string
+		kmsKeyID     string
+		expected     APIKeySource
+	}{
+		{desc: "plaintext", expected: APIKeySourceEnvironment},
+		{desc: "kms", kmsKeyID: "some-key-id", expected: APIKeySourceKMS},
+		{desc: "ssm", ssmParameter: "/test/parameter", kmsKeyID: "some-key-id", expected: APIKeySourceSSM},
+		{desc: "secrets manager", secretARN: "test-secret", ssmParameter: "/test/parameter", expected: APIKeySourceSecretsManager},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("HONEYCOMB_API_KEY_SECRET_ARN", tC.secretARN)
+			t.Setenv("HONEYCOMB_API_KEY_SSM_PARAMETER", tC.ssmParameter)
+			t.Setenv("KMS_KEY_ID", tC.kmsKeyID)
+			assert.Equal(t, tC.expected, new(configLoader).apiKeySourceFromEnv())
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ErrorTypeInvalidConfig is reported to the Extensions API when strict
+// configuration is enabled and Config.Validate finds problems.
+const ErrorTypeInvalidConfig = "Extension.InvalidConfig"
+
+// The Telemetry API only accepts buffering options within these limits
+const (
+	minTelemetryTimeoutMS = 25
+	maxTelemetryTimeoutMS = 30000
+	minTelemetryMaxBytes  = 262144
+	maxTelemetryMaxBytes  = 1048576
+	minTelemetryMaxItems  = 1000
+	maxTelemetryMaxItems  = 10000
+)
+
+// redacted stands in for secrets in Summary
+const redacted = "[redacted]"
+
+// warnInvalidSetting logs a setting that can't be used, and records it to be
+// returned by Config.Validate
+func (l *configLoader) warnInvalidSetting(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Warn(msg)
+	if l != nil {
+		l.invalid = append(l.invalid, errors.New(msg))
+	}
+}
+
+// Validate returns every problem with the configuration at once, joined into
+// one error, or nil if there are none. Problems include settings that
+// couldn't be parsed and fell back on their defaults, invalid settings in the
+// config file, and values outside the limits the Telemetry API and the
+// extension accept.
+func (c Config) Validate() error {
+	_, err := c.corrected()
+	return err
+}
+
+// Corrected returns the config with every value found by Validate to be
+// outside its limits brought within them: values with a range are clamped to
+// it, and others are replaced by their defaults. URLs and addresses that
+// aren't valid are left as they are.
+func (c Config) Corrected() Config {
+	corrected, _ := c.corrected()
+	return corrected
+}
+
+// corrected returns the config as Corrected does, and the problems found as
+// Validate does
+func (c Config) corrected() (Config, error) {
+	var errs []error
+	if c.configFileErr != nil {
+		errs = append(errs, c.configFileErr)
+	}
+	if c.loader != nil {
+		errs = append(errs, c.loader.invalid...)
+	}
+
+	inRange := func(key string, value *int, lo, hi int) {
+		if *value < lo || *value > hi {
+			errs = append(errs, fmt.Errorf("%s is %d, but must be between %d and %d", key, *value, lo, hi))
+			*value = min(max(*value, lo), hi)
+		}
+	}
+	atLeast := func(key string, value *int, lo, fallback int) {
+		if *value < lo {
+			errs = append(errs, fmt.Errorf("%s is %d, but must be at least %d", key, *value, lo))
+			*value = fallback
+		}
+	}
+	positive := func(key string, value *time.Duration, fallback time.Duration) {
+		if *value <= 0 {
+			errs = append(errs, fmt.Errorf("%s is %s, but must be more than 0", key, *value))
+			*value = fallback
+		}
+	}
+	notNegative := func(key string, value *time.Duration) {
+		if *value < 0 {
+			errs = append(errs, fmt.Errorf("%s is %s, but must not be negative", key, *value))
+			*value = 0
+		}
+	}
+	isURL := func(key, value string) {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s is '%s', but must be an http or https URL", key, value))
+		}
+	}
+
+	inRange("LOGS_API_TIMEOUT_MS", &c.LogsAPITimeoutMS, minTelemetryTimeoutMS, maxTelemetryTimeoutMS)
+	inRange("LOGS_API_MAX_BYTES", &c.LogsAPIMaxBytes, minTelemetryMaxBytes, maxTelemetryMaxBytes)
+	inRange("LOGS_API_MAX_ITEMS", &c.LogsAPIMaxItems, minTelemetryMaxItems, maxTelemetryMaxItems)
+
+	positive("HONEYCOMB_BATCH_SEND_TIMEOUT", &c.BatchSendTimeout, defaultBatchSendTimeout)
+	positive("HONEYCOMB_CONNECT_TIMEOUT", &c.ConnectTimeout, defaultConnectTimeout)
+	positive("HONEYCOMB_FLUSH_INTERVAL", &c.FlushInterval, defaultFlushInterval)
+	atLeast("HONEYCOMB_FLUSH_MAX_BYTES", &c.FlushMaxBytes, 0, defaultFlushMaxBytes)
+	atLeast("HONEYCOMB_FLUSH_EVERY_INVOCATIONS", &c.FlushEveryInvocations, 0, defaultFlushEveryInvocations)
+	notNegative("HONEYCOMB_POST_INVOKE_TIMEOUT", &c.PostInvokeTimeout)
+	notNegative("HONEYCOMB_FLUSH_MIN_REMAINING", &c.FlushMinRemaining)
+	atLeast("HONEYCOMB_QUEUE_MAX_BYTES", &c.QueueMaxBytes, 1, queueMaxBytesForMemory(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE")))
+	if c.SpoolEnabled {
+		atLeast("HONEYCOMB_SPOOL_MAX_BYTES", &c.SpoolMaxBytes, 1, defaultSpoolMaxBytes)
+		positive("HONEYCOMB_SPOOL_MAX_AGE", &c.SpoolMaxAge, defaultSpoolMaxAge)
+	}
+	atLeast("HONEYCOMB_RETRY_MAX_ATTEMPTS", &c.RetryMaxAttempts, 1, defaultRetryMaxAttempts)
+	if c.RetryMaxAttempts > 1 {
+		positive("HONEYCOMB_RETRY_INITIAL_BACKOFF", &c.RetryInitialBackoff, defaultRetryInitialBackoff)
+		positive("HONEYCOMB_RETRY_BUDGET", &c.RetryBudget, defaultRetryBudget)
+		if c.RetryMaxBackoff < c.RetryInitialBackoff {
+			errs = append(errs, fmt.Errorf("HONEYCOMB_RETRY_MAX_BACKOFF is %s, but must be at least HONEYCOMB_RETRY_INITIAL_BACKOFF (%s)", c.RetryMaxBackoff, c.RetryInitialBackoff))
+			c.RetryMaxBackoff = c.RetryInitialBackoff
+		}
+	}
+	if c.RetryJitter < 0 || c.RetryJitter > 1 {
+		errs = append(errs, fmt.Errorf("HONEYCOMB_RETRY_JITTER is %g, but must be between 0 and 1", c.RetryJitter))
+		c.RetryJitter = min(max(c.RetryJitter, 0), 1)
+	}
+	atLeast("HONEYCOMB_CIRCUIT_BREAKER_THRESHOLD", &c.CircuitBreakerThreshold, 0, defaultCircuitBreakerThreshold)
+	if c.CircuitBreakerThreshold > 0 {
+		positive("HONEYCOMB_CIRCUIT_BREAKER_COOLDOWN", &c.CircuitBreakerCooldown, defaultCircuitBreakerCooldown)
+	}
+	notNegative("HONEYCOMB_SELF_TELEMETRY_INTERVAL", &c.SelfTelemetryInterval)
+
+	if c.APIHost != "" {
+		isURL("LIBHONEY_API_HOST", c.APIHost)
+	}
+	for _, destination := range c.Destinations {
+		if destination.APIHost != "" {
+			isURL(fmt.Sprintf("apiHost of destination %s", destination.Name), destination.APIHost)
+		}
+	}
+	if c.Backend == BackendOTLP {
+		isURL("HONEYCOMB_OTLP_ENDPOINT", c.OTLPEndpoint)
+	}
+	if c.Backend == BackendSyslog && c.SyslogAddress == "" {
+		errs = append(errs, errors.New("HONEYCOMB_SYSLOG_ADDRESS must be set with the syslog backend"))
+	}
+	if c.SyslogAddress != "" {
+		if _, _, err := net.SplitHostPort(c.SyslogAddress); err != nil {
+			errs = append(errs, fmt.Errorf("HONEYCOMB_SYSLOG_ADDRESS is '%s', but must be a host and port: %w", c.SyslogAddress, err))
+		}
+		atLeast("HONEYCOMB_SYSLOG_BATCH_SIZE", &c.SyslogBatchSize, 1, defaultSyslogBatchSize)
+	}
+	return c, errors.Join(errs...)
+}
+
+// Summary returns the effective configuration, keyed as in the config file,
+// for logging at startup. Secrets, such as API keys and OTLP header values,
+// are redacted.
+func (c Config) Summary() map[string]interface{} {
+	summary := map[string]interface{}{
+		"configFile":                         c.ConfigFile,
+		"strictConfig":                       c.StrictConfig,
+		"apiKey":                             redact(c.APIKey),
+		"apiKeySource":                       c.APIKeySource,
+		"dataset":                            c.Dataset,
+		"apiHost":                            c.APIHost,
+		"debug":                              c.Debug,
+		"validateApiKey":                     c.ValidateAPIKey,
+		"failOnInitError":                    c.FailOnInitError,
+		"exitOnAuthFailure":                  c.ExitOnAuthFailure,
+		"telemetryApi.timeoutMs":             c.LogsAPITimeoutMS,
+		"telemetryApi.maxBytes":              c.LogsAPIMaxBytes,
+		"telemetryApi.maxItems":              c.LogsAPIMaxItems,
+		"telemetryApi.disablePlatformEvents": c.LogsAPIDisablePlatformMessages,
+		"batchSendTimeout":                   c.BatchSendTimeout.String(),
+		"connectTimeout":                     c.ConnectTimeout.String(),
+		"postInvokeTimeout":                  c.PostInvokeTimeout.String(),
+		"flush.strategy":                     c.FlushStrategy,
+		"flush.interval":                     c.FlushInterval.String(),
+		"flush.maxBytes":                     c.FlushMaxBytes,
+		"flush.everyInvocations":             c.FlushEveryInvocations,
+		"flush.minRemaining":                 c.FlushMinRemaining.String(),
+		"queue.maxBytes":                     c.QueueMaxBytes,
+		"queue.policy":                       c.QueuePolicy,
+		"spool.enabled":                      c.SpoolEnabled,
+		"retry.maxAttempts":                  c.RetryMaxAttempts,
+		"retry.initialBackoff":               c.RetryInitialBackoff.String(),
+		"retry.maxBackoff":                   c.RetryMaxBackoff.String(),
+		"retry.jitter":                       c.RetryJitter,
+		"retry.budget":                       c.RetryBudget.String(),
+		"circuitBreaker.threshold":           c.CircuitBreakerThreshold,
+		"circuitBreaker.cooldown":            c.CircuitBreakerCooldown.String(),
+		"selfTelemetry.enabled":              c.SelfTelemetryEnabled,
+		"backend":                            c.Backend,
+	}
+	if c.SpoolEnabled {
+		summary["spool.dir"] = c.SpoolDir
+		summary["spool.maxBytes"] = c.SpoolMaxBytes
+		summary["spool.maxAge"] = c.SpoolMaxAge.String()
+		summary["spool.compress"] = c.SpoolCompress
+	}
+	if c.SelfTelemetryEnabled {
+		summary["selfTelemetry.dataset"] = c.SelfTelemetryDataset
+		summary["selfTelemetry.interval"] = c.SelfTelemetryInterval.String()
+	}
+	if len(c.Destinations) > 0 {
+		destinations := make([]string, 0, len(c.Destinations))
+		for _, destination := range c.Destinations {
+			destinations = append(destinations, destination.Name+":"+destination.Dataset)
+		}
+		summary["destinations"] = destinations
+	}
+	if c.BackendFile != "" {
+		summary["backendFile"] = c.BackendFile
+	}
+	if c.Backend == BackendOTLP {
+		headers := make(map[string]string, len(c.OTLPHeaders))
+		for name := range c.OTLPHeaders {
+			headers[name] = redacted
+		}
+		summary["otlp.endpoint"] = c.OTLPEndpoint
+		summary["otlp.headers"] = headers
+	}
+	if c.SyslogAddress != "" {
+		summary["syslog.address"] = c.SyslogAddress
+		summary["syslog.tls"] = c.SyslogTLS
+		summary["syslog.caFile"] = c.SyslogCAFile
+		summary["syslog.batchSize"] = c.SyslogBatchSize
+		summary["syslog.structuredDataId"] = c.SyslogStructuredDataID
+	}
+	return summary
+}
+
+// redact returns redacted in place of a secret, or an empty string if the
+// secret isn't set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,234 @@
+package extension
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Validate(t *testing.T) {
+	t.Setenv("LIBHONEY_API_KEY", "test-api-key")
+	defaults := NewConfigFromEnvironment()
+
+	testCases := []struct {
+		desc           string
+		configure      func(c *Config)
+		expectedErrors []string
+	}{
+		{
+			desc:      "defaults",
+			configure: func(c *Config) {},
+		},
+		{
+			desc: "outside Telemetry API limits",
+			configure: func(c *Config) {
+				c.LogsAPITimeoutMS = 10
+				c.LogsAPIMaxBytes = 2 << 20
+				c.LogsAPIMaxItems = 100
+			},
+			expectedErrors: []string{
+				"LOGS_API_TIMEOUT_MS is 10, but must be between 25 and 30000",
+				"LOGS_API_MAX_BYTES is 2097152, but must be between 262144 and 1048576",
+				"LOGS_API_MAX_ITEMS is 100, but must be between 1000 and 10000",
+			},
+		},
+		{
+			desc: "retries",
+			configure: func(c *Config) {
+				c.RetryMaxBackoff = time.Millisecond
+				c.RetryJitter = 1.5
+			},
+			expectedErrors: []string{
+				"HONEYCOMB_RETRY_MAX_BACKOFF is 1ms, but must be at least HONEYCOMB_RETRY_INITIAL_BACKOFF (100ms)",
+				"HONEYCOMB_RETRY_JITTER is 1.5, but must be between 0 and 1",
+			},
+		},
+		{
+			desc: "retries turned off",
+			configure: func(c *Config) {
+				c.RetryMaxAttempts = 1
+				c.RetryMaxBackoff = 0
+			},
+		},
+		{
+			desc: "waiting turned off",
+			configure: func(c *Config) {
+				c.PostInvokeTimeout = 0
+				c.FlushMinRemaining = 0
+			},
+		},
+		{
+			desc: "flushing and the queue",
+			configure: func(c *Config) {
+				c.FlushInterval = 0
+				c.FlushEveryInvocations = -1
+				c.QueueMaxBytes = 0
+			},
+			expectedErrors: []string{
+				"HONEYCOMB_FLUSH_INTERVAL is 0s, but must be more than 0",
+				"HONEYCOMB_FLUSH_EVERY_INVOCATIONS is -1, but must be at least 0",
+				"HONEYCOMB_QUEUE_MAX_BYTES is 0, but must be at least 1",
+			},
+		},
+		{
+			desc: "URLs",
+			configure: func(c *Config) {
+				c.APIHost = "api.honeycomb.io"
+				c.Destinations = []Destination{{Name: "security", APIHost: "ftp://example.com"}}
+				c.Backend = BackendOTLP
+				c.OTLPEndpoint = "https://"
+			},
+			expectedErrors: []string{
+				"LIBHONEY_API_HOST is 'api.honeycomb.io', but must be an http or https URL",
+				"apiHost of destination security is 'ftp://example.com', but must be an http or https URL",
+				"HONEYCOMB_OTLP_ENDPOINT is 'https://', but must be an http or https URL",
+			},
+		},
+		{
+			desc: "syslog backend without an address",
+			configure: func(c *Config) {
+				c.Backend = BackendSyslog
+			},
+			expectedErrors: []string{"HONEYCOMB_SYSLOG_ADDRESS must be set with the syslog backend"},
+		},
+		{
+			desc: "syslog address without a port",
+			configure: func(c *Config) {
+				c.SyslogAddress = "siem.example.com"
+			},
+			expectedErrors: []string{"HONEYCOMB_SYSLOG_ADDRESS is 'siem.example.com', but must be a host and port: address siem.example.com: missing port in address"},
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config := defaults
+			tC.configure(&config)
+			assert.Equal(t, tC.expectedErrors, validationErrors(config.Validate()))
+		})
+	}
+}
+
+func Test_Corrected(t *testing.T) {
+	t.Setenv("LIBHONEY_API_KEY", "test-api-key")
+	defaults := NewConfigFromEnvironment()
+
+	testCases := []struct {
+		desc         string
+		configure    func(c *Config)
+		expected     func(c *Config)
+		stillInvalid bool
+	}{
+		{
+			desc:      "valid values are kept",
+			configure: func(c *Config) { c.LogsAPITimeoutMS = 500 },
+			expected:  func(c *Config) { c.LogsAPITimeoutMS = 500 },
+		},
+		{
+			desc: "values with a range are clamped to it",
+			configure: func(c *Config) {
+				c.LogsAPITimeoutMS = 5
+				c.LogsAPIMaxBytes = 2 << 20
+				c.LogsAPIMaxItems = 100
+				c.RetryJitter = 1.5
+				c.RetryMaxBackoff = time.Millisecond
+			},
+			expected: func(c *Config) {
+				c.LogsAPITimeoutMS = 25
+				c.LogsAPIMaxBytes = 1048576
+				c.LogsAPIMaxItems = 1000
+				c.RetryJitter = 1
+				c.RetryMaxBackoff = 100 * time.Millisecond
+			},
+		},
+		{
+			desc: "other values are replaced by their defaults",
+			configure: func(c *Config) {
+				c.FlushInterval = -time.Second
+				c.QueueMaxBytes = 0
+				c.RetryMaxAttempts = 0
+				c.PostInvokeTimeout = -time.Second
+			},
+			expected: func(c *Config) {
+				c.FlushInterval = defaultFlushInterval
+				c.QueueMaxBytes = queueMaxBytesForMemory("")
+				c.RetryMaxAttempts = defaultRetryMaxAttempts
+				c.PostInvokeTimeout = 0
+			},
+		},
+		{
+			desc:         "URLs are left as they are",
+			configure:    func(c *Config) { c.APIHost = "api.honeycomb.io" },
+			expected:     func(c *Config) { c.APIHost = "api.honeycomb.io" },
+			stillInvalid: true,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			config, expected := defaults, defaults
+			tC.configure(&config)
+			tC.expected(&expected)
+			corrected := config.Corrected()
+			assert.Equal(t, expected, corrected)
+			if !tC.stillInvalid {
+				assert.NoError(t, corrected.Validate())
+			}
+		})
+	}
+}
+
+func Test_ValidateReportsInvalidSettings(t *testing.T) {
+	t.Setenv("LIBHONEY_API_KEY", "test-api-key")
+	t.Setenv("LOGS_API_TIMEOUT_MS", "5")
+	t.Setenv("HONEYCOMB_FLUSH_STRATEGY", "eventually")
+	t.Setenv("HONEYCOMB_CONNECT_TIMEOUT", "0")
+	t.Setenv("HONEYCOMB_SELF_TELEMETRY_INTERVAL", "0")
+
+	config := NewConfigFromEnvironment()
+
+	assert.Equal(t, []string{
+		"HONEYCOMB_CONNECT_TIMEOUT was set to '0', which is an unusable duration for the extension. Falling back to default of 3s.",
+		"HONEYCOMB_FLUSH_STRATEGY was set to 'eventually', but must be one of 'sync' or 'async'. Falling back to default of sync.",
+		"LOGS_API_TIMEOUT_MS is 5, but must be between 25 and 30000",
+	}, validationErrors(config.Validate()))
+
+	t.Setenv("LOGS_API_TIMEOUT_MS", "500")
+	t.Setenv("HONEYCOMB_FLUSH_STRATEGY", "async")
+	t.Setenv("HONEYCOMB_CONNECT_TIMEOUT", "1s")
+	assert.NoError(t, NewConfigFromEnvironment().Validate(), "expected problems from an earlier config to be forgotten")
+}
+
+func Test_Summary(t *testing.T) {
+	config := Config{
+		APIKey:        "test-api-key",
+		Dataset:       "test-dataset",
+		FlushInterval: time.Second,
+		Backend:       BackendOTLP,
+		OTLPEndpoint:  "https://api.honeycomb.io",
+		OTLPHeaders:   map[string]string{"x-honeycomb-team": "another-api-key"},
+		Destinations:  []Destination{{Name: "security", APIKey: "security-api-key", Dataset: "audit"}},
+	}
+
+	summary := config.Summary()
+
+	assert.Equal(t, "[redacted]", summary["apiKey"])
+	assert.Equal(t, "test-dataset", summary["dataset"])
+	assert.Equal(t, "1s", summary["flush.interval"])
+	assert.Equal(t, map[string]string{"x-honeycomb-team": "[redacted]"}, summary["otlp.headers"])
+	assert.Equal(t, []string{"security:audit"}, summary["destinations"])
+	assert.NotContains(t, summary, "syslog.address")
+	assert.Equal(t, "", Config{}.Summary()["apiKey"], "expected a missing API key to be shown as missing")
+}
+
+// validationErrors returns the messages of the errors joined in err
+func validationErrors(err error) []string {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return nil
+	}
+	var msgs []string
+	for _, e := range joined.Unwrap() {
+		msgs = append(msgs, e.Error())
+	}
+	return msgs
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"os"
 	"os/signal"
@@ -13,12 +14,14 @@ import (
 	"github.com/honeycombio/honeycomb-lambda-extension/eventprocessor"
 	"github.com/honeycombio/honeycomb-lambda-extension/eventpublisher"
 	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
 	"github.com/honeycombio/honeycomb-lambda-extension/telemetryapi"
 )
 
 var (
-	version string           // Fed in at build with -ldflags "-X main.version=<value>"
-	config  extension.Config // Honeycomb extension configuration
+	version   string           // Fed in at build with -ldflags "-X main.version=<value>"
+	config    extension.Config // Honeycomb extension configuration
+	configErr error            // problems with the configuration, as found by config.Validate
 
 	// extension API configuration
 	extensionName = filepath.Base(os.Args[0])
@@ -39,12 +42,18 @@ func init() {
 	}
 
 	config = extension.NewConfigFromEnvironment()
+	configErr = config.Validate()
+	if configErr != nil && !config.StrictConfig {
+		config = config.Corrected()
+	}
 
 	logLevel := logrus.InfoLevel
 	if config.Debug {
 		logLevel = logrus.DebugLevel
 	}
 	logrus.SetLevel(logLevel)
+
+	log.WithFields(logrus.Fields(config.Summary())).Info("Effective configuration")
 }
 
 func main() {
@@ -63,13 +72,19 @@ func main() {
 	}()
 
 	// initialize event publisher client
-	eventpublisherClient, err := eventpublisher.New(config, version)
+	eventpublisherClient, err := newPublisher()
 	if err != nil {
 		log.Warn("Could not initialize event publisher", err)
 	}
 
+	// track invocations as the Telemetry API reports them
+	invocationTracker := eventprocessor.NewInvocationTracker()
+
 	// initialize Telemetry API HTTP server
-	go telemetryapi.StartTelemetryReceiver(config.LogsReceiverPort, eventpublisherClient)
+	receiver, err := telemetryapi.StartTelemetryReceiver(ctx, config.LogsReceiverPort, eventpublisherClient, invocationTracker)
+	if err != nil {
+		log.Fatal("Could not start Telemetry API receiver: ", err)
+	}
 
 	// if running in localMode, wait on the context to be cancelled,
 	// then early return main() to end the process
@@ -82,6 +97,10 @@ func main() {
 
 	// --- Lambda Runtime Activity ---
 
+	// check the API key with Honeycomb while registering, so that it only adds
+	// to init if init waits on it to fail
+	authResults := checkAPIKey(ctx, receiver)
+
 	// register with Extensions API
 	extensionClient := extension.NewClient(config.RuntimeAPI, extensionName)
 	res, err := extensionClient.Register(ctx, config.IsManagedInstances)
@@ -90,12 +109,126 @@ func main() {
 	}
 	log.Debug("Response from register: ", res)
 
+	if configErr != nil {
+		if config.StrictConfig {
+			reportInitError(ctx, extensionClient, extension.ErrorTypeInvalidConfig, configErr)
+			return
+		}
+		log.WithError(configErr).Warn("Configuration has problems, using defaults or the nearest allowed values in their place where possible")
+	}
+
+	if err := config.ConfigFileError(); err != nil {
+		if failInit(ctx, extensionClient, extension.ErrorTypeInvalidConfigFile, err) {
+			return
+		}
+	}
+
+	if err := config.APIKeyError(); err != nil && config.Backend == extension.BackendHoneycomb {
+		var configErr *extension.ConfigError
+		errorType := extension.ErrorTypeMissingAPIKey
+		if errors.As(err, &configErr) {
+			errorType = configErr.Type
+		}
+		if failInit(ctx, extensionClient, errorType, err) {
+			return
+		}
+	}
+
+	if authResults != nil && config.FailOnInitError {
+		if result := <-authResults; result.Status == eventpublisher.AuthStatusRejected {
+			if failInit(ctx, extensionClient, extension.ErrorTypeAPIKeyRejected, result.Err) {
+				return
+			}
+		}
+	}
+
 	// subscribe to Lambda telemetry streams
 	subscription, err := telemetryapi.Subscribe(ctx, config, extensionClient.ExtensionID)
 	if err != nil {
 		log.Warn("Could not subscribe to events: ", err)
+		if failInit(ctx, extensionClient, extension.ErrorTypeSubscribeFailed, err) {
+			return
+		}
 	}
 	log.Debug("Response from subscribe: ", subscription)
 
-	eventprocessor.New(extensionClient, eventpublisherClient).Run(ctx, cancel)
+	eventprocessor.New(config, extensionClient, eventpublisherClient, invocationTracker, receiver).Run(ctx, cancel)
+}
+
+// newPublisher returns the publisher for the configured backend, forwarding
+// events to syslog as well if a syslog address is set
+func newPublisher() (publisher.Publisher, error) {
+	backend, err := newBackend()
+	if err != nil || config.SyslogAddress == "" || config.Backend == extension.BackendSyslog {
+		return backend, err
+	}
+	forwarder, err := publisher.NewSyslog(config)
+	if err != nil {
+		log.Warn("Could not forward events to syslog: ", err)
+		return backend, nil
+	}
+	return publisher.NewTee(backend, forwarder), nil
+}
+
+// newBackend returns the publisher for the configured backend
+func newBackend() (publisher.Publisher, error) {
+	switch config.Backend {
+	case extension.BackendJSONLines:
+		writer, err := publisher.OpenWriter(config.BackendFile, config.Dataset)
+		if err != nil {
+			log.Warn("Could not open ", config.BackendFile, ", writing events to stdout: ", err)
+			writer = publisher.NewWriter(os.Stdout, config.Dataset)
+		}
+		return writer, nil
+	case extension.BackendOTLP:
+		return eventpublisher.NewOTLPExporter(config, version), nil
+	case extension.BackendSyslog:
+		forwarder, err := publisher.NewSyslog(config)
+		if err != nil {
+			log.Warn("Could not forward events to syslog, writing them to stdout: ", err)
+			return publisher.NewWriter(os.Stdout, config.Dataset), nil
+		}
+		return forwarder, nil
+	default:
+		return eventpublisher.New(config, version)
+	}
+}
+
+// checkAPIKey checks the API key with Honeycomb in the background, logging the
+// outcome and recording it on the platform.initReport event. The outcome is
+// also delivered on the returned channel, which is nil if the key isn't to be
+// checked.
+func checkAPIKey(ctx context.Context, receiver *telemetryapi.Receiver) <-chan eventpublisher.AuthResult {
+	if !config.ValidateAPIKey || config.Backend != extension.BackendHoneycomb || config.APIKey == "" {
+		return nil
+	}
+	results := make(chan eventpublisher.AuthResult, 1)
+	go func() {
+		result := eventpublisher.CheckAuth(ctx, config, version)
+		result.Log()
+		receiver.AddInitFields(result.Fields())
+		results <- result
+	}()
+	return results
+}
+
+// failInit reports a misconfiguration to the Extensions API as an init error
+// when the extension is configured to fail on init errors, and returns true if
+// the extension should exit. Otherwise the extension carries on, likely unable
+// to send events.
+func failInit(ctx context.Context, extensionClient *extension.Client, errorType string, err error) bool {
+	if !config.FailOnInitError {
+		return false
+	}
+	reportInitError(ctx, extensionClient, errorType, err)
+	return true
+}
+
+// reportInitError reports a misconfiguration to the Extensions API as an init
+// error, after which the extension should exit
+func reportInitError(ctx context.Context, extensionClient *extension.Client, errorType string, err error) {
+	log.WithError(err).Error("Extension misconfigured, reporting init error: ", errorType)
+	if initErr := extensionClient.InitError(ctx, errorType, err); initErr != nil {
+		log.WithError(initErr).Error("Could not report init error")
+	}
 }
@@ -0,0 +1,103 @@
+// Package metrics keeps counters and gauges describing the extension's own
+// behaviour, such as batches received and events dropped, so they can be
+// logged or reported as self-telemetry.
+package metrics
+
+import (
+	"sync"
+)
+
+// Registry holds named counters and gauges. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+	}
+}
+
+// Add adds delta to the named counter
+func (r *Registry) Add(name string, delta int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += delta
+}
+
+// Increment adds one to the named counter
+func (r *Registry) Increment(name string) {
+	r.Add(name, 1)
+}
+
+// Gauge sets the named gauge to value
+func (r *Registry) Gauge(name string, value int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = value
+}
+
+// Counter returns the current value of the named counter
+func (r *Registry) Counter(name string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[name]
+}
+
+// Snapshot returns the current value of every counter and gauge
+func (r *Registry) Snapshot() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	snapshot := make(map[string]int64, len(r.counters)+len(r.gauges))
+	for name, value := range r.counters {
+		snapshot[name] = value
+	}
+	for name, value := range r.gauges {
+		snapshot[name] = value
+	}
+	return snapshot
+}
+
+// Counters returns the current value of every counter
+func (r *Registry) Counters() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyValues(r.counters)
+}
+
+// Gauges returns the current value of every gauge
+func (r *Registry) Gauges() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return copyValues(r.gauges)
+}
+
+func copyValues(values map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(values))
+	for name, value := range values {
+		copied[name] = value
+	}
+	return copied
+}
+
+// Default is the registry the extension's packages record to
+var Default = NewRegistry()
+
+// Add adds delta to the named counter in the Default registry
+func Add(name string, delta int64) {
+	Default.Add(name, delta)
+}
+
+// Increment adds one to the named counter in the Default registry
+func Increment(name string) {
+	Default.Increment(name)
+}
+
+// Gauge sets the named gauge in the Default registry
+func Gauge(name string, value int64) {
+	Default.Gauge(name, value)
+}
@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Increment("things")
+			r.Add("bytes", 100)
+		}()
+	}
+	wg.Wait()
+	r.Gauge("depth", 3)
+	r.Gauge("depth", 2)
+
+	assert.Equal(t, int64(10), r.Counter("things"))
+	assert.Equal(t, map[string]int64{
+		"things": 10,
+		"bytes":  1000,
+		"depth":  2,
+	}, r.Snapshot())
+	assert.Equal(t, map[string]int64{"things": 10, "bytes": 1000}, r.Counters())
+	assert.Equal(t, map[string]int64{"depth": 2}, r.Gauges())
+}
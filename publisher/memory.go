@@ -0,0 +1,49 @@
+package publisher
+
+import "sync"
+
+// Memory is a Publisher that keeps every published event in memory, for tests
+type Memory struct {
+	mu      sync.Mutex
+	events  []*Event
+	flushes int
+}
+
+// NewMemory returns an empty Memory
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// NewEvent returns an empty event
+func (m *Memory) NewEvent() *Event {
+	return &Event{}
+}
+
+// Publish keeps ev, and never fails
+func (m *Memory) Publish(ev *Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, ev)
+	return nil
+}
+
+// Flush counts the flush, as there is nothing to send
+func (m *Memory) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushes++
+}
+
+// Events returns the events published so far, in the order they were published
+func (m *Memory) Events() []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Event(nil), m.events...)
+}
+
+// Flushes returns the number of times Flush has been called
+func (m *Memory) Flushes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushes
+}
@@ -0,0 +1,485 @@
+package publisher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Self-metrics describing events published by a backend other than
+// Honeycomb's Events API, which counts its own
+const (
+	MetricEventsSent   = "publisher.events_sent"
+	MetricEventsFailed = "publisher.events_failed"
+	MetricOTLPDropped  = "otlp.events_dropped"
+)
+
+const (
+	otlpLogsPath   = "/v1/logs"
+	otlpTracesPath = "/v1/traces"
+
+	// otlpMaxBatchEvents is the most events held before they are exported
+	// in the background without waiting for a flush
+	otlpMaxBatchEvents = 1000
+
+	// otlpMaxPendingEvents bounds the events held while exports can't keep
+	// up. The oldest are dropped to make room for new ones.
+	otlpMaxPendingEvents = 10 * otlpMaxBatchEvents
+
+	// otlpMaxResponseBytes bounds how much of a response body is read
+	otlpMaxResponseBytes = 64 << 10
+
+	// otlpScopeName names the instrumentation scope of everything exported
+	otlpScopeName = "honeycomb-lambda-extension"
+
+	// platformReport events describe a finished invocation, and are exported
+	// as invocation spans rather than log records
+	platformReport     = "platform.report"
+	invocationSpanName = "invocation"
+)
+
+// OTLP is a Publisher exporting events over OTLP/HTTP, as gzipped protobuf,
+// to Honeycomb's OTLP endpoint or an OpenTelemetry collector. Events become
+// log records, except platform.report events, which become a span for the
+// invocation they report on. Every export carries the function's faas.*
+// resource attributes.
+//
+// Events are held until a flush, or until a batch of them is ready, when
+// they're exported in the background so that Publish never waits on the
+// endpoint. Exports are neither retried nor spooled by OTLP itself: an export
+// that fails is dropped.
+type OTLP struct {
+	endpoint   string
+	headers    map[string]string
+	userAgent  string
+	resource   *resourcepb.Resource
+	scope      *commonpb.InstrumentationScope
+	client     *http.Client
+	onResponse func(OTLPResponse)
+
+	mu      sync.Mutex // guards pending and dropped
+	pending []*Event
+	dropped int64
+
+	// ready wakes the background exporter once a batch is ready
+	ready chan struct{}
+
+	// exportMu is held while exporting, so that a flush waits for an export
+	// already under way
+	exportMu sync.Mutex
+}
+
+// OTLPResponse is the outcome of one export request
+type OTLPResponse struct {
+	// Path is the path the request was sent to, such as /v1/logs
+	Path string
+	// Count is the number of events the request held
+	Count      int
+	StatusCode int
+	Err        error
+	// Body is the response's body, if the export was rejected
+	Body []byte
+}
+
+// Success reports whether the endpoint accepted the export
+func (r OTLPResponse) Success() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+// NewOTLP returns an OTLP exporting to the endpoint configured in config with
+// client, or http.DefaultClient if it's nil. If onResponse isn't nil, it's
+// called with the outcome of every export request.
+func NewOTLP(config extension.Config, version string, client *http.Client, onResponse func(OTLPResponse)) *OTLP {
+	headers := make(map[string]string)
+	if config.APIKey != "" {
+		headers["x-honeycomb-team"] = config.APIKey
+	}
+	if config.Dataset != "" {
+		headers["x-honeycomb-dataset"] = config.Dataset
+	}
+	for name, value := range config.OTLPHeaders {
+		headers[name] = value
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	e := &OTLP{
+		endpoint:   strings.TrimSuffix(config.OTLPEndpoint, "/"),
+		headers:    headers,
+		userAgent:  fmt.Sprintf("honeycomb-lambda-extension/%s", version),
+		resource:   lambdaResource(),
+		scope:      &commonpb.InstrumentationScope{Name: otlpScopeName, Version: version},
+		client:     client,
+		onResponse: onResponse,
+		ready:      make(chan struct{}, 1),
+	}
+	go e.exportBatches()
+	return e
+}
+
+func (e *OTLP) NewEvent() *Event {
+	return &Event{}
+}
+
+// Publish holds on to ev until the next flush, and wakes the background
+// exporter once there are otlpMaxBatchEvents events held. It never waits for
+// them to be exported.
+func (e *OTLP) Publish(ev *Event) error {
+	e.mu.Lock()
+	e.pending = append(e.pending, ev)
+	if excess := len(e.pending) - otlpMaxPendingEvents; excess > 0 {
+		e.pending = slices.Delete(e.pending, 0, excess)
+		e.dropped += int64(excess)
+		metrics.Add(MetricOTLPDropped, int64(excess))
+	}
+	ready := len(e.pending) >= otlpMaxBatchEvents
+	e.mu.Unlock()
+	if ready {
+		select {
+		case e.ready <- struct{}{}:
+		default: // already woken
+		}
+	}
+	return nil
+}
+
+// Flush exports every event held, waiting until they've been sent
+func (e *OTLP) Flush() {
+	e.exportPending()
+}
+
+// DroppedSinceLastReport returns the number of events dropped for want of
+// room while exports couldn't keep up, since it was last called
+func (e *OTLP) DroppedSinceLastReport() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dropped := e.dropped
+	e.dropped = 0
+	return dropped
+}
+
+// exportBatches exports the events held each time the background exporter is
+// woken
+func (e *OTLP) exportBatches() {
+	for range e.ready {
+		e.exportPending()
+	}
+}
+
+// exportPending exports every event held
+func (e *OTLP) exportPending() {
+	e.exportMu.Lock()
+	defer e.exportMu.Unlock()
+	e.mu.Lock()
+	batch := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(batch) > 0 {
+		e.export(batch)
+	}
+}
+
+// export sends events as one request of log records and one of spans for
+// each dataset they're sent to
+func (e *OTLP) export(events []*Event) {
+	var datasets []string
+	byDataset := make(map[string][]*Event)
+	for _, ev := range events {
+		if _, ok := byDataset[ev.Dataset]; !ok {
+			datasets = append(datasets, ev.Dataset)
+		}
+		byDataset[ev.Dataset] = append(byDataset[ev.Dataset], ev)
+	}
+
+	observed := time.Now()
+	for _, dataset := range datasets {
+		var records []*logspb.LogRecord
+		var spans []*tracepb.Span
+		for _, ev := range byDataset[dataset] {
+			if ev.Fields()["lambda_extension.type"] == platformReport {
+				spans = append(spans, invocationSpan(ev))
+			} else {
+				records = append(records, logRecord(ev, observed))
+			}
+		}
+		if len(records) > 0 {
+			e.post(otlpLogsPath, dataset, len(records), &logspb.LogsData{
+				ResourceLogs: []*logspb.ResourceLogs{{
+					Resource:  e.resource,
+					ScopeLogs: []*logspb.ScopeLogs{{Scope: e.scope, LogRecords: records}},
+				}},
+			})
+		}
+		if len(spans) > 0 {
+			e.post(otlpTracesPath, dataset, len(spans), &tracepb.TracesData{
+				ResourceSpans: []*tracepb.ResourceSpans{{
+					Resource:   e.resource,
+					ScopeSpans: []*tracepb.ScopeSpans{{Scope: e.scope, Spans: spans}},
+				}},
+			})
+		}
+	}
+}
+
+// post sends msg to the endpoint's path, and records the outcome for the
+// count events it holds. LogsData and TracesData are encoded the same as the
+// export requests for logs and traces.
+func (e *OTLP) post(path, dataset string, count int, msg proto.Message) {
+	r := e.send(path, dataset, msg)
+	r.Path, r.Count = path, count
+	if e.onResponse != nil {
+		e.onResponse(r)
+	}
+	if r.Success() {
+		metrics.Add(MetricEventsSent, int64(count))
+		log.Debugf("Successfully exported %d events to %s", count, path)
+		return
+	}
+	metrics.Add(MetricEventsFailed, int64(count))
+	log.Debugf("Error exporting %d events to %s! Had code %d, err %v and response body %s",
+		count, path, r.StatusCode, r.Err, r.Body)
+}
+
+func (e *OTLP) send(path, dataset string, msg proto.Message) OTLPResponse {
+	encoded, err := proto.Marshal(msg)
+	if err != nil {
+		return OTLPResponse{Err: err}
+	}
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	if _, err := gz.Write(encoded); err != nil {
+		return OTLPResponse{Err: err}
+	}
+	if err := gz.Close(); err != nil {
+		return OTLPResponse{Err: err}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint+path, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return OTLPResponse{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", e.userAgent)
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+	if dataset != "" {
+		req.Header.Set("x-honeycomb-dataset", dataset)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return OTLPResponse{Err: err}
+	}
+	defer res.Body.Close()
+	r := OTLPResponse{StatusCode: res.StatusCode}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		r.Body, _ = io.ReadAll(io.LimitReader(res.Body, otlpMaxResponseBytes))
+	}
+	io.Copy(io.Discard, res.Body)
+	return r
+}
+
+// logRecord returns ev as a log record. A plain-text line becomes the
+// record's body, and every other field an attribute.
+func logRecord(ev *Event, observed time.Time) *logspb.LogRecord {
+	fields := ev.Fields()
+	record := &logspb.LogRecord{
+		TimeUnixNano:         unixNano(ev.timestamp()),
+		ObservedTimeUnixNano: unixNano(observed),
+	}
+	var skip []string
+	if line, ok := fields["record"].(string); ok {
+		record.Body = &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: line}}
+		skip = append(skip, "record")
+	}
+	if level, ok := fields["level"].(string); ok {
+		record.SeverityText = level
+	}
+	record.TraceId = hexID(fields["trace.trace_id"], 16)
+	record.SpanId = hexID(fields["trace.span_id"], 8)
+	record.Attributes = attributes(fields, ev.SampleRate, skip...)
+	return record
+}
+
+// invocationSpan returns a span for the invocation a platform.report event
+// reports on, ending when it was reported and lasting its metrics.durationMs.
+// The span joins the invocation's X-Ray trace if the report has one.
+func invocationSpan(ev *Event) *tracepb.Span {
+	fields := ev.Fields()
+	end := ev.timestamp()
+	start := end
+	if reportMetrics, ok := fields["metrics"].(map[string]interface{}); ok {
+		if durationMS, ok := reportMetrics["durationMs"].(float64); ok {
+			start = end.Add(-time.Duration(durationMS * float64(time.Millisecond)))
+		}
+	}
+	traceID := xrayTraceID(fields)
+	if traceID == nil {
+		traceID = randomID(16)
+	}
+	span := &tracepb.Span{
+		TraceId:           traceID,
+		SpanId:            randomID(8),
+		Name:              invocationSpanName,
+		Kind:              tracepb.Span_SPAN_KIND_SERVER,
+		StartTimeUnixNano: unixNano(start),
+		EndTimeUnixNano:   unixNano(end),
+		Attributes:        attributes(fields, ev.SampleRate),
+	}
+	if requestID, ok := fields["requestId"].(string); ok {
+		span.Attributes = append(span.Attributes, keyValue("faas.invocation_id", requestID))
+	}
+	if status, ok := fields["status"].(string); ok && status != "success" {
+		span.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: status}
+	}
+	return span
+}
+
+// xrayTraceID returns the trace ID from the X-Ray tracing header in a
+// platform event's tracing field, if it has one. X-Ray's Root=1-5759e988-
+// bd862e3fe1be46a994272793 is the trace ID 5759e988bd862e3fe1be46a994272793.
+func xrayTraceID(fields map[string]interface{}) []byte {
+	tracing, ok := fields["tracing"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	header, _ := tracing["value"].(string)
+	for _, part := range strings.Split(header, ";") {
+		root, ok := strings.CutPrefix(strings.TrimSpace(part), "Root=1-")
+		if ok {
+			return hexID(strings.ReplaceAll(root, "-", ""), 16)
+		}
+	}
+	return nil
+}
+
+// attributes returns fields as attributes, sorted by name, leaving out the
+// fields named in skip. A sample rate above 1 is added as SampleRate, which
+// Honeycomb reads to weight the event.
+func attributes(fields map[string]interface{}, sampleRate uint, skip ...string) []*commonpb.KeyValue {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !slices.Contains(skip, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	attrs := make([]*commonpb.KeyValue, 0, len(names)+1)
+	for _, name := range names {
+		attrs = append(attrs, keyValue(name, fields[name]))
+	}
+	if sampleRate > 1 {
+		attrs = append(attrs, keyValue("SampleRate", int64(sampleRate)))
+	}
+	return attrs
+}
+
+func keyValue(key string, value interface{}) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: anyValue(value)}
+}
+
+// anyValue converts a field's value, as decoded from JSON or set by the
+// extension, to an attribute value
+func anyValue(value interface{}) *commonpb.AnyValue {
+	switch v := value.(type) {
+	case nil:
+		return &commonpb.AnyValue{}
+	case string:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}}
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v}}
+	case int:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v}}
+	case uint:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(v)}}
+	case float64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v}}
+	case []string:
+		values := make([]*commonpb.AnyValue, len(v))
+		for i, s := range v {
+			values[i] = anyValue(s)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	case []interface{}:
+		values := make([]*commonpb.AnyValue, len(v))
+		for i, item := range v {
+			values[i] = anyValue(item)
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+	case map[string]interface{}:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: attributes(v, 0)}}}
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(v)}}
+	}
+}
+
+// lambdaResource describes the function the extension runs alongside, from
+// the environment Lambda sets for it
+func lambdaResource() *resourcepb.Resource {
+	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	attrs := []*commonpb.KeyValue{
+		keyValue("cloud.provider", "aws"),
+		keyValue("cloud.platform", "aws_lambda"),
+	}
+	for _, attr := range []struct{ key, value string }{
+		{"service.name", functionName},
+		{"faas.name", functionName},
+		{"faas.version", os.Getenv("AWS_LAMBDA_FUNCTION_VERSION")},
+		{"faas.instance", os.Getenv("AWS_LAMBDA_LOG_STREAM_NAME")},
+		{"cloud.region", os.Getenv("AWS_REGION")},
+	} {
+		if attr.value != "" {
+			attrs = append(attrs, keyValue(attr.key, attr.value))
+		}
+	}
+	if mb, err := strconv.ParseInt(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64); err == nil {
+		attrs = append(attrs, keyValue("faas.max_memory", mb<<20))
+	}
+	return &resourcepb.Resource{Attributes: attrs}
+}
+
+// hexID decodes a hex-encoded trace or span ID of size bytes, or returns nil
+// if value isn't one
+func hexID(value interface{}, size int) []byte {
+	s, ok := value.(string)
+	if !ok || len(s) != size*2 {
+		return nil
+	}
+	id, err := hex.DecodeString(s)
+	if err != nil {
+		return nil
+	}
+	return id
+}
+
+func randomID(size int) []byte {
+	id := make([]byte, size)
+	rand.Read(id)
+	return id
+}
+
+func unixNano(t time.Time) uint64 {
+	return uint64(t.UnixNano())
+}
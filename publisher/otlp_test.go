@@ -0,0 +1,236 @@
+package publisher
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpRequest is an export received by an otlpServer
+type otlpRequest struct {
+	path   string
+	header http.Header
+	logs   *logspb.LogsData
+	traces *tracepb.TracesData
+}
+
+// otlpServer decodes the exports it receives, and answers them with status.
+// While hold isn't nil, it waits for hold to be closed before answering.
+type otlpServer struct {
+	status int
+	hold   chan struct{}
+
+	mu       sync.Mutex
+	requests []otlpRequest
+}
+
+func (s *otlpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gz, err := gzip.NewReader(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := otlpRequest{path: r.URL.Path, header: r.Header}
+	if r.URL.Path == otlpLogsPath {
+		req.logs = &logspb.LogsData{}
+		err = proto.Unmarshal(body, req.logs)
+	} else {
+		req.traces = &tracepb.TracesData{}
+		err = proto.Unmarshal(body, req.traces)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.hold != nil {
+		<-s.hold
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+	w.WriteHeader(s.status)
+}
+
+// attributeMap returns attrs keyed by name, with string, int and double values
+func attributeMap(attrs []*commonpb.KeyValue) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, attr := range attrs {
+		switch v := attr.Value.Value.(type) {
+		case *commonpb.AnyValue_StringValue:
+			m[attr.Key] = v.StringValue
+		case *commonpb.AnyValue_IntValue:
+			m[attr.Key] = v.IntValue
+		case *commonpb.AnyValue_DoubleValue:
+			m[attr.Key] = v.DoubleValue
+		default:
+			m[attr.Key] = attr.Value
+		}
+	}
+	return m
+}
+
+func TestOTLPExportsLogsAndSpans(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "my-function")
+	t.Setenv("AWS_LAMBDA_FUNCTION_VERSION", "$LATEST")
+	t.Setenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE", "128")
+	server := &otlpServer{status: http.StatusOK}
+	testServer := httptest.NewServer(server)
+	defer testServer.Close()
+
+	exporter := NewOTLP(extension.Config{
+		APIKey:       "test-api-key",
+		Dataset:      "test-dataset",
+		OTLPEndpoint: testServer.URL + "/",
+		OTLPHeaders:  map[string]string{"authorization": "Bearer token"},
+	}, "test-version", nil, nil)
+	reported := time.Date(2020, 12, 25, 12, 34, 56, 0, time.UTC)
+
+	line := exporter.NewEvent()
+	line.Timestamp = reported.Add(-time.Second)
+	line.AddFields(map[string]interface{}{"lambda_extension.type": "function", "record": "A basic message to STDOUT"})
+	span := exporter.NewEvent()
+	span.SampleRate = 5
+	span.AddFields(map[string]interface{}{
+		"lambda_extension.type": "function",
+		"name":                  "handle-request",
+		"trace.trace_id":        "97cac7afa949e6e0ccf399e11509c275",
+		"trace.span_id":         "e4f8bd1e1c8cc3a5",
+		"duration_ms":           12.5,
+	})
+	report := exporter.NewEvent()
+	report.Timestamp = reported
+	report.AddFields(map[string]interface{}{
+		"lambda_extension.type": "platform.report",
+		"requestId":             "6d67e385-053d-4622-a56f-b25bcef23083",
+		"status":                "timeout",
+		"metrics":               map[string]interface{}{"durationMs": 250.0},
+		"tracing":               map[string]interface{}{"type": "X-Amzn-Trace-Id", "value": "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1"},
+	})
+	self := exporter.NewEvent()
+	self.Dataset = "self-dataset"
+	self.AddField("lambda_extension.type", "extension.self_telemetry")
+	for _, ev := range []*Event{line, span, report, self} {
+		assert.NoError(t, exporter.Publish(ev))
+	}
+	exporter.Flush()
+
+	if !assert.Len(t, server.requests, 3) {
+		return
+	}
+	logs, traces, selfLogs := server.requests[0], server.requests[1], server.requests[2]
+
+	assert.Equal(t, otlpLogsPath, logs.path)
+	assert.Equal(t, "application/x-protobuf", logs.header.Get("Content-Type"))
+	assert.Equal(t, "test-api-key", logs.header.Get("x-honeycomb-team"))
+	assert.Equal(t, "test-dataset", logs.header.Get("x-honeycomb-dataset"))
+	assert.Equal(t, "Bearer token", logs.header.Get("Authorization"))
+	resource := attributeMap(logs.logs.ResourceLogs[0].Resource.Attributes)
+	assert.Equal(t, "my-function", resource["service.name"])
+	assert.Equal(t, "my-function", resource["faas.name"])
+	assert.Equal(t, "$LATEST", resource["faas.version"])
+	assert.Equal(t, int64(128<<20), resource["faas.max_memory"])
+	records := logs.logs.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "A basic message to STDOUT", records[0].Body.GetStringValue())
+		assert.Equal(t, uint64(line.Timestamp.UnixNano()), records[0].TimeUnixNano)
+		assert.NotContains(t, attributeMap(records[0].Attributes), "record")
+		assert.Equal(t, "97cac7afa949e6e0ccf399e11509c275", hex.EncodeToString(records[1].TraceId))
+		assert.Equal(t, "e4f8bd1e1c8cc3a5", hex.EncodeToString(records[1].SpanId))
+		attrs := attributeMap(records[1].Attributes)
+		assert.Equal(t, "handle-request", attrs["name"])
+		assert.Equal(t, 12.5, attrs["duration_ms"])
+		assert.Equal(t, int64(5), attrs["SampleRate"])
+	}
+
+	assert.Equal(t, otlpTracesPath, traces.path)
+	spans := traces.traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if assert.Len(t, spans, 1) {
+		assert.Equal(t, invocationSpanName, spans[0].Name)
+		assert.Equal(t, "5759e988bd862e3fe1be46a994272793", hex.EncodeToString(spans[0].TraceId))
+		assert.Equal(t, uint64(reported.UnixNano()), spans[0].EndTimeUnixNano)
+		assert.Equal(t, uint64(reported.Add(-250*time.Millisecond).UnixNano()), spans[0].StartTimeUnixNano)
+		assert.Equal(t, "6d67e385-053d-4622-a56f-b25bcef23083", attributeMap(spans[0].Attributes)["faas.invocation_id"])
+		assert.Equal(t, tracepb.Status_STATUS_CODE_ERROR, spans[0].Status.GetCode())
+	}
+
+	assert.Equal(t, "self-dataset", selfLogs.header.Get("x-honeycomb-dataset"), "expected an event's own dataset to override the header")
+	assert.Len(t, selfLogs.logs.ResourceLogs[0].ScopeLogs[0].LogRecords, 1)
+}
+
+func TestOTLPReportsResponses(t *testing.T) {
+	server := &otlpServer{status: http.StatusUnauthorized}
+	testServer := httptest.NewServer(server)
+	defer testServer.Close()
+
+	var responses []OTLPResponse
+	exporter := NewOTLP(extension.Config{OTLPEndpoint: testServer.URL}, "test-version", nil, func(r OTLPResponse) {
+		responses = append(responses, r)
+	})
+	sentBefore := metrics.Default.Counter(MetricEventsSent)
+	failedBefore := metrics.Default.Counter(MetricEventsFailed)
+
+	assert.NoError(t, exporter.Publish(exporter.NewEvent()))
+	assert.NoError(t, exporter.Publish(exporter.NewEvent()))
+	exporter.Flush()
+
+	if assert.Len(t, responses, 1) {
+		assert.Equal(t, otlpLogsPath, responses[0].Path)
+		assert.Equal(t, 2, responses[0].Count)
+		assert.Equal(t, http.StatusUnauthorized, responses[0].StatusCode)
+		assert.False(t, responses[0].Success())
+	}
+	assert.Equal(t, sentBefore, metrics.Default.Counter(MetricEventsSent))
+	assert.Equal(t, failedBefore+2, metrics.Default.Counter(MetricEventsFailed))
+}
+
+func TestOTLPPublishDoesNotWaitForExports(t *testing.T) {
+	server := &otlpServer{status: http.StatusOK, hold: make(chan struct{})}
+	testServer := httptest.NewServer(server)
+	defer testServer.Close()
+
+	exporter := NewOTLP(extension.Config{OTLPEndpoint: testServer.URL}, "test-version", nil, nil)
+	droppedBefore := metrics.Default.Counter(MetricOTLPDropped)
+
+	published := make(chan struct{})
+	go func() {
+		for range otlpMaxPendingEvents + 2*otlpMaxBatchEvents {
+			exporter.Publish(exporter.NewEvent())
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Publish not to wait while a batch is being exported")
+	}
+	close(server.hold)
+	exporter.Flush()
+
+	dropped := exporter.DroppedSinceLastReport()
+	assert.Positive(t, dropped, "expected the events beyond what could be held to be dropped")
+	assert.Equal(t, droppedBefore+dropped, metrics.Default.Counter(MetricOTLPDropped))
+	exported := 0
+	for _, req := range server.requests {
+		exported += len(req.logs.ResourceLogs[0].ScopeLogs[0].LogRecords)
+	}
+	assert.Equal(t, otlpMaxPendingEvents+2*otlpMaxBatchEvents, exported+int(dropped))
+}
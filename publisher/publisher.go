@@ -0,0 +1,83 @@
+// Package publisher describes events independently of the backend they are
+// published to, and the interface every backend implements.
+package publisher
+
+import (
+	"maps"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithFields(logrus.Fields{
+	"source": "hny-lambda-ext-publisher",
+})
+
+// Publisher creates events and publishes them to a backend, such as
+// Honeycomb's Events API, an OTLP endpoint or a local file.
+type Publisher interface {
+	// NewEvent returns an empty event, with any fields the backend adds to
+	// every event already set.
+	NewEvent() *Event
+	// Publish hands ev to the backend, which may buffer it until Flush.
+	Publish(ev *Event) error
+	// Flush sends every buffered event, waiting until they've been sent.
+	Flush()
+}
+
+// Event is a single event to be published. Its fields are not safe for
+// concurrent use, so an event should be built by one goroutine at a time.
+type Event struct {
+	// Timestamp is when the event happened. The zero value means now.
+	Timestamp time.Time
+	// Dataset overrides the backend's dataset for this event, if not empty.
+	Dataset string
+	// SampleRate is the rate at which the event was already sampled, if any.
+	// Events are published as they are, without being sampled again.
+	SampleRate uint
+	// Metadata is handed back alongside the response to the event, for
+	// backends that report responses.
+	Metadata interface{}
+
+	fields map[string]interface{}
+}
+
+// NewEvent returns an event with the given fields
+func NewEvent(fields map[string]interface{}) *Event {
+	ev := &Event{fields: make(map[string]interface{}, len(fields))}
+	maps.Copy(ev.fields, fields)
+	return ev
+}
+
+// AddField sets a single field on the event
+func (e *Event) AddField(name string, value interface{}) {
+	if e.fields == nil {
+		e.fields = make(map[string]interface{})
+	}
+	e.fields[name] = value
+}
+
+// AddFields sets every field in data on the event
+func (e *Event) AddFields(data map[string]interface{}) {
+	if e.fields == nil {
+		e.fields = make(map[string]interface{}, len(data))
+	}
+	maps.Copy(e.fields, data)
+}
+
+// Fields returns the event's fields. The map is the event's own, so changes
+// to it change the event.
+func (e *Event) Fields() map[string]interface{} {
+	if e.fields == nil {
+		e.fields = make(map[string]interface{})
+	}
+	return e.fields
+}
+
+// timestamp returns the event's timestamp, or now if it has none
+func (e *Event) timestamp() time.Time {
+	if e.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return e.Timestamp
+}
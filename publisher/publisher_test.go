@@ -0,0 +1,40 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFields(t *testing.T) {
+	fields := map[string]interface{}{"name": "handle-request"}
+	ev := NewEvent(fields)
+	ev.AddField("duration_ms", 12.5)
+	ev.AddFields(map[string]interface{}{"name": "renamed", "http.status": 200})
+
+	assert.Equal(t, map[string]interface{}{
+		"name":        "renamed",
+		"duration_ms": 12.5,
+		"http.status": 200,
+	}, ev.Fields())
+	assert.Equal(t, "handle-request", fields["name"], "expected the event to copy the fields it was created with")
+
+	var empty Event
+	empty.AddField("record", "a line")
+	assert.Equal(t, map[string]interface{}{"record": "a line"}, empty.Fields())
+}
+
+func TestMemory(t *testing.T) {
+	memory := NewMemory()
+	first := memory.NewEvent()
+	first.AddField("n", 1)
+	second := memory.NewEvent()
+	second.AddField("n", 2)
+
+	assert.NoError(t, memory.Publish(first))
+	assert.NoError(t, memory.Publish(second))
+	memory.Flush()
+
+	assert.Equal(t, []*Event{first, second}, memory.Events())
+	assert.Equal(t, 1, memory.Flushes())
+}
@@ -0,0 +1,413 @@
+package publisher
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// Self-metrics describing events forwarded over syslog
+const (
+	MetricSyslogEventsSent    = "syslog.events_sent"
+	MetricSyslogEventsDropped = "syslog.events_dropped"
+	MetricSyslogReconnects    = "syslog.reconnects"
+)
+
+const (
+	syslogDialTimeout  = 3 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+
+	// syslogAliveTimeout is how long a connection that's been idle for
+	// syslogIdleCheck is read from before a batch is written, to notice the
+	// receiver having closed it
+	syslogAliveTimeout = time.Millisecond
+	syslogIdleCheck    = time.Second
+
+	// syslogMaxPending bounds the messages held while the receiver can't be
+	// reached. The oldest are dropped to make room for new ones.
+	syslogMaxPending = 10000
+
+	// Connecting to the receiver is retried no sooner than the reconnect
+	// backoff, which doubles with each failure between these bounds
+	syslogMinReconnectBackoff = time.Second
+	syslogMaxReconnectBackoff = 30 * time.Second
+
+	// Messages are sent with the user-level facility
+	syslogFacility = 1
+
+	// syslogTimestampFormat is RFC5424's TIMESTAMP, to the microsecond
+	syslogTimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// errReconnectBackoff is returned while waiting to try connecting again
+var errReconnectBackoff = errors.New("waiting to reconnect to syslog receiver")
+
+// Syslog is a Publisher that forwards every event to a syslog receiver, such
+// as a SIEM, over TCP or TLS. Each event is written as an RFC5424 message,
+// framed by octet counting as in RFC5425, with its fields as structured data
+// and any plain-text line as the message.
+//
+// Messages are held until a flush, or until a batch of them is ready, when
+// they're sent in the background so that Publish never waits on the receiver.
+// They are kept for the next attempt while the receiver can't be reached.
+type Syslog struct {
+	address   string
+	tlsConfig *tls.Config // nil for plain TCP
+	batchSize int
+	sdID      string
+	hostname  string
+	appName   string
+
+	mu      sync.Mutex // guards pending and dropped
+	pending [][]byte
+	dropped int64
+
+	// ready wakes the background sender once a batch is ready
+	ready chan struct{}
+
+	sendMu    sync.Mutex // held while sending, guards the connection
+	conn      net.Conn
+	lastWrite time.Time
+	backoff   time.Duration
+	nextDial  time.Time
+}
+
+// NewSyslog returns a Syslog forwarding events to the receiver configured in
+// config
+func NewSyslog(config extension.Config) (*Syslog, error) {
+	if config.SyslogAddress == "" {
+		return nil, errors.New("no syslog address set")
+	}
+	var tlsConfig *tls.Config
+	if config.SyslogTLS {
+		host, _, err := net.SplitHostPort(config.SyslogAddress)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if config.SyslogCAFile != "" {
+			certs, err := os.ReadFile(config.SyslogCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(certs) {
+				return nil, fmt.Errorf("no certificates found in %s", config.SyslogCAFile)
+			}
+		}
+	}
+	hostname, _ := os.Hostname()
+	s := &Syslog{
+		address:   config.SyslogAddress,
+		tlsConfig: tlsConfig,
+		batchSize: max(config.SyslogBatchSize, 1),
+		sdID:      config.SyslogStructuredDataID,
+		hostname:  headerField(hostname, 255),
+		appName:   headerField(os.Getenv("AWS_LAMBDA_FUNCTION_NAME"), 48),
+		ready:     make(chan struct{}, 1),
+	}
+	go s.sendBatches()
+	return s, nil
+}
+
+func (s *Syslog) NewEvent() *Event {
+	return &Event{}
+}
+
+// Publish formats ev as a syslog message, and wakes the background sender
+// once there is a batch of messages held. It never waits for them to be sent.
+func (s *Syslog) Publish(ev *Event) error {
+	msg := s.format(ev)
+	s.mu.Lock()
+	s.pending = append(s.pending, msg)
+	s.trim()
+	ready := len(s.pending) >= s.batchSize
+	s.mu.Unlock()
+	if ready {
+		select {
+		case s.ready <- struct{}{}:
+		default: // already woken
+		}
+	}
+	return nil
+}
+
+// Flush sends every message held, waiting until they've been written
+func (s *Syslog) Flush() {
+	s.send()
+}
+
+// SendSoon wakes the background sender to send every message held, without
+// waiting for them to be written
+func (s *Syslog) SendSoon() {
+	select {
+	case s.ready <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// DroppedSinceLastReport returns the number of messages dropped for want of
+// room while the receiver couldn't be reached, since it was last called
+func (s *Syslog) DroppedSinceLastReport() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+// sendBatches sends the messages held each time the background sender is woken
+func (s *Syslog) sendBatches() {
+	for range s.ready {
+		s.send()
+	}
+}
+
+// send writes the messages held to the receiver, reconnecting if the
+// connection was lost. Messages that couldn't be written are held again.
+func (s *Syslog) send() {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	connected := s.conn != nil
+	err := s.write(batch)
+	if err != nil && connected {
+		// the receiver may have closed the connection since the last batch,
+		// so have one more go on a new connection
+		s.disconnect()
+		metrics.Increment(MetricSyslogReconnects)
+		err = s.write(batch)
+	}
+	if err != nil {
+		s.disconnect()
+		if !errors.Is(err, errReconnectBackoff) {
+			log.WithError(err).WithField("address", s.address).Warn("Unable to forward events to syslog, will retry")
+		}
+		s.requeue(batch)
+		return
+	}
+	metrics.Add(MetricSyslogEventsSent, int64(len(batch)))
+}
+
+// write writes batch on the connection, connecting first if need be. The
+// caller must hold sendMu.
+func (s *Syslog) write(batch [][]byte) error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	if time.Since(s.lastWrite) > syslogIdleCheck && !s.alive() {
+		return io.ErrClosedPipe
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(bytes.Join(batch, nil)); err != nil {
+		return err
+	}
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// connect connects to the receiver unless already connected, or returns
+// errReconnectBackoff if the last attempt failed too recently. The caller
+// must hold sendMu.
+func (s *Syslog) connect() error {
+	if s.conn != nil {
+		return nil
+	}
+	if time.Now().Before(s.nextDial) {
+		return errReconnectBackoff
+	}
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
+	if err != nil {
+		s.backoff = min(max(s.backoff*2, syslogMinReconnectBackoff), syslogMaxReconnectBackoff)
+		s.nextDial = time.Now().Add(s.backoff)
+		return err
+	}
+	s.conn = conn
+	s.backoff = 0
+	return nil
+}
+
+// alive reports whether the receiver still has the connection open. Syslog
+// receivers never write back, so anything but a timeout means it's gone. The
+// caller must hold sendMu.
+func (s *Syslog) alive() bool {
+	if err := s.conn.SetReadDeadline(time.Now().Add(syslogAliveTimeout)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := s.conn.Read(b[:])
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// disconnect closes the connection, if any. The caller must hold sendMu.
+func (s *Syslog) disconnect() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// requeue holds batch again, ahead of messages published since
+func (s *Syslog) requeue(batch [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(batch, s.pending...)
+	s.trim()
+}
+
+// trim drops the oldest messages held beyond syslogMaxPending. The caller
+// must hold mu.
+func (s *Syslog) trim() {
+	if excess := len(s.pending) - syslogMaxPending; excess > 0 {
+		s.pending = slices.Delete(s.pending, 0, excess)
+		s.dropped += int64(excess)
+		metrics.Add(MetricSyslogEventsDropped, int64(excess))
+	}
+}
+
+// format returns ev as an RFC5424 message, framed with its length:
+//
+//	LEN <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID name="value" ...] MSG
+//
+// PROCID is the event's request ID and MSGID its lambda_extension.type, if it
+// has them. A plain-text line is the message, and every other field is a
+// parameter of the structured data element.
+func (s *Syslog) format(ev *Event) []byte {
+	fields := ev.Fields()
+	procID, _ := fields["requestId"].(string)
+	msgID, _ := fields["lambda_extension.type"].(string)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "<%d>1 %s %s %s %s %s ",
+		syslogFacility*8+syslogSeverity(fields["level"]),
+		ev.timestamp().UTC().Format(syslogTimestampFormat),
+		s.hostname, s.appName, headerField(procID, 128), headerField(msgID, 32))
+
+	line, hasLine := fields["record"].(string)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if !hasLine || name != "record" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		msg.WriteByte('-')
+	} else {
+		slices.Sort(names)
+		msg.WriteString("[" + s.sdID)
+		for _, name := range names {
+			fmt.Fprintf(&msg, ` %s="%s"`, paramName(name), paramValue(fields[name]))
+		}
+		msg.WriteByte(']')
+	}
+	if hasLine {
+		msg.WriteByte(' ')
+		msg.WriteString(line)
+	}
+
+	framed := make([]byte, 0, msg.Len()+8)
+	framed = strconv.AppendInt(framed, int64(msg.Len()), 10)
+	framed = append(framed, ' ')
+	return append(framed, msg.Bytes()...)
+}
+
+// syslogSeverity returns the severity for a log level field, or
+// informational if there isn't one
+func syslogSeverity(level interface{}) int {
+	s, _ := level.(string)
+	switch strings.ToLower(s) {
+	case "fatal", "panic", "critical", "crit":
+		return 2
+	case "error", "err":
+		return 3
+	case "warn", "warning":
+		return 4
+	case "notice":
+		return 5
+	case "debug", "trace":
+		return 7
+	default:
+		return 6
+	}
+}
+
+// headerField returns s as a header field of at most maxLen printable ASCII
+// characters, or the nil value "-" if it's empty
+func headerField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// paramName returns a field's name as a structured data parameter name, which
+// is at most 32 printable ASCII characters other than '=', ']' and '"'
+func paramName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// paramValue returns a field's value as a structured data parameter value.
+// Strings are written as they are, anything else as JSON, escaping '"', '\'
+// and ']'.
+func paramValue(value interface{}) string {
+	s, ok := value.(string)
+	if !ok {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded = []byte(fmt.Sprint(value))
+		}
+		s = string(encoded)
+	}
+	s = strings.ToValidUTF8(s, "�")
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,285 @@
+package publisher
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/extension"
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+)
+
+// syslogListener is a local syslog receiver, reading octet-counted messages
+// from every connection it accepts
+type syslogListener struct {
+	ln       net.Listener
+	messages chan string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newSyslogListener(t *testing.T, address string) *syslogListener {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &syslogListener{ln: ln, messages: make(chan string, 100)}
+	go l.accept()
+	t.Cleanup(func() {
+		ln.Close()
+		l.closeConnections()
+	})
+	return l
+}
+
+func (l *syslogListener) accept() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		l.conns = append(l.conns, conn)
+		l.mu.Unlock()
+		go l.read(conn)
+	}
+}
+
+func (l *syslogListener) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		l.messages <- string(msg)
+	}
+}
+
+func (l *syslogListener) closeConnections() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	l.conns = nil
+}
+
+// receive returns the next n messages, or fewer if they don't arrive in time
+func (l *syslogListener) receive(n int) []string {
+	var messages []string
+	for range n {
+		select {
+		case msg := <-l.messages:
+			messages = append(messages, msg)
+		case <-time.After(time.Second):
+			return messages
+		}
+	}
+	return messages
+}
+
+func newTestSyslog(t *testing.T, address string, batchSize int) *Syslog {
+	s, err := NewSyslog(extension.Config{
+		SyslogAddress:          address,
+		SyslogBatchSize:        batchSize,
+		SyslogStructuredDataID: "lambda@32473",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewSyslog(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config extension.Config
+		errors bool
+	}{
+		{desc: "plain TCP", config: extension.Config{SyslogAddress: "siem.example.com:601"}},
+		{desc: "TLS", config: extension.Config{SyslogAddress: "siem.example.com:6514", SyslogTLS: true}},
+		{desc: "no address", config: extension.Config{}, errors: true},
+		{desc: "TLS without a port", config: extension.Config{SyslogAddress: "siem.example.com", SyslogTLS: true}, errors: true},
+		{desc: "missing CA file", config: extension.Config{SyslogAddress: "siem.example.com:6514", SyslogTLS: true, SyslogCAFile: "/does/not/exist.pem"}, errors: true},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			s, err := NewSyslog(tC.config)
+			if tC.errors {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tC.config.SyslogTLS, s.tlsConfig != nil)
+			if s.tlsConfig != nil {
+				assert.Equal(t, "siem.example.com", s.tlsConfig.ServerName)
+			}
+		})
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	s := &Syslog{sdID: "lambda@32473", hostname: "host", appName: "my-function"}
+	timestamp := time.Date(2020, 12, 25, 12, 34, 56, 789000000, time.UTC)
+	testCases := []struct {
+		desc     string
+		fields   map[string]interface{}
+		expected string
+	}{
+		{
+			desc:     "plain-text line",
+			fields:   map[string]interface{}{"lambda_extension.type": "function", "record": "A basic message to STDOUT"},
+			expected: `<14>1 2020-12-25T12:34:56.789000Z host my-function - function [lambda@32473 lambda_extension.type="function"] A basic message to STDOUT`,
+		},
+		{
+			desc: "platform event",
+			fields: map[string]interface{}{
+				"lambda_extension.type": "platform.report",
+				"requestId":             "6d67e385",
+				"metrics":               map[string]interface{}{"durationMs": 250},
+				"note":                  `say "hi" [x]`,
+			},
+			expected: `<14>1 2020-12-25T12:34:56.789000Z host my-function 6d67e385 platform.report [lambda@32473 lambda_extension.type="platform.report" metrics="{\"durationMs\":250}" note="say \"hi\" [x\]" requestId="6d67e385"]`,
+		},
+		{
+			desc:     "level and awkward field name",
+			fields:   map[string]interface{}{"level": "ERROR", "bad name=": 1},
+			expected: `<11>1 2020-12-25T12:34:56.789000Z host my-function - - [lambda@32473 bad_name_="1" level="ERROR"]`,
+		},
+		{
+			desc:     "no fields",
+			expected: `<14>1 2020-12-25T12:34:56.789000Z host my-function - - -`,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			ev := NewEvent(tC.fields)
+			ev.Timestamp = timestamp
+			assert.Equal(t, strconv.Itoa(len(tC.expected))+" "+tC.expected, string(s.format(ev)))
+		})
+	}
+}
+
+func TestSyslogForwardsBatches(t *testing.T) {
+	listener := newSyslogListener(t, "127.0.0.1:0")
+	s := newTestSyslog(t, listener.ln.Addr().String(), 2)
+	sentBefore := metrics.Default.Counter(MetricSyslogEventsSent)
+
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "one"})))
+	select {
+	case msg := <-listener.messages:
+		t.Fatalf("expected no message before a batch is ready, got %q", msg)
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "two"})))
+	received := listener.receive(2)
+	if assert.Len(t, received, 2) {
+		assert.True(t, strings.HasSuffix(received[0], " one"))
+		assert.True(t, strings.HasSuffix(received[1], " two"))
+	}
+
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "three"})))
+	s.Flush()
+	assert.Len(t, listener.receive(1), 1, "expected a flush to send a partial batch")
+	assert.Equal(t, sentBefore+3, metrics.Default.Counter(MetricSyslogEventsSent))
+}
+
+func TestSyslogSendSoonSendsAPartialBatch(t *testing.T) {
+	listener := newSyslogListener(t, "127.0.0.1:0")
+	s := newTestSyslog(t, listener.ln.Addr().String(), 10)
+
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "one"})))
+	s.SendSoon()
+	assert.Len(t, listener.receive(1), 1, "expected the partial batch to be sent in the background")
+}
+
+func TestSyslogPublishDoesNotWaitForSending(t *testing.T) {
+	listener := newSyslogListener(t, "127.0.0.1:0")
+	s := newTestSyslog(t, listener.ln.Addr().String(), 2)
+
+	// stands in for a send stuck on a slow receiver
+	s.sendMu.Lock()
+	published := make(chan struct{})
+	go func() {
+		for _, record := range []string{"one", "two", "three"} {
+			s.Publish(NewEvent(map[string]interface{}{"record": record}))
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second):
+		t.Fatal("expected Publish not to wait while a batch is being sent")
+	}
+	s.sendMu.Unlock()
+
+	assert.Len(t, listener.receive(3), 3, "expected the batches to be sent in the background")
+}
+
+func TestSyslogReconnects(t *testing.T) {
+	listener := newSyslogListener(t, "127.0.0.1:0")
+	s := newTestSyslog(t, listener.ln.Addr().String(), 10)
+	reconnectsBefore := metrics.Default.Counter(MetricSyslogReconnects)
+
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "before"})))
+	s.Flush()
+	assert.Len(t, listener.receive(1), 1)
+
+	listener.closeConnections()
+	time.Sleep(10 * time.Millisecond)
+	s.sendMu.Lock()
+	s.lastWrite = time.Now().Add(-2 * syslogIdleCheck)
+	s.sendMu.Unlock()
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "after"})))
+	s.Flush()
+
+	received := listener.receive(1)
+	if assert.Len(t, received, 1, "expected the message to be sent on a new connection") {
+		assert.True(t, strings.HasSuffix(received[0], " after"))
+	}
+	assert.Equal(t, reconnectsBefore+1, metrics.Default.Counter(MetricSyslogReconnects))
+}
+
+func TestSyslogHoldsMessagesWhileUnreachable(t *testing.T) {
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := unused.Addr().String()
+	unused.Close()
+	s := newTestSyslog(t, address, 10)
+
+	assert.NoError(t, s.Publish(NewEvent(map[string]interface{}{"record": "held"})))
+	s.Flush()
+	assert.Len(t, s.pending, 1, "expected the message to be held")
+	assert.False(t, s.nextDial.IsZero(), "expected reconnecting to back off")
+
+	listener := newSyslogListener(t, address)
+	s.Flush()
+	assert.Empty(t, listener.receive(1), "expected no reconnect within the backoff")
+
+	s.nextDial = time.Time{}
+	s.Flush()
+	received := listener.receive(1)
+	if assert.Len(t, received, 1) {
+		assert.True(t, strings.HasSuffix(received[0], " held"))
+	}
+	assert.Empty(t, s.pending)
+}
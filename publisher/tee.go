@@ -0,0 +1,118 @@
+package publisher
+
+import (
+	"sync"
+	"time"
+)
+
+// Tee is a Publisher that publishes every event to a primary publisher and to
+// any number of forwarders, such as a copy of the logs for a SIEM. Events are
+// created by the primary, so they carry its fields, and every publisher is
+// flushed at once.
+//
+// The optional capabilities callers look for, such as reporting backpressure
+// or spooling, are passed on to the publishers that have them, so a Tee can
+// stand in for its primary.
+type Tee struct {
+	primary    Publisher
+	forwarders []Publisher
+}
+
+// NewTee returns a Tee publishing to primary and every forwarder
+func NewTee(primary Publisher, forwarders ...Publisher) *Tee {
+	return &Tee{primary: primary, forwarders: forwarders}
+}
+
+func (t *Tee) NewEvent() *Event {
+	return t.primary.NewEvent()
+}
+
+// Publish hands ev to every publisher, returning the primary's error. Failing
+// forwarders report their own errors.
+func (t *Tee) Publish(ev *Event) error {
+	for _, f := range t.forwarders {
+		if err := f.Publish(ev); err != nil {
+			log.WithError(err).Debug("Unable to forward event")
+		}
+	}
+	return t.primary.Publish(ev)
+}
+
+// Flush flushes every publisher at once, and waits for them all
+func (t *Tee) Flush() {
+	var wg sync.WaitGroup
+	for _, p := range t.all() {
+		wg.Go(p.Flush)
+	}
+	wg.Wait()
+}
+
+// SendForwardersSoon wakes the background senders of the forwarders that have
+// one, without waiting on them. The rest are sent with the next Flush.
+func (t *Tee) SendForwardersSoon() {
+	for _, f := range t.forwarders {
+		if sender, ok := f.(interface{ SendSoon() }); ok {
+			sender.SendSoon()
+		}
+	}
+}
+
+// Full reports whether the primary is refusing new events for now
+func (t *Tee) Full() bool {
+	full, ok := t.primary.(interface{ Full() bool })
+	return ok && full.Full()
+}
+
+// DroppedSinceLastReport returns the number of events dropped by every
+// publisher since it was last called
+func (t *Tee) DroppedSinceLastReport() int64 {
+	var dropped int64
+	for _, p := range t.all() {
+		if reporter, ok := p.(interface{ DroppedSinceLastReport() int64 }); ok {
+			dropped += reporter.DroppedSinceLastReport()
+		}
+	}
+	return dropped
+}
+
+// ReplaySpool replays the spools of every publisher that has one
+func (t *Tee) ReplaySpool() {
+	for _, p := range t.all() {
+		if replayer, ok := p.(interface{ ReplaySpool() }); ok {
+			replayer.ReplaySpool()
+		}
+	}
+}
+
+// SpooledEvents returns the number of events waiting in every spool
+func (t *Tee) SpooledEvents() int {
+	spooled := 0
+	for _, p := range t.all() {
+		if replayer, ok := p.(interface{ SpooledEvents() int }); ok {
+			spooled += replayer.SpooledEvents()
+		}
+	}
+	return spooled
+}
+
+// SetDeadline passes deadline on to every publisher that retries failed sends
+func (t *Tee) SetDeadline(deadline time.Time) {
+	for _, p := range t.all() {
+		if setter, ok := p.(interface{ SetDeadline(time.Time) }); ok {
+			setter.SetDeadline(deadline)
+		}
+	}
+}
+
+// Degraded returns the primary's error while it is persistently failing to
+// send, or nil otherwise. Forwarders failing don't degrade the extension.
+func (t *Tee) Degraded() error {
+	if reporter, ok := t.primary.(interface{ Degraded() error }); ok {
+		return reporter.Degraded()
+	}
+	return nil
+}
+
+func (t *Tee) all() []Publisher {
+	return append([]Publisher{t.primary}, t.forwarders...)
+}
@@ -0,0 +1,67 @@
+package publisher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// reportingMemory is a Memory that reports backpressure and dropped events
+type reportingMemory struct {
+	*Memory
+	full    bool
+	dropped int64
+}
+
+func (m *reportingMemory) Full() bool {
+	return m.full
+}
+
+func (m *reportingMemory) DroppedSinceLastReport() int64 {
+	return m.dropped
+}
+
+// sendingMemory is a Memory with a background sender to wake
+type sendingMemory struct {
+	*Memory
+	woken int
+}
+
+func (m *sendingMemory) SendSoon() {
+	m.woken++
+}
+
+func TestTeePublishesToEveryPublisher(t *testing.T) {
+	primary := NewMemory()
+	forwarder := NewMemory()
+	sender := &sendingMemory{Memory: NewMemory()}
+	tee := NewTee(primary, forwarder, sender)
+
+	ev := tee.NewEvent()
+	ev.AddField("method", "test")
+	assert.NoError(t, tee.Publish(ev))
+	tee.SendForwardersSoon()
+	assert.Equal(t, 1, sender.woken)
+	assert.Equal(t, 0, primary.Flushes()+forwarder.Flushes()+sender.Flushes(), "expected nothing to be flushed")
+	tee.Flush()
+
+	for _, p := range []*Memory{primary, forwarder, sender.Memory} {
+		if assert.Len(t, p.Events(), 1) {
+			assert.Equal(t, "test", p.Events()[0].Fields()["method"])
+		}
+	}
+	assert.Equal(t, 1, primary.Flushes())
+	assert.Equal(t, 1, forwarder.Flushes())
+}
+
+func TestTeePassesOnCapabilities(t *testing.T) {
+	primary := &reportingMemory{Memory: NewMemory(), dropped: 2}
+	forwarder := &reportingMemory{Memory: NewMemory(), full: true, dropped: 3}
+	tee := NewTee(primary, forwarder)
+
+	assert.False(t, tee.Full(), "expected a full forwarder not to hold back the primary")
+	primary.full = true
+	assert.True(t, tee.Full())
+	assert.Equal(t, int64(5), tee.DroppedSinceLastReport())
+	assert.NoError(t, tee.Degraded())
+}
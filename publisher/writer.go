@@ -0,0 +1,97 @@
+package publisher
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Writer is a Publisher that writes every event to an io.Writer as a line of
+// JSON, for debugging locally. Lines take the same shape as the events a
+// Beeline writes to stdout:
+//
+//	{"time": "...", "dataset": "...", "samplerate": 1, "data": {...}}
+type Writer struct {
+	dataset string
+
+	mu     sync.Mutex
+	out    *bufio.Writer
+	closer io.Closer
+}
+
+// writtenEvent is the line written for each event
+type writtenEvent struct {
+	Time       time.Time              `json:"time"`
+	Dataset    string                 `json:"dataset,omitempty"`
+	SampleRate uint                   `json:"samplerate,omitempty"`
+	Data       map[string]interface{} `json:"data"`
+}
+
+// NewWriter returns a Writer writing events to w. Events without a dataset of
+// their own are written with dataset.
+func NewWriter(w io.Writer, dataset string) *Writer {
+	return &Writer{dataset: dataset, out: bufio.NewWriter(w)}
+}
+
+// OpenWriter returns a Writer appending events to the file at path, creating
+// it if need be, or writing them to stdout if path is empty.
+func OpenWriter(path, dataset string) (*Writer, error) {
+	if path == "" {
+		return NewWriter(os.Stdout, dataset), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := NewWriter(f, dataset)
+	w.closer = f
+	return w, nil
+}
+
+func (w *Writer) NewEvent() *Event {
+	return &Event{}
+}
+
+// Publish writes ev, which may stay buffered until the next Flush
+func (w *Writer) Publish(ev *Event) error {
+	dataset := ev.Dataset
+	if dataset == "" {
+		dataset = w.dataset
+	}
+	line, err := json.Marshal(writtenEvent{
+		Time:       ev.timestamp(),
+		Dataset:    dataset,
+		SampleRate: ev.SampleRate,
+		Data:       ev.Fields(),
+	})
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.out.Write(line); err != nil {
+		return err
+	}
+	return w.out.WriteByte('\n')
+}
+
+func (w *Writer) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.out.Flush(); err != nil {
+		log.WithError(err).Warn("Unable to write events")
+	}
+}
+
+// Close flushes buffered events, and closes the file they're written to if
+// the Writer opened it.
+func (w *Writer) Close() error {
+	w.Flush()
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
@@ -0,0 +1,51 @@
+package publisher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriterWritesJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, "lambda")
+
+	ev := w.NewEvent()
+	ev.Timestamp = time.Date(2020, 12, 25, 12, 34, 56, 789000000, time.UTC)
+	ev.SampleRate = 5
+	ev.AddField("name", "handle-request")
+	assert.NoError(t, w.Publish(ev))
+	other := w.NewEvent()
+	other.Timestamp = ev.Timestamp
+	other.Dataset = "self"
+	assert.NoError(t, w.Publish(other))
+	assert.Empty(t, out.String(), "expected events to be buffered until flushed")
+
+	w.Flush()
+	assert.Equal(t, `{"time":"2020-12-25T12:34:56.789Z","dataset":"lambda","samplerate":5,"data":{"name":"handle-request"}}
+{"time":"2020-12-25T12:34:56.789Z","dataset":"self","data":{}}
+`, out.String())
+}
+
+func TestOpenWriterAppendsToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	assert.NoError(t, os.WriteFile(path, []byte("{}\n"), 0o644))
+
+	w, err := OpenWriter(path, "lambda")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, w.Publish(NewEvent(map[string]interface{}{"n": 1})))
+	assert.NoError(t, w.Close())
+
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(contents), []byte("\n"))
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, string(lines[1]), `"data":{"n":1}`)
+	}
+}
@@ -0,0 +1,154 @@
+package telemetryapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// receiverShutdownTimeout bounds how long the receiver waits for in-flight
+// batches when it is shut down because its context was cancelled.
+const receiverShutdownTimeout = time.Second
+
+// Receiver is the HTTP server that the Telemetry API delivers batches of
+// telemetry to. It keeps count of handlers in flight so that, on shutdown,
+// callers can wait until every batch already delivered has been enqueued.
+type Receiver struct {
+	server *http.Server
+	addr   net.Addr
+	init   *initFields
+
+	mu        sync.Mutex
+	inFlight  int
+	closing   bool
+	drained   chan struct{}
+	drainOnce sync.Once
+}
+
+// NewReceiver returns a Receiver for the specified port that sends the
+// telemetry it receives as events with the eventCreator provided as client.
+// The observer, if not nil, is notified of invocations starting and finishing.
+func NewReceiver(port int, client eventCreator, observer invocationObserver) *Receiver {
+	r := &Receiver{drained: make(chan struct{}), init: &initFields{}}
+	mux := http.NewServeMux()
+	mux.Handle("/", r.track(handler(client, observer, r.init)))
+	r.server = &http.Server{
+		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
+		Handler: mux,
+	}
+	return r
+}
+
+// StartTelemetryReceiver starts a small HTTP server on the specified port.
+// The server receives log messages in AWS Lambda's [Telemetry API message format]
+// (JSON array of messages) and the handler will send them to Honeycomb
+// as events with the eventCreator provided as client.
+//
+// When running in Lambda, the extension's subscription to telemetry types will
+// result in the Lambda Telemetry API publishing log messages to this receiver.
+//
+// When running in localMode, the server will be started for manual posting of
+// log messages to the specified port for testing.
+//
+// The observer, if not nil, is notified of invocations starting and finishing.
+// The server is shut down when ctx is cancelled, if it hasn't been already.
+//
+// [Telemetry API message format]: https://docs.aws.amazon.com/lambda/latest/dg/telemetry-api.html#telemetry-api-messages
+func StartTelemetryReceiver(ctx context.Context, port int, client eventCreator, observer invocationObserver) (*Receiver, error) {
+	r := NewReceiver(port, client, observer)
+	if err := r.Start(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start listens on the receiver's port and serves requests in the background.
+// An error is returned if the port can't be listened on.
+func (r *Receiver) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", r.server.Addr)
+	if err != nil {
+		return err
+	}
+	r.addr = listener.Addr()
+	log.Info("Telemetry server listening on ", r.addr)
+
+	go func() {
+		if err := r.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Error("Telemetry server stopped unexpectedly")
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), receiverShutdownTimeout)
+		defer cancel()
+		if err := r.Shutdown(shutdownCtx); err != nil {
+			log.WithError(err).Warn("Telemetry server did not shut down cleanly")
+		}
+	}()
+	return nil
+}
+
+// AddInitFields adds fields to record on the platform.initReport event, such
+// as the outcome of checks the extension makes while it initializes. Fields
+// added once the event has been received are recorded on the next platform
+// event instead.
+func (r *Receiver) AddInitFields(fields map[string]interface{}) {
+	r.init.add(fields)
+}
+
+// Shutdown stops the receiver accepting new batches and waits until every
+// handler already in flight has enqueued its events, or ctx is done. It is safe
+// to call more than once.
+func (r *Receiver) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	r.closing = true
+	if r.inFlight == 0 {
+		r.closeDrained()
+	}
+	r.mu.Unlock()
+
+	err := r.server.Shutdown(ctx)
+	select {
+	case <-r.drained:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drained returns a channel that is closed once the receiver is shutting down
+// and no handlers remain in flight.
+func (r *Receiver) Drained() <-chan struct{} {
+	return r.drained
+}
+
+// track wraps next to keep count of handlers in flight
+func (r *Receiver) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		r.inFlight++
+		r.mu.Unlock()
+
+		defer func() {
+			r.mu.Lock()
+			r.inFlight--
+			if r.closing && r.inFlight == 0 {
+				r.closeDrained()
+			}
+			r.mu.Unlock()
+		}()
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// closeDrained signals that the receiver has drained. The caller must hold r.mu.
+func (r *Receiver) closeDrained() {
+	r.drainOnce.Do(func() {
+		close(r.drained)
+	})
+}
@@ -0,0 +1,95 @@
+package telemetryapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
+)
+
+func TestReceiverShutdownDrainsInFlightBatches(t *testing.T) {
+	memory := publisher.NewMemory()
+	client := &blockingEventCreator{Memory: memory, release: make(chan struct{}), entered: make(chan struct{}, 1)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	receiver, err := StartTelemetryReceiver(ctx, 0, client, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	b, _ := json.Marshal([]LogMessage{nonJsonFunctionMessage})
+	posted := make(chan int)
+	go func() {
+		res, err := http.Post(fmt.Sprintf("http://%s/", receiver.addr), "application/json", bytes.NewBuffer(b))
+		if err != nil {
+			posted <- 0
+			return
+		}
+		res.Body.Close()
+		posted <- res.StatusCode
+	}()
+	<-client.entered
+
+	shutdownErr := make(chan error)
+	go func() {
+		shutdownErr <- receiver.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-receiver.Drained():
+		t.Fatal("receiver drained while a batch was still being handled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(client.release)
+	assert.NoError(t, <-shutdownErr)
+	assert.Equal(t, http.StatusOK, <-posted)
+	assert.Len(t, memory.Events(), 1, "in-flight batch should be enqueued before drained")
+	select {
+	case <-receiver.Drained():
+	default:
+		t.Error("expected receiver to be drained")
+	}
+}
+
+func TestReceiverShutdownOnContextCancel(t *testing.T) {
+	memory := publisher.NewMemory()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	receiver, err := StartTelemetryReceiver(ctx, 0, memory, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cancel()
+
+	select {
+	case <-receiver.Drained():
+	case <-time.After(time.Second):
+		t.Error("expected receiver to drain after context cancellation")
+	}
+}
+
+// blockingEventCreator holds up the handler until released
+type blockingEventCreator struct {
+	*publisher.Memory
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingEventCreator) NewEvent() *publisher.Event {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return b.Memory.NewEvent()
+}
@@ -3,13 +3,20 @@ package telemetryapi
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"maps"
 	"net/http"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	libhoney "github.com/honeycombio/libhoney-go"
 	logrus "github.com/sirupsen/logrus"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
 )
 
 // LogMessage is an Event record sent from the Telemetry API
@@ -19,10 +26,69 @@ type LogMessage struct {
 	Record interface{} `json:"record"`
 }
 
+// eventCreator is the interface that provides a way to create events and
+// publish them
 type eventCreator interface {
-	NewEvent() *libhoney.Event
+	NewEvent() *publisher.Event
+	Publish(ev *publisher.Event) error
+}
+
+// backpressurer is implemented by event creators that can be temporarily
+// unable to accept more events. When Full returns true, batches are refused
+// with a 503 so that the Telemetry API holds on to them and retries later.
+type backpressurer interface {
+	Full() bool
+}
+
+// dropReporter is implemented by event creators that may drop events when they
+// can't keep up. The count is recorded on the next platform.start event.
+type dropReporter interface {
+	DroppedSinceLastReport() int64
+}
+
+// invocationObserver is notified of invocation lifecycles and received volume
+// as the receiver handles telemetry batches.
+type invocationObserver interface {
+	InvocationStarted(requestID string)
+	InvocationDone(requestID string)
+	EventsEnqueued(bytes int)
 }
 
+const (
+	// platformStart is the Telemetry API event type emitted when an invocation starts
+	platformStart = "platform.start"
+	// platformRuntimeDone is the Telemetry API event type emitted when the runtime
+	// has finished handling an invocation
+	platformRuntimeDone = "platform.runtimeDone"
+	// platformInitReport is the Telemetry API event type emitted once the
+	// init phase is over, describing how it went
+	platformInitReport = "platform.initReport"
+
+	// backpressureRetryAfter is sent as Retry-After, in seconds, when refusing
+	// a batch because the publisher is full
+	backpressureRetryAfter = "1"
+
+	// minMessagesPerWorker keeps small batches from being spread over more
+	// parsing workers than is worth the coordination
+	minMessagesPerWorker = 64
+
+	// droppedEventsField is added to a platform.start event with the number of
+	// events dropped since the previous one reported drops
+	droppedEventsField = "lambda_extension.dropped_events"
+)
+
+// Self-metrics counted for each outcome of handling a batch
+const (
+	MetricBatchesAccepted      = "receiver.batches_accepted"
+	MetricBatchesMalformed     = "receiver.batches_malformed"
+	MetricBatchesBackpressured = "receiver.batches_backpressured"
+	MetricRequestsBadMethod    = "receiver.requests_bad_method"
+	MetricEventsReceived       = "receiver.events_received"
+	MetricBytesReceived        = "receiver.bytes_received"
+	MetricEventsParsed         = "receiver.events_parsed"
+	MetricRecordParseErrors    = "receiver.record_parse_errors"
+)
+
 var (
 	// set up logging defaults for our own logging output
 	log = logrus.WithFields(logrus.Fields{
@@ -30,71 +96,309 @@ var (
 	})
 )
 
+// initFields are fields describing the extension's own init, such as the
+// outcome of checks it makes, recorded on the platform.initReport event. Fields
+// added once that event has gone by are recorded on the next platform event
+// instead.
+type initFields struct {
+	mu       sync.Mutex
+	fields   map[string]interface{}
+	reported bool
+	late     map[string]interface{}
+}
+
+// add adds fields to those recorded on the platform.initReport event, or on
+// the next platform event if it has already gone by
+func (f *initFields) add(fields map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reported {
+		log.Info("Extension init finished after platform.initReport, recording its outcome on the next platform event")
+		if f.late == nil {
+			f.late = make(map[string]interface{}, len(fields))
+		}
+		maps.Copy(f.late, fields)
+		return
+	}
+	if f.fields == nil {
+		f.fields = make(map[string]interface{}, len(fields))
+	}
+	maps.Copy(f.fields, fields)
+}
+
+// addTo adds the fields to the platform.initReport event. A nil *initFields
+// adds none.
+func (f *initFields) addTo(event *publisher.Event) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event.AddFields(f.fields)
+	f.reported = true
+}
+
+// addLateTo adds the fields added since the platform.initReport event went by
+// to another platform event, once. A nil *initFields adds none.
+func (f *initFields) addLateTo(event *publisher.Event) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	event.AddFields(f.late)
+	f.late = nil
+}
+
 // handler receives batches of log messages from the Lambda Telemetry API. Each
-// LogMessage is sent to Honeycomb as a separate event.
-func handler(client eventCreator) http.HandlerFunc {
+// LogMessage is sent to Honeycomb as a separate event. If observer is not nil,
+// it is told about platform lifecycle events once the batch is enqueued. If
+// init is not nil, its fields are recorded on the platform.initReport event,
+// or on the next platform event if they come after it.
+//
+// The response status tells the Telemetry API whether to retry: a 200 once the
+// batch is enqueued, a 4xx for a request that will never succeed, and a 503
+// when the client is too full to accept the batch right now.
+func handler(client eventCreator, observer invocationObserver, init *initFields) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Debug("handler - log batch received")
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Warn("Error", err)
+		if r.Method != http.MethodPost {
+			metrics.Increment(MetricRequestsBadMethod)
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if bp, ok := client.(backpressurer); ok && bp.Full() {
+			metrics.Increment(MetricBatchesBackpressured)
+			log.Warn("Publisher is full, asking the Telemetry API to retry the batch later")
+			w.Header().Set("Retry-After", backpressureRetryAfter)
+			http.Error(w, "event queue is full", http.StatusServiceUnavailable)
 			return
 		}
-		defer r.Body.Close()
 
 		// The Telemetry API will send batches of events as an array of JSON objects.
 		// Each object will have time, type and record as the top-level keys. If
 		// the log message is a function message, the record element will contain
 		// whatever was emitted by the function to stdout. This could be a structured
 		// log message (JSON) or a plain string.
-		var logs []LogMessage
-		err = json.Unmarshal(body, &logs)
+		body := &countingReader{r: r.Body}
+		defer r.Body.Close()
+		raws, err := decodeBatch(body)
+		metrics.Add(MetricBytesReceived, int64(body.n))
 		if err != nil {
-			log.Warn("Could not unmarshal payload", err)
+			metrics.Increment(MetricBatchesMalformed)
+			log.Warn("Could not unmarshal payload: ", err)
+			http.Error(w, "could not unmarshal request body", http.StatusBadRequest)
 			return
 		}
 
-		// Iterate through the batch of log messages received. A function log
-		// message's Record holds whatever the function wrote to stdout, in one
-		// of two encodings. With plain-text log format (and all Logs API /
-		// pre-2022-12-13 schema deliveries), Record is a string that may itself
-		// contain JSON. With JSON log format, Lambda pre-parses the line:
-		// a line that was already JSON arrives as that object verbatim, and a
-		// non-JSON line arrives wrapped as {timestamp, level, message}.
-		// Normalize all of these into the same structured handling so a span
-		// emitted by libhoney/beeline parses identically regardless of the
-		// function's logging config.
-		for _, msg := range logs {
-			event := client.NewEvent()
-			event.AddField("lambda_extension.type", msg.Type)
-
-			switch record := msg.Record.(type) {
-			case string:
-				addRecordString(event, msg, record)
-			case map[string]interface{}:
-				if inner, ok := record["message"].(string); ok && record["data"] == nil {
-					// JSON-log-format wrapper around a non-JSON line; unwrap and
-					// handle the original line as if it had arrived unwrapped.
-					addRecordString(event, msg, inner)
-				} else {
-					addRecordJSON(event, msg, record)
+		// Records are parsed and turned into events in parallel, then sent in
+		// the order they were received.
+		logs, events := buildEvents(client, raws, runtime.GOMAXPROCS(0))
+		var doneRequestIDs []string
+		for i, msg := range logs {
+			event := events[i]
+			switch msg.Type {
+			case platformStart:
+				addDroppedEvents(client, event)
+			case platformInitReport:
+				init.addTo(event)
+			}
+			if msg.Type != platformInitReport && strings.HasPrefix(msg.Type, "platform.") {
+				init.addLateTo(event)
+			}
+			if observer != nil {
+				switch msg.Type {
+				case platformStart:
+					if requestID := recordRequestID(msg); requestID != "" {
+						observer.InvocationStarted(requestID)
+					}
+				case platformRuntimeDone:
+					if requestID := recordRequestID(msg); requestID != "" {
+						doneRequestIDs = append(doneRequestIDs, requestID)
+					}
 				}
-			default:
-				event.Timestamp = parseMessageTimestamp(event, msg)
-				event.Add(msg.Record)
 			}
-			event.Metadata, _ = event.Fields()["name"]
-			event.SendPresampled()
+			if err := client.Publish(event); err != nil {
+				// the events already published are sent again with the
+				// retried batch, which beats dropping the rest of it
+				metrics.Increment(MetricBatchesBackpressured)
+				log.WithError(err).Warn("Publisher could not accept an event, asking the Telemetry API to retry the batch later")
+				w.Header().Set("Retry-After", backpressureRetryAfter)
+				http.Error(w, "event queue is full", http.StatusServiceUnavailable)
+				return
+			}
 			log.Debug("handler - event enqueued")
 		}
+
+		metrics.Increment(MetricBatchesAccepted)
+		metrics.Add(MetricEventsReceived, int64(len(logs)))
+
+		if observer != nil {
+			observer.EventsEnqueued(body.n)
+			for _, requestID := range doneRequestIDs {
+				observer.InvocationDone(requestID)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// rawLogMessage is a LogMessage whose record is yet to be decoded
+type rawLogMessage struct {
+	Type   string          `json:"type"`
+	Time   string          `json:"time"`
+	Record json.RawMessage `json:"record"`
+}
+
+// decode returns the LogMessage with its record decoded
+func (m rawLogMessage) decode() LogMessage {
+	msg := LogMessage{Type: m.Type, Time: m.Time}
+	if len(m.Record) > 0 {
+		if err := json.Unmarshal(m.Record, &msg.Record); err != nil {
+			msg.Record = string(m.Record)
+		}
+	}
+	return msg
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// decodeBatch streams a JSON array of log messages from body, leaving each
+// record undecoded.
+func decodeBatch(body io.Reader) ([]rawLogMessage, error) {
+	dec := json.NewDecoder(body)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("expected an array of log messages, got %v", tok)
+	}
+	var raws []rawLogMessage
+	for dec.More() {
+		var raw rawLogMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		raws = append(raws, raw)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return raws, nil
+}
+
+// buildEvents decodes each message's record and builds its event, spreading
+// the work over up to maxWorkers workers when the batch is large enough to be
+// worth it. Messages and events are returned in the order they were received.
+func buildEvents(client eventCreator, raws []rawLogMessage, maxWorkers int) ([]LogMessage, []*publisher.Event) {
+	logs := make([]LogMessage, len(raws))
+	events := make([]*publisher.Event, len(raws))
+	build := func(i int) {
+		logs[i] = raws[i].decode()
+		events[i] = buildEvent(client, logs[i])
+	}
+
+	workers := min(maxWorkers, len(raws)/minMessagesPerWorker)
+	if workers <= 1 {
+		for i := range raws {
+			build(i)
+		}
+		return logs, events
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for i := int(next.Add(1) - 1); i < len(raws); i = int(next.Add(1) - 1) {
+				build(i)
+			}
+		})
+	}
+	wg.Wait()
+	return logs, events
+}
+
+// buildEvent creates the event for a single log message. A function log
+// message's Record holds whatever the function wrote to stdout, in one of two
+// encodings. With plain-text log format (and all Logs API / pre-2022-12-13
+// schema deliveries), Record is a string that may itself contain JSON. With
+// JSON log format, Lambda pre-parses the line: a line that was already JSON
+// arrives as that object verbatim, and a non-JSON line arrives wrapped as
+// {timestamp, level, message}. Normalize all of these into the same structured
+// handling so a span emitted by libhoney/beeline parses identically regardless
+// of the function's logging config.
+func buildEvent(client eventCreator, msg LogMessage) *publisher.Event {
+	event := client.NewEvent()
+	event.AddField("lambda_extension.type", msg.Type)
+
+	switch record := msg.Record.(type) {
+	case string:
+		addRecordString(event, msg, record)
+	case map[string]interface{}:
+		if inner, ok := record["message"].(string); ok && record["data"] == nil {
+			// JSON-log-format wrapper around a non-JSON line; unwrap and
+			// handle the original line as if it had arrived unwrapped.
+			addRecordString(event, msg, inner)
+		} else {
+			addRecordJSON(event, msg, record)
+		}
+	default:
+		// any other record is a bare JSON value, with no fields to add
+		event.Timestamp = parseMessageTimestamp(event, msg)
+	}
+	event.Metadata, _ = event.Fields()["name"]
+	return event
+}
+
+// addDroppedEvents records on event how many events the client has dropped
+// since it last reported drops, if any.
+func addDroppedEvents(client eventCreator, event *publisher.Event) {
+	reporter, ok := client.(dropReporter)
+	if !ok {
+		return
+	}
+	if dropped := reporter.DroppedSinceLastReport(); dropped > 0 {
+		event.AddField(droppedEventsField, dropped)
 	}
 }
 
+// recordRequestID returns the requestId of a platform event's record, or an
+// empty string if there isn't one.
+func recordRequestID(msg LogMessage) string {
+	record, ok := msg.Record.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	requestID, _ := record["requestId"].(string)
+	return requestID
+}
+
 // addRecordString populates event from a raw log line, parsing it as JSON when
-// possible and falling back to a timestamped "record" string field.
-func addRecordString(event *libhoney.Event, msg LogMessage, record string) {
+// possible and falling back to a timestamped "record" string field. Lines that
+// can't be a JSON object aren't given to the JSON decoder at all.
+func addRecordString(event *publisher.Event, msg LogMessage, record string) {
 	var jsonRecord map[string]interface{}
+	if !strings.HasPrefix(strings.TrimLeft(record, " \t\r\n"), "{") {
+		event.Timestamp = parseMessageTimestamp(event, msg)
+		event.AddField("record", record)
+		return
+	}
 	if err := json.Unmarshal([]byte(record), &jsonRecord); err != nil {
+		metrics.Increment(MetricRecordParseErrors)
 		event.Timestamp = parseMessageTimestamp(event, msg)
 		event.AddField("record", record)
 		return
@@ -104,22 +408,23 @@ func addRecordString(event *libhoney.Event, msg LogMessage, record string) {
 
 // addRecordJSON populates event from a structured record: fields come from the
 // libhoney envelope's data map when present, otherwise from the record itself.
-func addRecordJSON(event *libhoney.Event, msg LogMessage, jsonRecord map[string]interface{}) {
+func addRecordJSON(event *publisher.Event, msg LogMessage, jsonRecord map[string]interface{}) {
+	metrics.Increment(MetricEventsParsed)
 	event.Timestamp = parseFunctionTimestamp(msg, jsonRecord)
 	switch data := jsonRecord["data"].(type) {
 	case map[string]interface{}:
 		// data key contains a map, likely emitted by a Beeline's libhoney, so add the fields from it
-		event.Add(data)
+		event.AddFields(data)
 	default:
 		// data is not a map, so treat the record as flat JSON adding all keys as fields
-		event.Add(jsonRecord)
+		event.AddFields(jsonRecord)
 	}
 	event.SampleRate = parseSampleRate(jsonRecord)
 }
 
 // parseMessageTimestamp is a helper function that tries to parse the timestamp from the
 // log event payload. If it cannot parse the timestamp, it returns the current timestamp.
-func parseMessageTimestamp(event *libhoney.Event, msg LogMessage) time.Time {
+func parseMessageTimestamp(event *publisher.Event, msg LogMessage) time.Time {
 	log.Debug("parseMessageTimestamp")
 	ts, err := time.Parse(time.RFC3339, msg.Time)
 	if err != nil {
@@ -218,26 +523,3 @@ func parseFunctionTimestamp(msg LogMessage, body map[string]interface{}) time.Ti
 
 	return messageTime
 }
-
-// StartTelemetryReceiver starts a small HTTP server on the specified port.
-// The server receives log messages in AWS Lambda's [Telemetry API message format]
-// (JSON array of messages) and the handler will send them to Honeycomb
-// as events with the eventCreator provided as client.
-//
-// When running in Lambda, the extension's subscription to telemetry types will
-// result in the Lambda Telemetry API publishing log messages to this receiver.
-//
-// When running in localMode, the server will be started for manual posting of
-// log messages to the specified port for testing.
-//
-// [Telemetry API message format]: https://docs.aws.amazon.com/lambda/latest/dg/telemetry-api.html#telemetry-api-messages
-func StartTelemetryReceiver(port int, client eventCreator) {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", handler(client))
-	server := &http.Server{
-		Addr:    fmt.Sprintf("0.0.0.0:%d", port),
-		Handler: mux,
-	}
-	log.Info("Telemetry server listening on port ", port)
-	log.Fatal(server.ListenAndServe())
-}
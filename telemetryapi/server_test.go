@@ -3,15 +3,17 @@ package telemetryapi
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
-	libhoney "github.com/honeycombio/libhoney-go"
-	"github.com/honeycombio/libhoney-go/transmission"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/honeycombio/honeycomb-lambda-extension/metrics"
+	"github.com/honeycombio/honeycomb-lambda-extension/publisher"
 )
 
 var (
@@ -81,7 +83,7 @@ var (
 	}
 )
 
-func postMessages(t *testing.T, messages []LogMessage) []*transmission.Event {
+func postMessages(t *testing.T, messages []LogMessage) []*publisher.Event {
 	rr := httptest.NewRecorder()
 	b, err := json.Marshal(messages)
 	if err != nil {
@@ -91,17 +93,13 @@ func postMessages(t *testing.T, messages []LogMessage) []*transmission.Event {
 	if err != nil {
 		t.Error(err)
 	}
-	testTx := &transmission.MockSender{}
-	client, _ := libhoney.NewClient(libhoney.ClientConfig{
-		Transmission: testTx,
-		APIKey:       "blah",
-	})
-	handler(client).ServeHTTP(rr, req)
+	memory := publisher.NewMemory()
+	handler(memory, nil, nil).ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
 		t.Errorf("handler returned wrong status code: got %v want %v",
 			status, http.StatusOK)
 	}
-	return testTx.Events()
+	return memory.Events()
 }
 
 func TestLogMessage(t *testing.T) {
@@ -109,16 +107,16 @@ func TestLogMessage(t *testing.T) {
 
 	assert.Equal(t, 7, len(events))
 
-	assert.Equal(t, "platform.start", events[0].Data["lambda_extension.type"])
-	assert.Equal(t, "function", events[1].Data["lambda_extension.type"])
-	assert.Equal(t, "function", events[2].Data["lambda_extension.type"])
-	assert.Equal(t, "function", events[3].Data["lambda_extension.type"])
+	assert.Equal(t, "platform.start", events[0].Fields()["lambda_extension.type"])
+	assert.Equal(t, "function", events[1].Fields()["lambda_extension.type"])
+	assert.Equal(t, "function", events[2].Fields()["lambda_extension.type"])
+	assert.Equal(t, "function", events[3].Fields()["lambda_extension.type"])
 
-	assert.Equal(t, "$LATEST", events[0].Data["version"])
-	assert.Equal(t, "A basic message to STDOUT", events[1].Data["record"])
-	assert.Equal(t, "bar", events[2].Data["foo"])
-	assert.Equal(t, "bar", events[5].Data["foo"])
-	assert.Equal(t, "an android", events[6].Data["data"])
+	assert.Equal(t, "$LATEST", events[0].Fields()["version"])
+	assert.Equal(t, "A basic message to STDOUT", events[1].Fields()["record"])
+	assert.Equal(t, "bar", events[2].Fields()["foo"])
+	assert.Equal(t, "bar", events[5].Fields()["foo"])
+	assert.Equal(t, "an android", events[6].Fields()["data"])
 }
 
 func TestLogMessageFromLibhoneyTransmission(t *testing.T) {
@@ -139,8 +137,8 @@ func TestLogMessageFromLibhoneyTransmission(t *testing.T) {
 		parsedEvent.Timestamp.String(),
 		"Want: 🎄! Do not want: epoch. The event's time should be from the time key within the Transmission JSON, not the Lambda Function's log timestamp.",
 	)
-	assert.Equal(t, "bar", parsedEvent.Data["foo"], "The foo and its value should have been found under the data key within the Transmission JSON.")
-	assert.Equal(t, float64(54), parsedEvent.Data["duration_ms"], "The duration should have been found under the data key within the Transmission JSON.")
+	assert.Equal(t, "bar", parsedEvent.Fields()["foo"], "The foo and its value should have been found under the data key within the Transmission JSON.")
+	assert.Equal(t, float64(54), parsedEvent.Fields()["duration_ms"], "The duration should have been found under the data key within the Transmission JSON.")
 }
 
 func TestLogMessageJsonWithUnmappableData(t *testing.T) {
@@ -148,7 +146,7 @@ func TestLogMessageJsonWithUnmappableData(t *testing.T) {
 
 	parsedEvent := events[0]
 
-	assert.Equal(t, "an android", parsedEvent.Data["data"], "The Data map on the Event should contain a field named 'data' with a single value.")
+	assert.Equal(t, "an android", parsedEvent.Fields()["data"], "The Data map on the Event should contain a field named 'data' with a single value.")
 }
 
 func TestTimestampsFunctionMessageNoJson(t *testing.T) {
@@ -291,9 +289,9 @@ func TestJSONFormatRecordObjects(t *testing.T) {
 			},
 		}})
 		event := events[0]
-		assert.Equal(t, "QueryKiller.Tick", event.Data["name"])
-		assert.Equal(t, "97cac7afa949e6e0ccf399e11509c275", event.Data["trace.trace_id"])
-		assert.NotContains(t, event.Data, "data", "envelope must be unwrapped, not double-encoded")
+		assert.Equal(t, "QueryKiller.Tick", event.Fields()["name"])
+		assert.Equal(t, "97cac7afa949e6e0ccf399e11509c275", event.Fields()["trace.trace_id"])
+		assert.NotContains(t, event.Fields(), "data", "envelope must be unwrapped, not double-encoded")
 		ts, _ := time.Parse(time.RFC3339, christmasTimestamp)
 		assert.Equal(t, ts.String(), event.Timestamp.String())
 		assert.EqualValues(t, 5, event.SampleRate)
@@ -310,7 +308,7 @@ func TestJSONFormatRecordObjects(t *testing.T) {
 			},
 		}})
 		event := events[0]
-		assert.Equal(t, "A basic message to STDOUT", event.Data["record"])
+		assert.Equal(t, "A basic message to STDOUT", event.Fields()["record"])
 	})
 
 	t.Run("wrapped message containing JSON is unwrapped and parsed", func(t *testing.T) {
@@ -324,6 +322,338 @@ func TestJSONFormatRecordObjects(t *testing.T) {
 			},
 		}})
 		event := events[0]
-		assert.Equal(t, "bar", event.Data["foo"])
+		assert.Equal(t, "bar", event.Fields()["foo"])
 	})
 }
+
+func TestObserverNotifiedOfInvocations(t *testing.T) {
+	observer := &fakeObserver{}
+	b, err := json.Marshal([]LogMessage{
+		{
+			Time:   "2020-11-03T21:10:25.133Z",
+			Type:   "platform.start",
+			Record: map[string]string{"requestId": "1"},
+		},
+		nonJsonFunctionMessage,
+		{
+			Time:   "2020-11-03T21:10:25.160Z",
+			Type:   "platform.runtimeDone",
+			Record: map[string]string{"requestId": "1", "status": "success"},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(b))
+	if err != nil {
+		t.Error(err)
+	}
+	client := publisher.NewMemory()
+	handler(client, observer, nil).ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, []string{"1"}, observer.started)
+	assert.Equal(t, []string{"1"}, observer.done)
+	assert.Equal(t, len(b), observer.bytes)
+}
+
+type fakeObserver struct {
+	started []string
+	done    []string
+	bytes   int
+}
+
+func (f *fakeObserver) InvocationStarted(requestID string) {
+	f.started = append(f.started, requestID)
+}
+
+func (f *fakeObserver) InvocationDone(requestID string) {
+	f.done = append(f.done, requestID)
+}
+
+func (f *fakeObserver) EventsEnqueued(bytes int) {
+	f.bytes += bytes
+}
+
+func TestHandlerStatusCodes(t *testing.T) {
+	validBody, _ := json.Marshal([]LogMessage{nonJsonFunctionMessage})
+	threeMessages, _ := json.Marshal([]LogMessage{nonJsonFunctionMessage, nonJsonFunctionMessage, nonJsonFunctionMessage})
+	testCases := []struct {
+		desc           string
+		method         string
+		body           []byte
+		full           bool
+		fillAfter      int
+		expectedStatus int
+		expectedMetric string
+		expectedEvents int
+	}{
+		{
+			desc:           "accepted",
+			method:         "POST",
+			body:           validBody,
+			expectedStatus: http.StatusOK,
+			expectedMetric: MetricBatchesAccepted,
+			expectedEvents: 1,
+		},
+		{
+			desc:           "malformed body",
+			method:         "POST",
+			body:           []byte(`[{"type": "function", "record": `),
+			expectedStatus: http.StatusBadRequest,
+			expectedMetric: MetricBatchesMalformed,
+		},
+		{
+			desc:           "not a POST",
+			method:         "GET",
+			expectedStatus: http.StatusMethodNotAllowed,
+			expectedMetric: MetricRequestsBadMethod,
+		},
+		{
+			desc:           "publisher is full",
+			method:         "POST",
+			body:           validBody,
+			full:           true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedMetric: MetricBatchesBackpressured,
+		},
+		{
+			desc:           "publisher fills partway through the batch",
+			method:         "POST",
+			body:           threeMessages,
+			fillAfter:      1,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedMetric: MetricBatchesBackpressured,
+			expectedEvents: 1,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			memory := publisher.NewMemory()
+			client := &fakeFullEventCreator{Memory: memory, full: tC.full, fillAfter: tC.fillAfter}
+			req, _ := http.NewRequest(tC.method, "/", bytes.NewBuffer(tC.body))
+			rr := httptest.NewRecorder()
+			before := metrics.Default.Counter(tC.expectedMetric)
+
+			handler(client, nil, nil).ServeHTTP(rr, req)
+
+			assert.Equal(t, tC.expectedStatus, rr.Code)
+			assert.Equal(t, before+1, metrics.Default.Counter(tC.expectedMetric))
+			assert.Len(t, memory.Events(), tC.expectedEvents)
+			if tC.expectedStatus == http.StatusServiceUnavailable {
+				assert.Equal(t, backpressureRetryAfter, rr.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+// fakeFullEventCreator is full from the start if full is set, or refuses
+// events once it has accepted fillAfter of them if that isn't 0
+type fakeFullEventCreator struct {
+	*publisher.Memory
+	full      bool
+	fillAfter int
+}
+
+func (f *fakeFullEventCreator) Publish(ev *publisher.Event) error {
+	if f.fillAfter > 0 && len(f.Events()) >= f.fillAfter {
+		return errors.New("ingestion queue full")
+	}
+	return f.Memory.Publish(ev)
+}
+
+func (f *fakeFullEventCreator) Full() bool {
+	return f.full
+}
+
+func TestDroppedEventsRecordedOnPlatformStart(t *testing.T) {
+	start := LogMessage{
+		Time:   "2020-11-03T21:10:25.133Z",
+		Type:   "platform.start",
+		Record: map[string]string{"requestId": "1"},
+	}
+	b, _ := json.Marshal([]LogMessage{nonJsonFunctionMessage, start, start})
+	memory := publisher.NewMemory()
+	client := &fakeDroppingEventCreator{Memory: memory, dropped: 5}
+	req, _ := http.NewRequest("POST", "/", bytes.NewBuffer(b))
+
+	handler(client, nil, nil).ServeHTTP(httptest.NewRecorder(), req)
+
+	events := memory.Events()
+	assert.Len(t, events, 3)
+	assert.NotContains(t, events[0].Fields(), droppedEventsField)
+	assert.Equal(t, int64(5), events[1].Fields()[droppedEventsField])
+	assert.NotContains(t, events[2].Fields(), droppedEventsField)
+}
+
+type fakeDroppingEventCreator struct {
+	*publisher.Memory
+	dropped int64
+}
+
+func (f *fakeDroppingEventCreator) DroppedSinceLastReport() int64 {
+	dropped := f.dropped
+	f.dropped = 0
+	return dropped
+}
+
+// benchmarkBatch builds a Telemetry API batch of about maxBytes, the size
+// of the largest batch LOGS_API_MAX_BYTES allows, mixing plain-text lines,
+// JSON lines and pre-parsed JSON records.
+func benchmarkBatch(b *testing.B, maxBytes int) ([]byte, int) {
+	var messages []LogMessage
+	size := 0
+	for i := 0; size < maxBytes; i++ {
+		var msg LogMessage
+		switch i % 3 {
+		case 0:
+			msg = nonJsonFunctionMessage
+		case 1:
+			msg = functionMessageFromLibhoneyTransmission
+		case 2:
+			msg = LogMessage{
+				Time: christmasTimestamp,
+				Type: "function",
+				Record: map[string]interface{}{
+					"timestamp":      christmasTimestamp,
+					"name":           "handle-request",
+					"duration_ms":    12.5,
+					"trace.trace_id": fmt.Sprintf("%032d", i),
+					"http.status":    200,
+				},
+			}
+		}
+		messages = append(messages, msg)
+		encoded, _ := json.Marshal(msg)
+		size += len(encoded)
+	}
+	body, err := json.Marshal(messages)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body, len(messages)
+}
+
+func BenchmarkHandler(b *testing.B) {
+	body, count := benchmarkBatch(b, 1024*1024)
+	client := publisher.NewMemory()
+	h := handler(client, nil, nil)
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rr.Code)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*count), "ns/event")
+}
+
+func TestBuildEventsPreservesOrder(t *testing.T) {
+	var raws []rawLogMessage
+	for i := 0; i < 10*minMessagesPerWorker; i++ {
+		record, _ := json.Marshal(fmt.Sprintf(`{"n": %d}`, i))
+		raws = append(raws, rawLogMessage{Type: "function", Time: christmasTimestamp, Record: record})
+	}
+	client := publisher.NewMemory()
+
+	logs, events := buildEvents(client, raws, 4)
+
+	assert.Len(t, logs, len(raws))
+	assert.Len(t, events, len(raws))
+	for i, event := range events {
+		assert.Equal(t, fmt.Sprintf(`{"n": %d}`, i), logs[i].Record)
+		assert.Equal(t, float64(i), event.Fields()["n"])
+	}
+}
+
+func BenchmarkBuildEvents(b *testing.B) {
+	body, count := benchmarkBatch(b, 1024*1024)
+	raws, err := decodeBatch(bytes.NewReader(body))
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := publisher.NewMemory()
+
+	for _, workers := range []int{1, 2, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				buildEvents(client, raws, workers)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*count), "ns/event")
+		})
+	}
+}
+
+func TestHandlerRecordsInitFieldsOnInitReport(t *testing.T) {
+	b, err := json.Marshal([]LogMessage{
+		{
+			Time:   "2020-11-03T21:10:25.100Z",
+			Type:   "platform.initStart",
+			Record: map[string]string{"initializationType": "on-demand"},
+		},
+		{
+			Time:   "2020-11-03T21:10:25.130Z",
+			Type:   "platform.initReport",
+			Record: map[string]interface{}{"initializationType": "on-demand", "status": "success"},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(b))
+	if err != nil {
+		t.Error(err)
+	}
+	init := &initFields{}
+	init.add(map[string]interface{}{"lambda_extension.api_key.status": "valid"})
+	client := publisher.NewMemory()
+	handler(client, nil, init).ServeHTTP(httptest.NewRecorder(), req)
+
+	events := client.Events()
+	if assert.Len(t, events, 2) {
+		assert.NotContains(t, events[0].Fields(), "lambda_extension.api_key.status")
+		assert.Equal(t, "valid", events[1].Fields()["lambda_extension.api_key.status"])
+		assert.Equal(t, "success", events[1].Fields()["status"])
+	}
+}
+
+func TestHandlerRecordsLateInitFieldsOnNextPlatformEvent(t *testing.T) {
+	post := func(init *initFields, client *publisher.Memory, messages ...LogMessage) {
+		b, err := json.Marshal(messages)
+		if err != nil {
+			t.Error(err)
+		}
+		req, err := http.NewRequest("POST", "/", bytes.NewBuffer(b))
+		if err != nil {
+			t.Error(err)
+		}
+		handler(client, nil, init).ServeHTTP(httptest.NewRecorder(), req)
+	}
+	init := &initFields{}
+	client := publisher.NewMemory()
+
+	post(init, client, LogMessage{
+		Time:   "2020-11-03T21:10:25.130Z",
+		Type:   "platform.initReport",
+		Record: map[string]interface{}{"initializationType": "on-demand", "status": "success"},
+	})
+	init.add(map[string]interface{}{"lambda_extension.api_key.status": "valid"})
+	post(init, client,
+		LogMessage{Time: "2020-11-03T21:10:25.150Z", Type: "function", Record: "A basic message to STDOUT"},
+		LogMessage{Time: "2020-11-03T21:10:25.160Z", Type: "platform.start", Record: map[string]interface{}{"requestId": "6d67e385"}},
+		LogMessage{Time: "2020-11-03T21:10:25.170Z", Type: "platform.runtimeDone", Record: map[string]interface{}{"requestId": "6d67e385"}},
+	)
+
+	events := client.Events()
+	if assert.Len(t, events, 4) {
+		assert.NotContains(t, events[0].Fields(), "lambda_extension.api_key.status")
+		assert.NotContains(t, events[1].Fields(), "lambda_extension.api_key.status")
+		assert.Equal(t, "valid", events[2].Fields()["lambda_extension.api_key.status"])
+		assert.NotContains(t, events[3].Fields(), "lambda_extension.api_key.status", "expected late fields to be recorded once")
+	}
+}